@@ -0,0 +1,56 @@
+// Copyright © 2018 J. Strobus White.
+// This file is part of the blocktop blockchain development kit.
+//
+// Blocktop is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// Blocktop is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with blocktop. If not, see <http://www.gnu.org/licenses/>.
+
+package cmd
+
+import (
+	p2p "github.com/blocktop/go-network-libp2p"
+
+	inet "github.com/libp2p/go-libp2p-net"
+	peer "github.com/libp2p/go-libp2p-peer"
+	"github.com/spf13/viper"
+)
+
+// peerAllowlist restricts the node to the peer IDs in node.allowlist plus
+// the static peers. Connections with any other peer are closed as soon as
+// they are established. An empty node.allowlist disables the allowlist.
+type peerAllowlist map[peer.ID]bool
+
+func buildAllowlist(node *p2p.NetworkNode, static *staticPeers) (peerAllowlist, error) {
+	ids := viper.GetStringSlice("node.allowlist")
+	if len(ids) == 0 {
+		return nil, nil
+	}
+
+	allow := make(peerAllowlist)
+	for _, s := range append(ids, static.ids()...) {
+		id, err := peer.IDB58Decode(s)
+		if err != nil {
+			return nil, err
+		}
+		allow[id] = true
+	}
+
+	node.Host.Network().Notify(&inet.NotifyBundle{
+		ConnectedF: func(n inet.Network, c inet.Conn) {
+			if !allow[c.RemotePeer()] {
+				p2pLog.WithField(logFieldPeer, c.RemotePeer().Pretty()).Debug("Rejecting connection from peer not in allowlist")
+				go n.ClosePeer(c.RemotePeer())
+			}
+		}})
+
+	return allow, nil
+}
@@ -18,6 +18,14 @@
 package cmd
 
 import (
+	"fmt"
+	"net/url"
+	"os"
+	"os/exec"
+	"strconv"
+	"syscall"
+	"time"
+
 	"github.com/blocktop/go-api"
 	"github.com/spf13/cobra"
 	"github.com/spf13/viper"
@@ -31,8 +39,29 @@ var apiCmd = &cobra.Command{
 
 By default the API is accessible at localhost:3000
 Monitor API health with
-	curl http://localhost:3000/api/`,
+	curl http://localhost:3000/api/
+It serves the node whose RPC server is at --rpcURL.
+
+Alongside it, the lucky API (REST endpoints under /api/v1, events,
+GraphQL at /api/graphql and the web UI, a block explorer, at /) is
+served at localhost:3001, see --extPort. It proxies to the RPC server
+of the node at --rpcURL for consensus metrics and the consensus tree,
+and to its control server at --nodeURL for kernel metrics, peers,
+events and health. To serve the
+API inside the node instead, start it with lucky blockchain --api.
+
+GraphQL subscriptions are served over a WebSocket at /api/graphql using
+the graphql-transport-ws protocol.`,
 	Run: func(cmd *cobra.Command, args []string) {
+		if err := targetGoAPI(viper.GetString("api.rpcURL")); err != nil {
+			failWithError(err)
+		}
+		if !apiGoAPIOnly {
+			backend := newRemoteAPIBackend(viper.GetString("api.rpcURL"), viper.GetString("api.nodeURL"))
+			ext := newAPIServer(backend)
+			ext.start()
+		}
+
 		err := api.Start()
 		if err != nil {
 			failWithError(err)
@@ -40,16 +69,109 @@ Monitor API health with
 	},
 }
 
+// apiGoAPIOnly serves only go-api, for the child process of startGoAPI.
+var apiGoAPIOnly bool
+
 func init() {
 	rootCmd.AddCommand(apiCmd)
 
 	apiCmd.PersistentFlags().String("apiHost", "localhost", `host for API server, set to 0.0.0.0 to
-expose publicly`)
+expose publicly, preferably with TLS`)
 	apiCmd.PersistentFlags().Int("apiPort", 3000, "API server port")
+	apiCmd.PersistentFlags().Int("extPort", 3001, "lucky API server port")
+	apiCmd.PersistentFlags().String("rpcURL", "http://localhost:28180/rpc", "RPC server URL of the node to serve")
+	apiCmd.PersistentFlags().String("nodeURL", "http://localhost:28181", "control server URL of the node to serve")
+	apiCmd.PersistentFlags().String("tlsCert", "", "TLS certificate file, serves HTTPS with --tlsKey")
+	apiCmd.PersistentFlags().String("tlsKey", "", "TLS key file")
+	apiCmd.PersistentFlags().Bool("selfSigned", false, `generate a self-signed certificate if --tlsCert and
+--tlsKey do not exist (default files are in the data directory)`)
+	apiCmd.PersistentFlags().StringArray("corsOrigin", []string{}, `origin allowed to use the API from a browser, e.g.
+https://explorer.example.com or *, may be specified more than once`)
+	apiCmd.PersistentFlags().Float64("rateLimit", 20, `requests per second allowed per client IP, counting
+WebSocket operations, 0 for no limit`)
+	apiCmd.PersistentFlags().Int64("maxRequestBytes", 1<<20, "max request body or WebSocket message size")
+	apiCmd.PersistentFlags().Bool("ui", true, "serve the web UI at /")
+	apiCmd.Flags().BoolVar(&apiGoAPIOnly, "goAPIOnly", false, "serve go-api without the lucky API")
+	apiCmd.Flags().MarkHidden("goAPIOnly")
 
 	viper.BindPFlag("api.host", apiCmd.PersistentFlags().Lookup("apiHost"))
 	viper.BindPFlag("api.port", apiCmd.PersistentFlags().Lookup("apiPort"))
+	viper.BindPFlag("api.ext.port", apiCmd.PersistentFlags().Lookup("extPort"))
+	viper.BindPFlag("api.rpcURL", apiCmd.PersistentFlags().Lookup("rpcURL"))
+	viper.BindPFlag("api.nodeURL", apiCmd.PersistentFlags().Lookup("nodeURL"))
+	viper.BindPFlag("api.tls.cert", apiCmd.PersistentFlags().Lookup("tlsCert"))
+	viper.BindPFlag("api.tls.key", apiCmd.PersistentFlags().Lookup("tlsKey"))
+	viper.BindPFlag("api.tls.selfSigned", apiCmd.PersistentFlags().Lookup("selfSigned"))
+	viper.BindPFlag("api.cors.origins", apiCmd.PersistentFlags().Lookup("corsOrigin"))
+	viper.BindPFlag("api.rateLimit", apiCmd.PersistentFlags().Lookup("rateLimit"))
+	viper.BindPFlag("api.maxRequestBytes", apiCmd.PersistentFlags().Lookup("maxRequestBytes"))
+	viper.BindPFlag("api.ui", apiCmd.PersistentFlags().Lookup("ui"))
 
 	viper.SetDefault("api.host", "localhost")
 	viper.SetDefault("api.port", 3000)
+	viper.SetDefault("api.ext.port", 3001)
+	viper.SetDefault("api.rpcURL", "http://localhost:28180/rpc")
+	viper.SetDefault("api.nodeURL", "http://localhost:28181")
+	viper.SetDefault("api.embed", false)
+	viper.SetDefault("api.ui", true)
+}
+
+// targetGoAPI points go-api at the RPC server at rpcURL. go-api reaches
+// the node through go-rpc-client, which reads rpc.host and rpc.port.
+func targetGoAPI(rpcURL string) error {
+	u, err := url.Parse(rpcURL)
+	if err != nil {
+		return fmt.Errorf("invalid --rpcURL: %v", err)
+	}
+	port, err := strconv.Atoi(u.Port())
+	if err != nil {
+		return fmt.Errorf("--rpcURL %s has no port", rpcURL)
+	}
+	viper.Set("rpc.host", u.Hostname())
+	viper.Set("rpc.port", port)
+	return nil
+}
+
+// startGoAPI serves the API of go-api for lucky blockchain --api. go-api
+// cannot be stopped, so it runs in a child lucky api process targeting the
+// node, which the returned function terminates when the node shuts down.
+func startGoAPI() (stop func(), err error) {
+	exe, err := os.Executable()
+	if err != nil {
+		return nil, err
+	}
+
+	args := []string{"api", "--goAPIOnly",
+		"--rpcURL", rpcURL(),
+		"--apiHost", viper.GetString("api.host"),
+		"--apiPort", strconv.Itoa(viper.GetInt("api.port"))}
+	if cfgFile != "" {
+		args = append(args, "--config", cfgFile)
+	}
+	cmd := exec.Command(exe, args...)
+	cmd.Stdout = os.Stderr
+	cmd.Stderr = os.Stderr
+	if err = cmd.Start(); err != nil {
+		return nil, err
+	}
+
+	exited := make(chan struct{})
+	go func() {
+		if err := cmd.Wait(); err != nil {
+			rpcLog.WithError(err).Info("API server exited")
+		}
+		close(exited)
+	}()
+
+	return func() {
+		if cmd.Process.Signal(syscall.SIGTERM) != nil {
+			cmd.Process.Kill()
+		}
+		select {
+		case <-exited:
+		case <-time.After(5 * time.Second):
+			cmd.Process.Kill()
+			<-exited
+		}
+	}, nil
 }
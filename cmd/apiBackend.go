@@ -0,0 +1,269 @@
+// Copyright © 2018 J. Strobus White.
+// This file is part of the blocktop blockchain development kit.
+//
+// Blocktop is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// Blocktop is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with blocktop. If not, see <http://www.gnu.org/licenses/>.
+
+package cmd
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	rpcconsensus "github.com/blocktop/go-rpc-client/consensus"
+	spec "github.com/blocktop/go-spec"
+)
+
+// apiBackend is the node the API server reports on. The node's own API
+// server uses the objects of the node directly; lucky api proxies to the
+// control server of a node.
+type apiBackend interface {
+	kernelMetrics() (json.RawMessage, error)
+	consensusMetrics() (json.RawMessage, error)
+	consensusTree() (json.RawMessage, error)
+	peers() ([]peerStatus, error)
+	// blockOrigins returns the origins of the tracked blocks of hashes
+	// by hash.
+	blockOrigins(hashes []string) (map[string]*blockOrigin, error)
+	health(ready bool) (*healthReport, error)
+
+	// events returns a channel of node events as for eventBus.subscribe.
+	// The channel is closed when cancel is called or the stream breaks.
+	events(types []string, after uint64) (ch <-chan *nodeEvent, cancel func())
+}
+
+// consensusReporter is the reporting side of the consensus of
+// go-consensus, which the RPC server serves metrics and the tree from.
+type consensusReporter interface {
+	GetMetrics(format string) (string, error)
+	GetTree(format string) (string, error)
+}
+
+// localAPIBackend serves the API from within the node, reading the
+// node's own blockchain and consensus rather than its RPC server.
+type localAPIBackend struct {
+	bc      spec.Blockchain
+	cons    spec.Consensus
+	rep     *peerReputation
+	nh      *nodeHealth
+	bus     *eventBus
+	tracker *blockTracker
+}
+
+func newLocalAPIBackend(bc spec.Blockchain, cons spec.Consensus, rep *peerReputation, health *nodeHealth, bus *eventBus, tracker *blockTracker) *localAPIBackend {
+	return &localAPIBackend{bc: bc, cons: cons, rep: rep, nh: health, bus: bus, tracker: tracker}
+}
+
+func (b *localAPIBackend) kernelMetrics() (json.RawMessage, error) {
+	res, err := nodeKernelMetrics("json")
+	if err != nil {
+		return nil, err
+	}
+	return metricsObject(res)
+}
+
+func (b *localAPIBackend) reporter() (consensusReporter, error) {
+	r, ok := b.cons.(consensusReporter)
+	if !ok {
+		return nil, errors.New("consensus of this node does not report metrics")
+	}
+	return r, nil
+}
+
+func (b *localAPIBackend) consensusMetrics() (json.RawMessage, error) {
+	r, err := b.reporter()
+	if err != nil {
+		return nil, err
+	}
+	res, err := r.GetMetrics("json")
+	if err != nil {
+		return nil, err
+	}
+	return metricsObject(res)
+}
+
+func (b *localAPIBackend) consensusTree() (json.RawMessage, error) {
+	r, err := b.reporter()
+	if err != nil {
+		return nil, err
+	}
+	res, err := r.GetTree("json")
+	if err != nil {
+		return nil, err
+	}
+	return nodeJSON(res)
+}
+
+func (b *localAPIBackend) peers() ([]peerStatus, error) {
+	return b.rep.status(), nil
+}
+
+func (b *localAPIBackend) blockOrigins(hashes []string) (map[string]*blockOrigin, error) {
+	return b.tracker.origins(hashes), nil
+}
+
+func (b *localAPIBackend) health(ready bool) (*healthReport, error) {
+	if ready {
+		return b.nh.ready(), nil
+	}
+	return b.nh.live(), nil
+}
+
+func (b *localAPIBackend) events(types []string, after uint64) (<-chan *nodeEvent, func()) {
+	return b.bus.subscribe(types, after)
+}
+
+// nodeJSON returns JSON that the node reported as a string, checking that
+// it is valid so that it can be embedded in responses.
+func nodeJSON(s string) (json.RawMessage, error) {
+	if !json.Valid([]byte(s)) {
+		return nil, errors.New("the node returned invalid JSON")
+	}
+	return json.RawMessage(s), nil
+}
+
+// eventPollTimeout is the timeout of long polls for events, which wait up
+// to 25 seconds for an event.
+const eventPollTimeout = 40 * time.Second
+
+// remoteAPIBackend serves the API from the RPC server of a node at
+// rpcURL, e.g. http://localhost:28180/rpc, for consensus metrics and the
+// consensus tree, and from its control server at url, e.g.
+// http://localhost:28181, for kernel metrics, peers, block origins, events
+// and health.
+type remoteAPIBackend struct {
+	url    string
+	rpcURL string
+	client *http.Client
+}
+
+func newRemoteAPIBackend(rpcURL string, url string) *remoteAPIBackend {
+	return &remoteAPIBackend{
+		url:    strings.TrimSuffix(url, "/"),
+		rpcURL: rpcURL,
+		client: &http.Client{Timeout: 10 * time.Second}}
+}
+
+func (b *remoteAPIBackend) call(method string, params interface{}, result interface{}) error {
+	return callControlURL(b.url+"/rpc", method, params, result)
+}
+
+// kernelMetrics returns the kernel metrics of the control server, which
+// hold the sections of lucky as those of the local backend do.
+func (b *remoteAPIBackend) kernelMetrics() (json.RawMessage, error) {
+	var res json.RawMessage
+	if err := b.call("kernel.metrics", &metricsParams{Format: "json"}, &res); err != nil {
+		return nil, err
+	}
+	return metricsObject(string(res))
+}
+
+func (b *remoteAPIBackend) consensusMetrics() (json.RawMessage, error) {
+	req := &rpcconsensus.GetMetricsRequest{}
+	var res rpcconsensus.GetMetricsResponse
+	if err := postNodeRPC(b.rpcURL, req.GetMetrics(rpcconsensus.GetMetricsArgs{Format: "json"}), &res); err != nil {
+		return nil, err
+	}
+	return metricsObject(res.Result.Metrics)
+}
+
+func (b *remoteAPIBackend) consensusTree() (json.RawMessage, error) {
+	req := &rpcconsensus.GetTreeRequest{}
+	var res rpcconsensus.GetTreeResponse
+	if err := postNodeRPC(b.rpcURL, req.GetTree(rpcconsensus.GetTreeArgs{Format: "json"}), &res); err != nil {
+		return nil, err
+	}
+	return nodeJSON(res.Result.Tree)
+}
+
+func (b *remoteAPIBackend) peers() ([]peerStatus, error) {
+	var res []peerStatus
+	err := b.call("peers.list", nil, &res)
+	return res, err
+}
+
+func (b *remoteAPIBackend) blockOrigins(hashes []string) (map[string]*blockOrigin, error) {
+	var res map[string]*blockOrigin
+	err := b.call("blocks.origins", &blockOriginsParams{Hashes: hashes}, &res)
+	return res, err
+}
+
+func (b *remoteAPIBackend) health(ready bool) (*healthReport, error) {
+	endpoint := "/healthz"
+	if ready {
+		endpoint = "/readyz"
+	}
+	res, err := b.client.Get(b.url + endpoint)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+
+	var report healthReport
+	if err = json.NewDecoder(res.Body).Decode(&report); err != nil {
+		return nil, errors.New("invalid health report from " + b.url + endpoint + ": " + err.Error())
+	}
+	return &report, nil
+}
+
+// events long-polls the events.poll control method.
+func (b *remoteAPIBackend) events(types []string, after uint64) (<-chan *nodeEvent, func()) {
+	ch := make(chan *nodeEvent, eventBufferSize)
+	done := make(chan struct{})
+	var once sync.Once
+
+	go func() {
+		defer close(ch)
+
+		if after == 0 {
+			var res eventPollResult
+			if err := b.call("events.poll", &eventPollParams{Latest: true}, &res); err != nil {
+				rpcLog.WithError(err).Debug("Failed to poll node events")
+				return
+			}
+			after = res.Last
+		}
+
+		for {
+			var res eventPollResult
+			err := callControlTimeout(b.url+"/rpc", eventPollTimeout, "events.poll",
+				&eventPollParams{After: after, Types: types, Wait: "25s"}, &res)
+			if err != nil {
+				rpcLog.WithError(err).Debug("Failed to poll node events")
+				return
+			}
+			for _, e := range res.Events {
+				select {
+				case ch <- e:
+				case <-done:
+					return
+				}
+			}
+			if res.Last > after {
+				after = res.Last
+			}
+
+			select {
+			case <-done:
+				return
+			default:
+			}
+		}
+	}()
+
+	return ch, func() { once.Do(func() { close(done) }) }
+}
@@ -0,0 +1,425 @@
+// Copyright © 2018 J. Strobus White.
+// This file is part of the blocktop blockchain development kit.
+//
+// Blocktop is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// Blocktop is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with blocktop. If not, see <http://www.gnu.org/licenses/>.
+
+package cmd
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+	graphql "github.com/graph-gophers/graphql-go"
+)
+
+// GraphQL is served at /api/graphql. Queries are sent as POST or GET
+// requests; subscriptions, and queries too, over a WebSocket speaking the
+// graphql-transport-ws protocol. Over the WebSocket, queries are answered
+// with a single result followed by complete.
+
+const (
+	graphQLWSProtocol    = "graphql-transport-ws"
+	graphQLWSInitTimeout = 10 * time.Second
+	graphQLWSMaxOps      = 32 // operations running at once per connection
+)
+
+// close codes of the graphql-transport-ws protocol
+const (
+	graphQLWSBadRequest      = 4400
+	graphQLWSUnauthorized    = 4401
+	graphQLWSInitTimedOut    = 4408
+	graphQLWSDuplicateID     = 4409
+	graphQLWSTooManyInitReqs = 4429
+)
+
+type graphQLRequest struct {
+	Query         string                 `json:"query"`
+	OperationName string                 `json:"operationName,omitempty"`
+	Variables     map[string]interface{} `json:"variables,omitempty"`
+}
+
+// graphQLWSMessage is a message of the graphql-transport-ws protocol.
+type graphQLWSMessage struct {
+	ID      string          `json:"id,omitempty"`
+	Type    string          `json:"type"`
+	Payload json.RawMessage `json:"payload,omitempty"`
+}
+
+func (s *apiServer) routeGraphQL() {
+	s.graphQL = newGraphQLSchema(s.backend)
+	s.mux.HandleFunc("/api/graphql", s.serveGraphQL)
+}
+
+func (s *apiServer) serveGraphQL(w http.ResponseWriter, r *http.Request) {
+	if websocket.IsWebSocketUpgrade(r) {
+		s.serveGraphQLWebSocket(w, r)
+		return
+	}
+
+	var req graphQLRequest
+	switch r.Method {
+	case http.MethodGet:
+		q := r.URL.Query()
+		req.Query = q.Get("query")
+		req.OperationName = q.Get("operationName")
+		if v := q.Get("variables"); v != "" {
+			if err := json.Unmarshal([]byte(v), &req.Variables); err != nil {
+				writeAPIError(w, http.StatusBadRequest, errors.New("invalid variables: "+err.Error()))
+				return
+			}
+		}
+	case http.MethodPost:
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			writeAPIError(w, http.StatusBadRequest, errors.New("invalid request: "+err.Error()))
+			return
+		}
+	default:
+		w.Header().Set("Allow", "GET, POST")
+		writeAPIError(w, http.StatusMethodNotAllowed, errors.New("method not allowed"))
+		return
+	}
+	if req.Query == "" {
+		writeAPIError(w, http.StatusBadRequest, errors.New("query is required"))
+		return
+	}
+
+	res := s.graphQL.Exec(withGraphQLBudget(r.Context()), req.Query, req.OperationName, req.Variables)
+	writeJSON(w, http.StatusOK, res)
+}
+
+// graphQLConn is a WebSocket connection of the graphql-transport-ws
+// protocol with its running operations. Each operation started counts
+// as a request against the rate limit of the client.
+type graphQLConn struct {
+	sync.Mutex
+	conn    *websocket.Conn
+	schema  *graphql.Schema
+	limiter *ipRateLimiter
+	ip      string
+	ops     map[string]*graphQLOp
+	acked   bool
+}
+
+type graphQLOp struct {
+	cancel context.CancelFunc
+}
+
+func (s *apiServer) serveGraphQLWebSocket(w http.ResponseWriter, r *http.Request) {
+	upgrader := s.upgrader
+	upgrader.Subprotocols = []string{graphQLWSProtocol}
+	conn, err := upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		return // Upgrade has replied
+	}
+	defer conn.Close()
+	if s.maxRequestBytes > 0 {
+		conn.SetReadLimit(s.maxRequestBytes)
+	}
+
+	c := &graphQLConn{conn: conn, schema: s.graphQL, limiter: s.limiter, ip: clientIP(r),
+		ops: make(map[string]*graphQLOp)}
+	defer c.cancelAll()
+
+	if conn.Subprotocol() != graphQLWSProtocol {
+		c.close(websocket.CloseProtocolError, "subprotocol "+graphQLWSProtocol+" required")
+		return
+	}
+
+	ctx, cancel := context.WithCancel(r.Context())
+	defer cancel()
+
+	conn.SetReadDeadline(time.Now().Add(graphQLWSInitTimeout))
+	for {
+		var msg graphQLWSMessage
+		if err := conn.ReadJSON(&msg); err != nil {
+			if ne, ok := err.(interface{ Timeout() bool }); ok && ne.Timeout() && !c.isAcked() {
+				c.close(graphQLWSInitTimedOut, "Connection initialisation timeout")
+			} else if _, ok := err.(*json.SyntaxError); ok {
+				c.close(graphQLWSBadRequest, "Invalid message")
+			}
+			return
+		}
+		if !c.handle(ctx, &msg) {
+			return
+		}
+	}
+}
+
+// handle handles one client message and returns whether to keep the
+// connection open.
+func (c *graphQLConn) handle(ctx context.Context, msg *graphQLWSMessage) bool {
+	switch msg.Type {
+	case "connection_init":
+		c.Lock()
+		acked := c.acked
+		c.acked = true
+		c.Unlock()
+		if acked {
+			c.close(graphQLWSTooManyInitReqs, "Too many initialisation requests")
+			return false
+		}
+		c.conn.SetReadDeadline(time.Time{})
+		c.send(&graphQLWSMessage{Type: "connection_ack"})
+
+	case "ping":
+		c.send(&graphQLWSMessage{Type: "pong"})
+
+	case "pong":
+
+	case "subscribe":
+		if !c.isAcked() {
+			c.close(graphQLWSUnauthorized, "Unauthorized")
+			return false
+		}
+		var req graphQLRequest
+		if msg.ID == "" || json.Unmarshal(msg.Payload, &req) != nil {
+			c.close(graphQLWSBadRequest, "Invalid message")
+			return false
+		}
+		if !c.limiter.allow(c.ip, time.Now()) {
+			c.sendError(msg.ID, "rate limit exceeded")
+			break
+		}
+		switch c.start(ctx, msg.ID, &req) {
+		case graphQLOpDuplicate:
+			c.close(graphQLWSDuplicateID, "Subscriber for "+msg.ID+" already exists")
+			return false
+		case graphQLOpTooMany:
+			c.sendError(msg.ID, fmt.Sprintf("too many operations, at most %d may run at once", graphQLWSMaxOps))
+		}
+
+	case "complete":
+		c.Lock()
+		if op, ok := c.ops[msg.ID]; ok {
+			op.cancel()
+			delete(c.ops, msg.ID)
+		}
+		c.Unlock()
+
+	default:
+		c.close(graphQLWSBadRequest, "Invalid message type: "+msg.Type)
+		return false
+	}
+	return true
+}
+
+// results of graphQLConn.start
+const (
+	graphQLOpStarted = iota
+	graphQLOpDuplicate
+	graphQLOpTooMany
+)
+
+// start runs the operation id, sending its results until it ends or is
+// completed by the client. It does not start the operation if id is
+// already running or too many operations are.
+func (c *graphQLConn) start(ctx context.Context, id string, req *graphQLRequest) int {
+	c.Lock()
+	defer c.Unlock()
+	if _, ok := c.ops[id]; ok {
+		return graphQLOpDuplicate
+	}
+	if len(c.ops) >= graphQLWSMaxOps {
+		return graphQLOpTooMany
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	op := &graphQLOp{cancel: cancel}
+	c.ops[id] = op
+
+	go func() {
+		defer cancel()
+
+		failed := c.run(ctx, id, req)
+
+		// the operation was completed by the client if it is no longer
+		// listed, and is not completed after an error
+		c.Lock()
+		running := c.ops[id] == op
+		if running {
+			delete(c.ops, id)
+		}
+		c.Unlock()
+		if running && !failed && ctx.Err() == nil {
+			c.send(&graphQLWSMessage{ID: id, Type: "complete"})
+		}
+	}()
+
+	return graphQLOpStarted
+}
+
+// run executes the operation id, sending its results, and returns whether
+// it failed. Queries and mutations are executed once, subscriptions send
+// a result for every event.
+func (c *graphQLConn) run(ctx context.Context, id string, req *graphQLRequest) bool {
+	if graphQLOperationType(req.Query, req.OperationName) != "subscription" {
+		res := c.schema.Exec(withGraphQLBudget(ctx), req.Query, req.OperationName, req.Variables)
+		return c.sendResult(id, res)
+	}
+
+	results, err := c.schema.Subscribe(ctx, req.Query, req.OperationName, req.Variables)
+	if err != nil {
+		c.sendError(id, err.Error())
+		return true
+	}
+	for r := range results {
+		res, ok := r.(*graphql.Response)
+		if !ok {
+			continue
+		}
+		if c.sendResult(id, res) {
+			return true
+		}
+	}
+	return false
+}
+
+// sendResult sends res as a next message, or as an error message if it
+// has no data, and returns whether it was an error.
+func (c *graphQLConn) sendResult(id string, res *graphql.Response) bool {
+	msg := &graphQLWSMessage{ID: id, Type: "next"}
+	failed := res.Data == nil && len(res.Errors) > 0
+	if failed {
+		msg.Type = "error"
+		msg.Payload, _ = json.Marshal(res.Errors)
+	} else {
+		msg.Payload, _ = json.Marshal(res)
+	}
+	c.send(msg)
+	return failed
+}
+
+// graphQLOperationType returns the type of the operation named name in
+// query, or of its only operation if name is empty: query, mutation or
+// subscription. It only scans the top level of the document; errors are
+// left to the schema to report, and an operation that is not found is
+// taken to be a query.
+func graphQLOperationType(query, name string) string {
+	type operation struct{ typ, name string }
+	ops := make([]operation, 0, 1)
+
+	depth := 0
+	pending := ""  // keyword of the definition being scanned
+	named := false // whether the pending definition has its name
+	for i := 0; i < len(query); {
+		ch := query[i]
+		switch {
+		case ch == '#':
+			for i < len(query) && query[i] != '\n' {
+				i++
+			}
+		case strings.HasPrefix(query[i:], `"""`):
+			end := strings.Index(query[i+3:], `"""`)
+			if end < 0 {
+				i = len(query)
+			} else {
+				i += end + 6
+			}
+		case ch == '"':
+			for i++; i < len(query) && query[i] != '"' && query[i] != '\n'; i++ {
+				if query[i] == '\\' {
+					i++
+				}
+			}
+			i++
+		case ch == '{' || ch == '(':
+			if depth == 0 && ch == '{' {
+				switch pending {
+				case "":
+					ops = append(ops, operation{typ: "query"})
+				case "query", "mutation", "subscription":
+					if !named {
+						ops = append(ops, operation{typ: pending})
+					}
+				}
+				pending, named = "", false
+			}
+			depth++
+			i++
+		case ch == '}' || ch == ')':
+			depth--
+			i++
+		case ch == '_' || ch >= 'A' && ch <= 'Z' || ch >= 'a' && ch <= 'z':
+			j := i
+			for j < len(query) && (query[j] == '_' || query[j] >= 'A' && query[j] <= 'Z' ||
+				query[j] >= 'a' && query[j] <= 'z' || query[j] >= '0' && query[j] <= '9') {
+				j++
+			}
+			word := query[i:j]
+			i = j
+			if depth != 0 {
+				break
+			}
+			switch {
+			case pending == "":
+				pending = word
+			case !named:
+				named = true
+				if pending == "query" || pending == "mutation" || pending == "subscription" {
+					ops = append(ops, operation{typ: pending, name: word})
+				}
+			}
+		default:
+			i++
+		}
+	}
+
+	for _, op := range ops {
+		if name == "" && len(ops) == 1 || op.name == name && name != "" {
+			return op.typ
+		}
+	}
+	return "query"
+}
+
+// sendError sends an error message with message for the operation id.
+func (c *graphQLConn) sendError(id string, message string) {
+	payload, _ := json.Marshal([]map[string]string{{"message": message}})
+	c.send(&graphQLWSMessage{ID: id, Type: "error", Payload: payload})
+}
+
+func (c *graphQLConn) isAcked() bool {
+	c.Lock()
+	defer c.Unlock()
+	return c.acked
+}
+
+func (c *graphQLConn) send(msg *graphQLWSMessage) {
+	c.Lock()
+	defer c.Unlock()
+	c.conn.SetWriteDeadline(time.Now().Add(10 * time.Second))
+	c.conn.WriteJSON(msg)
+}
+
+func (c *graphQLConn) close(code int, reason string) {
+	c.Lock()
+	defer c.Unlock()
+	c.conn.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(code, reason),
+		time.Now().Add(5*time.Second))
+}
+
+func (c *graphQLConn) cancelAll() {
+	c.Lock()
+	defer c.Unlock()
+	for id, op := range c.ops {
+		op.cancel()
+		delete(c.ops, id)
+	}
+}
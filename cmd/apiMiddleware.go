@@ -0,0 +1,219 @@
+// Copyright © 2018 J. Strobus White.
+// This file is part of the blocktop blockchain development kit.
+//
+// Blocktop is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// Blocktop is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with blocktop. If not, see <http://www.gnu.org/licenses/>.
+
+package cmd
+
+import (
+	"bufio"
+	"errors"
+	"math"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+)
+
+// apiLimiterIdle is how long the rate limiter remembers a client that
+// sends no requests.
+const apiLimiterIdle = 10 * time.Minute
+
+func init() {
+	viper.SetDefault("api.cors.origins", []string{})
+	viper.SetDefault("api.rateLimit", 20) // requests/second per client IP, 0 for no limit
+	viper.SetDefault("api.maxRequestBytes", 1<<20)
+	viper.SetDefault("api.accessLog", true)
+}
+
+// apiHandler wraps the API routes with access logging, CORS, per client
+// rate limiting and a request size limit, outermost first.
+func (s *apiServer) apiHandler() http.Handler {
+	var h http.Handler = s.mux
+	h = limitRequestSize(h, s.maxRequestBytes)
+	h = s.limiter.wrap(h)
+	h = s.cors(h)
+	if viper.GetBool("api.accessLog") {
+		h = accessLog(h)
+	}
+	return h
+}
+
+func limitRequestSize(h http.Handler, max int64) http.Handler {
+	if max <= 0 {
+		return h
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.ContentLength > max {
+			writeAPIError(w, http.StatusRequestEntityTooLarge, errors.New("request body too large"))
+			return
+		}
+		r.Body = http.MaxBytesReader(w, r.Body, max)
+		h.ServeHTTP(w, r)
+	})
+}
+
+// allowedOrigin reports whether a browser page from origin may use the
+// API. Pages served by the API itself are always allowed.
+func (s *apiServer) allowedOrigin(origin string, host string) bool {
+	if u, err := url.Parse(origin); err == nil && u.Host == host {
+		return true
+	}
+	for _, o := range s.origins {
+		if o == "*" || strings.EqualFold(o, origin) {
+			return true
+		}
+	}
+	return false
+}
+
+func (s *apiServer) cors(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		origin := r.Header.Get("Origin")
+		if origin == "" || !s.allowedOrigin(origin, r.Host) {
+			h.ServeHTTP(w, r)
+			return
+		}
+
+		w.Header().Set("Access-Control-Allow-Origin", origin)
+		w.Header().Add("Vary", "Origin")
+		if r.Method == http.MethodOptions && r.Header.Get("Access-Control-Request-Method") != "" {
+			w.Header().Set("Access-Control-Allow-Methods", "GET, HEAD, POST, OPTIONS")
+			w.Header().Set("Access-Control-Allow-Headers", "Content-Type, Last-Event-ID")
+			w.Header().Set("Access-Control-Max-Age", "600")
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+		h.ServeHTTP(w, r)
+	})
+}
+
+// ipRateLimiter limits the requests per second of each client IP. A
+// client may send a burst of up to a second's worth of requests, but at
+// least one.
+type ipRateLimiter struct {
+	sync.Mutex
+	rate    float64
+	clients map[string]*tokenBucket
+	swept   time.Time
+}
+
+func newIPRateLimiter(rate float64) *ipRateLimiter {
+	return &ipRateLimiter{rate: rate, clients: make(map[string]*tokenBucket), swept: time.Now()}
+}
+
+func (l *ipRateLimiter) allow(ip string, now time.Time) bool {
+	if l.rate <= 0 {
+		return true
+	}
+	l.Lock()
+	defer l.Unlock()
+
+	if now.Sub(l.swept) > apiLimiterIdle {
+		for c, b := range l.clients {
+			if now.Sub(b.last) > apiLimiterIdle {
+				delete(l.clients, c)
+			}
+		}
+		l.swept = now
+	}
+
+	b, ok := l.clients[ip]
+	if !ok {
+		b = newTokenBucket(l.rate, math.Max(1, l.rate))
+		l.clients[ip] = b
+	}
+	return b.take(1, now)
+}
+
+func (l *ipRateLimiter) wrap(h http.Handler) http.Handler {
+	if l.rate <= 0 {
+		return h
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !l.allow(clientIP(r), time.Now()) {
+			w.Header().Set("Retry-After", "1")
+			writeAPIError(w, http.StatusTooManyRequests, errors.New("rate limit exceeded"))
+			return
+		}
+		h.ServeHTTP(w, r)
+	})
+}
+
+func clientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// loggedResponse records the status and size of a response. It passes
+// flushing and hijacking through for event streams.
+type loggedResponse struct {
+	http.ResponseWriter
+	status int
+	bytes  int64
+}
+
+func (w *loggedResponse) WriteHeader(status int) {
+	w.status = status
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *loggedResponse) Write(b []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	n, err := w.ResponseWriter.Write(b)
+	w.bytes += int64(n)
+	return n, err
+}
+
+func (w *loggedResponse) Flush() {
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+func (w *loggedResponse) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	hj, ok := w.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, errors.New("hijacking not supported")
+	}
+	w.status = http.StatusSwitchingProtocols
+	return hj.Hijack()
+}
+
+func accessLog(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		lw := &loggedResponse{ResponseWriter: w}
+		h.ServeHTTP(lw, r)
+
+		rpcLog.WithFields(logrus.Fields{
+			"remote":   clientIP(r),
+			"method":   r.Method,
+			"path":     r.URL.RequestURI(),
+			"status":   lw.status,
+			"bytes":    lw.bytes,
+			"duration": time.Since(start).String(),
+			"agent":    r.UserAgent()}).Info("API request")
+	})
+}
@@ -0,0 +1,137 @@
+// Copyright © 2018 J. Strobus White.
+// This file is part of the blocktop blockchain development kit.
+//
+// Blocktop is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// Blocktop is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with blocktop. If not, see <http://www.gnu.org/licenses/>.
+
+package cmd
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/gorilla/websocket"
+	graphql "github.com/graph-gophers/graphql-go"
+	"github.com/spf13/viper"
+)
+
+// apiServer is the HTTP API of lucky, served next to the API server of
+// go-api. It runs inside the node with lucky blockchain --api, or
+// standalone with lucky api.
+type apiServer struct {
+	backend         apiBackend
+	mux             *http.ServeMux
+	srv             *http.Server
+	origins         []string
+	limiter         *ipRateLimiter
+	maxRequestBytes int64
+	upgrader        websocket.Upgrader
+	graphQL         *graphql.Schema
+}
+
+func apiAddr() string {
+	return fmt.Sprintf("%s:%d", viper.GetString("api.host"), viper.GetInt("api.ext.port"))
+}
+
+func newAPIServer(backend apiBackend) *apiServer {
+	s := &apiServer{
+		backend:         backend,
+		mux:             http.NewServeMux(),
+		origins:         viper.GetStringSlice("api.cors.origins"),
+		limiter:         newIPRateLimiter(viper.GetFloat64("api.rateLimit")),
+		maxRequestBytes: viper.GetInt64("api.maxRequestBytes")}
+	s.upgrader.CheckOrigin = func(r *http.Request) bool {
+		origin := r.Header.Get("Origin")
+		return origin == "" || s.allowedOrigin(origin, r.Host)
+	}
+	s.srv = &http.Server{
+		Addr:              apiAddr(),
+		Handler:           s.apiHandler(),
+		ReadHeaderTimeout: 10 * time.Second,
+		MaxHeaderBytes:    64 << 10}
+
+	s.mux.HandleFunc("/api/", s.serveHealth)
+	s.routeV1()
+	s.routeGraphQL()
+	s.routeWebUI()
+
+	return s
+}
+
+// start serves the API in the background until stop is called.
+func (s *apiServer) start() {
+	go func() {
+		if err := s.run(); err != nil {
+			rpcLog.WithError(err).Error("API server failed")
+		}
+	}()
+}
+
+// run serves the API until the server fails or is stopped.
+func (s *apiServer) run() error {
+	cert, key, err := apiTLSFiles()
+	if err != nil {
+		return err
+	}
+
+	if cert != "" {
+		rpcLog.WithField("addr", s.srv.Addr).Info("Serving API over TLS")
+		err = s.srv.ListenAndServeTLS(cert, key)
+	} else {
+		rpcLog.WithField("addr", s.srv.Addr).Info("Serving API")
+		err = s.srv.ListenAndServe()
+	}
+	if err == http.ErrServerClosed {
+		return nil
+	}
+	return err
+}
+
+// stop shuts the server down, waiting for open requests until ctx is
+// done.
+func (s *apiServer) stop(ctx context.Context) {
+	if err := s.srv.Shutdown(ctx); err != nil {
+		s.srv.Close()
+	}
+}
+
+// serveHealth reports that the API is up, along with the liveness of the
+// node behind it.
+func (s *apiServer) serveHealth(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path != "/api/" {
+		writeAPIError(w, http.StatusNotFound, fmt.Errorf("not found: %s", r.URL.Path))
+		return
+	}
+
+	res := map[string]interface{}{"status": healthOK}
+	report, err := s.backend.health(false)
+	if err != nil {
+		res["nodeError"] = err.Error()
+	} else {
+		res["node"] = report
+	}
+	writeJSON(w, http.StatusOK, res)
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+func writeAPIError(w http.ResponseWriter, status int, err error) {
+	writeJSON(w, status, map[string]string{"error": err.Error()})
+}
@@ -0,0 +1,122 @@
+// Copyright © 2018 J. Strobus White.
+// This file is part of the blocktop blockchain development kit.
+//
+// Blocktop is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// Blocktop is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with blocktop. If not, see <http://www.gnu.org/licenses/>.
+
+package cmd
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"os"
+	"path"
+	"time"
+
+	"github.com/spf13/viper"
+)
+
+func init() {
+	viper.SetDefault("api.tls.cert", "")
+	viper.SetDefault("api.tls.key", "")
+	viper.SetDefault("api.tls.selfSigned", false)
+}
+
+// apiTLSFiles returns the certificate and key files the API is served
+// with, or empty strings to serve plain HTTP. With api.tls.selfSigned a
+// certificate is generated if the files do not exist yet.
+func apiTLSFiles() (string, string, error) {
+	cert, key := viper.GetString("api.tls.cert"), viper.GetString("api.tls.key")
+	selfSigned := viper.GetBool("api.tls.selfSigned")
+
+	if selfSigned {
+		dir := dataDir()
+		if cert == "" {
+			cert = path.Join(dir, "api-cert.pem")
+		}
+		if key == "" {
+			key = path.Join(dir, "api-key.pem")
+		}
+		if !fileExists(cert) || !fileExists(key) {
+			if err := generateSelfSignedCert(cert, key, viper.GetString("api.host")); err != nil {
+				return "", "", err
+			}
+			rpcLog.WithField("cert", cert).Warn("Generated a self-signed API certificate")
+		}
+	}
+
+	if (cert == "") != (key == "") {
+		return "", "", errors.New("both a TLS certificate and key are required")
+	}
+	return cert, key, nil
+}
+
+// generateSelfSignedCert writes a self-signed certificate valid for a
+// year for localhost, the host name and host, and its key.
+func generateSelfSignedCert(certFile string, keyFile string, host string) error {
+	priv, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return err
+	}
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return err
+	}
+
+	now := time.Now()
+	tmpl := &x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               pkix.Name{Organization: []string{"lucky"}, CommonName: "lucky api"},
+		NotBefore:             now.Add(-time.Hour),
+		NotAfter:              now.AddDate(1, 0, 0),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageKeyEncipherment,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+		DNSNames:              []string{"localhost"},
+		IPAddresses:           []net.IP{net.IPv4(127, 0, 0, 1), net.IPv6loopback}}
+
+	if name, err := os.Hostname(); err == nil {
+		tmpl.DNSNames = append(tmpl.DNSNames, name)
+	}
+	if ip := net.ParseIP(host); ip != nil {
+		if !ip.IsUnspecified() {
+			tmpl.IPAddresses = append(tmpl.IPAddresses, ip)
+		}
+	} else if host != "" && host != "localhost" {
+		tmpl.DNSNames = append(tmpl.DNSNames, host)
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &priv.PublicKey, priv)
+	if err != nil {
+		return err
+	}
+	keyDer, err := x509.MarshalECPrivateKey(priv)
+	if err != nil {
+		return err
+	}
+
+	makeDirAll(path.Dir(certFile))
+	makeDirAll(path.Dir(keyFile))
+	if err = ioutil.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer}), 0600); err != nil {
+		return err
+	}
+	return ioutil.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0644)
+}
@@ -0,0 +1,299 @@
+// Copyright © 2018 J. Strobus White.
+// This file is part of the blocktop blockchain development kit.
+//
+// Blocktop is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// Blocktop is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with blocktop. If not, see <http://www.gnu.org/licenses/>.
+
+package cmd
+
+import (
+	_ "embed" // for the OpenAPI document
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// openAPIDocument describes the /api/v1 endpoints. Keep it in step with
+// the handlers below.
+//
+//go:embed openapi.json
+var openAPIDocument []byte
+
+const (
+	apiDefaultLimit = 50
+	apiMaxLimit     = 500
+)
+
+// apiPage is a page of a list resource. Next is the URL of the next page,
+// if there is one.
+type apiPage struct {
+	Items  interface{} `json:"items"`
+	Total  int         `json:"total"`
+	Offset int         `json:"offset"`
+	Limit  int         `json:"limit"`
+	Next   string      `json:"next,omitempty"`
+}
+
+// apiBlock is a block of the consensus tree. Siblings are the competing
+// blocks with the same parent.
+type apiBlock struct {
+	Hash        string   `json:"hash"`
+	ParentHash  string   `json:"parentHash"`
+	Number      uint64   `json:"blockNumber"`
+	Head        bool     `json:"head"`
+	OnHeadChain bool     `json:"onHeadChain"`
+	Children    []string `json:"children"`
+	Siblings    []string `json:"siblings"`
+}
+
+func (s *apiServer) routeV1() {
+	s.mux.HandleFunc("/api/v1/openapi.json", apiGet(s.serveOpenAPI))
+	s.mux.HandleFunc("/api/v1/blocks", apiGet(s.serveBlocks))
+	s.mux.HandleFunc("/api/v1/blocks/", apiGet(s.serveBlock))
+	s.mux.HandleFunc("/api/v1/head", apiGet(s.serveHead))
+	s.mux.HandleFunc("/api/v1/consensus/tree", apiGet(s.serveRaw(s.backend.consensusTree)))
+	s.mux.HandleFunc("/api/v1/consensus/metrics", apiGet(s.serveRaw(s.backend.consensusMetrics)))
+	s.mux.HandleFunc("/api/v1/kernel/metrics", apiGet(s.serveRaw(s.backend.kernelMetrics)))
+	s.mux.HandleFunc("/api/v1/peers", apiGet(s.servePeers))
+	s.mux.HandleFunc("/api/v1/events", apiGet(s.serveEvents))
+	s.mux.HandleFunc("/api/v1/events/ws", apiGet(s.serveEventsWebSocket))
+}
+
+// apiGet rejects requests other than GET and HEAD.
+func apiGet(h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet && r.Method != http.MethodHead {
+			w.Header().Set("Allow", "GET, HEAD")
+			writeAPIError(w, http.StatusMethodNotAllowed, errors.New("method not allowed"))
+			return
+		}
+		h(w, r)
+	}
+}
+
+func (s *apiServer) serveOpenAPI(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(openAPIDocument)
+}
+
+func (s *apiServer) serveRaw(get func() (json.RawMessage, error)) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		res, err := get()
+		if err != nil {
+			writeAPIError(w, http.StatusServiceUnavailable, err)
+			return
+		}
+		writeJSON(w, http.StatusOK, res)
+	}
+}
+
+func (s *apiServer) tree() (*consensusTree, error) {
+	raw, err := s.backend.consensusTree()
+	if err != nil {
+		return nil, err
+	}
+	return parseConsensusTree(raw)
+}
+
+// serveBlocks lists the blocks of the consensus tree, highest first. With
+// chain=head only the blocks on the chain of the consensus head are
+// listed.
+func (s *apiServer) serveBlocks(w http.ResponseWriter, r *http.Request) {
+	offset, limit, err := parsePage(r.URL.Query())
+	if err != nil {
+		writeAPIError(w, http.StatusBadRequest, err)
+		return
+	}
+	tree, err := s.tree()
+	if err != nil {
+		writeAPIError(w, http.StatusServiceUnavailable, err)
+		return
+	}
+
+	blocks := make([]*treeBlock, 0, len(tree.blocks))
+	switch chain := r.URL.Query().Get("chain"); chain {
+	case "":
+		for _, b := range tree.blocks {
+			blocks = append(blocks, b)
+		}
+	case "head":
+		if head := tree.head(); head != nil {
+			blocks = tree.ancestors(head.Hash)
+		}
+	default:
+		writeAPIError(w, http.StatusBadRequest, fmt.Errorf("unknown chain: %s", chain))
+		return
+	}
+	sort.Slice(blocks, func(i, j int) bool {
+		if blocks[i].Number != blocks[j].Number {
+			return blocks[i].Number > blocks[j].Number
+		}
+		return blocks[i].Hash < blocks[j].Hash
+	})
+
+	lo, hi := pageBounds(len(blocks), offset, limit)
+	items := make([]*apiBlock, 0, hi-lo)
+	onChain := headChain(tree)
+	for _, b := range blocks[lo:hi] {
+		items = append(items, newAPIBlock(tree, b, onChain))
+	}
+	writeJSON(w, http.StatusOK, newAPIPage(r, items, len(blocks), offset, limit))
+}
+
+// serveBlock returns a block by hash or by number. Of several blocks with
+// the same number, the one on the chain of the consensus head is
+// returned, or else the one with the lowest hash.
+func (s *apiServer) serveBlock(w http.ResponseWriter, r *http.Request) {
+	id := strings.TrimPrefix(r.URL.Path, "/api/v1/blocks/")
+	if id == "" || strings.Contains(id, "/") {
+		writeAPIError(w, http.StatusNotFound, fmt.Errorf("not found: %s", r.URL.Path))
+		return
+	}
+	tree, err := s.tree()
+	if err != nil {
+		writeAPIError(w, http.StatusServiceUnavailable, err)
+		return
+	}
+	onChain := headChain(tree)
+
+	if b, ok := tree.blocks[id]; ok {
+		writeJSON(w, http.StatusOK, newAPIBlock(tree, b, onChain))
+		return
+	}
+
+	number, err := strconv.ParseUint(id, 10, 64)
+	if err != nil {
+		writeAPIError(w, http.StatusNotFound, fmt.Errorf("block %s is not in the consensus tree", id))
+		return
+	}
+	var found *treeBlock
+	for _, b := range tree.blocks {
+		if b.Number != number {
+			continue
+		}
+		if found == nil || onChain[b.Hash] && !onChain[found.Hash] ||
+			onChain[b.Hash] == onChain[found.Hash] && b.Hash < found.Hash {
+			found = b
+		}
+	}
+	if found == nil {
+		writeAPIError(w, http.StatusNotFound, fmt.Errorf("block %d is not in the consensus tree", number))
+		return
+	}
+	writeJSON(w, http.StatusOK, newAPIBlock(tree, found, onChain))
+}
+
+func (s *apiServer) serveHead(w http.ResponseWriter, r *http.Request) {
+	tree, err := s.tree()
+	if err != nil {
+		writeAPIError(w, http.StatusServiceUnavailable, err)
+		return
+	}
+	head := tree.head()
+	if head == nil {
+		writeAPIError(w, http.StatusNotFound, errors.New("no consensus head yet"))
+		return
+	}
+	writeJSON(w, http.StatusOK, newAPIBlock(tree, head, headChain(tree)))
+}
+
+func (s *apiServer) servePeers(w http.ResponseWriter, r *http.Request) {
+	offset, limit, err := parsePage(r.URL.Query())
+	if err != nil {
+		writeAPIError(w, http.StatusBadRequest, err)
+		return
+	}
+	peers, err := s.backend.peers()
+	if err != nil {
+		writeAPIError(w, http.StatusServiceUnavailable, err)
+		return
+	}
+
+	sort.Slice(peers, func(i, j int) bool { return peers[i].PeerID < peers[j].PeerID })
+	lo, hi := pageBounds(len(peers), offset, limit)
+	writeJSON(w, http.StatusOK, newAPIPage(r, peers[lo:hi], len(peers), offset, limit))
+}
+
+func headChain(tree *consensusTree) map[string]bool {
+	onChain := make(map[string]bool)
+	if head := tree.head(); head != nil {
+		for _, b := range tree.ancestors(head.Hash) {
+			onChain[b.Hash] = true
+		}
+	}
+	return onChain
+}
+
+func newAPIBlock(tree *consensusTree, b *treeBlock, onChain map[string]bool) *apiBlock {
+	res := &apiBlock{
+		Hash:        b.Hash,
+		ParentHash:  b.ParentHash,
+		Number:      b.Number,
+		OnHeadChain: onChain[b.Hash],
+		Children:    append([]string{}, tree.children[b.Hash]...),
+		Siblings:    make([]string, 0)}
+	if head := tree.head(); head != nil {
+		res.Head = head.Hash == b.Hash
+	}
+	for _, h := range tree.children[b.ParentHash] {
+		if h != b.Hash {
+			res.Siblings = append(res.Siblings, h)
+		}
+	}
+	sort.Strings(res.Children)
+	sort.Strings(res.Siblings)
+	return res
+}
+
+// parsePage reads the offset and limit query parameters.
+func parsePage(q url.Values) (offset int, limit int, err error) {
+	limit = apiDefaultLimit
+	if v := q.Get("offset"); v != "" {
+		if offset, err = strconv.Atoi(v); err != nil || offset < 0 {
+			return 0, 0, fmt.Errorf("invalid offset: %s", v)
+		}
+	}
+	if v := q.Get("limit"); v != "" {
+		if limit, err = strconv.Atoi(v); err != nil || limit < 1 || limit > apiMaxLimit {
+			return 0, 0, fmt.Errorf("invalid limit: %s, must be 1 to %d", v, apiMaxLimit)
+		}
+	}
+	return offset, limit, nil
+}
+
+func pageBounds(total int, offset int, limit int) (int, int) {
+	if offset > total {
+		offset = total
+	}
+	end := offset + limit
+	if end > total {
+		end = total
+	}
+	return offset, end
+}
+
+func newAPIPage(r *http.Request, items interface{}, total int, offset int, limit int) *apiPage {
+	p := &apiPage{Items: items, Total: total, Offset: offset, Limit: limit}
+	if offset+limit < total {
+		q := r.URL.Query()
+		q.Set("offset", strconv.Itoa(offset+limit))
+		q.Set("limit", strconv.Itoa(limit))
+		p.Next = r.URL.Path + "?" + q.Encode()
+	}
+	return p
+}
@@ -0,0 +1,160 @@
+// Copyright © 2018 J. Strobus White.
+// This file is part of the blocktop blockchain development kit.
+//
+// Blocktop is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// Blocktop is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with blocktop. If not, see <http://www.gnu.org/licenses/>.
+
+package cmd
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path"
+	"sort"
+	"sync"
+	"time"
+)
+
+// banEntry records a banned peer. Bans counts how often the peer has been
+// banned automatically and drives the backoff of the next ban.
+type banEntry struct {
+	PeerID    string    `json:"peerID"`
+	Until     time.Time `json:"until"`
+	Permanent bool      `json:"permanent"`
+	Bans      int       `json:"bans"`
+	Reason    string    `json:"reason,omitempty"`
+}
+
+func (e *banEntry) active(now time.Time) bool {
+	return e.Permanent || now.Before(e.Until)
+}
+
+// banList is the set of banned peers, persisted as JSON in the data
+// directory so that bans survive restarts.
+type banList struct {
+	sync.Mutex
+	file    string
+	entries map[string]*banEntry
+}
+
+func banListFile() string {
+	return path.Join(dataDir(), "banlist.json")
+}
+
+func loadBanList(file string) (*banList, error) {
+	b := &banList{file: file, entries: make(map[string]*banEntry)}
+
+	data, err := ioutil.ReadFile(file)
+	if os.IsNotExist(err) {
+		return b, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var entries []*banEntry
+	if err = json.Unmarshal(data, &entries); err != nil {
+		return nil, err
+	}
+	for _, e := range entries {
+		b.entries[e.PeerID] = e
+	}
+
+	return b, nil
+}
+
+func (b *banList) save() error {
+	b.Lock()
+	entries := make([]*banEntry, 0, len(b.entries))
+	for _, e := range b.entries {
+		entries = append(entries, e)
+	}
+	b.Unlock()
+
+	sort.Slice(entries, func(i, j int) bool { return entries[i].PeerID < entries[j].PeerID })
+	data, err := json.MarshalIndent(entries, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	makeDirAll(path.Dir(b.file))
+	tmp := b.file + ".tmp"
+	if err = ioutil.WriteFile(tmp, data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, b.file)
+}
+
+func (b *banList) isBanned(peerID string, now time.Time) bool {
+	b.Lock()
+	defer b.Unlock()
+
+	e, ok := b.entries[peerID]
+	return ok && e.active(now)
+}
+
+// bans returns the number of times peerID has been banned before.
+func (b *banList) bans(peerID string) int {
+	b.Lock()
+	defer b.Unlock()
+
+	if e, ok := b.entries[peerID]; ok {
+		return e.Bans
+	}
+	return 0
+}
+
+// ban bans peerID for d, or permanently if d is zero.
+func (b *banList) ban(peerID string, d time.Duration, reason string, now time.Time) banEntry {
+	b.Lock()
+	defer b.Unlock()
+
+	e, ok := b.entries[peerID]
+	if !ok {
+		e = &banEntry{PeerID: peerID}
+		b.entries[peerID] = e
+	}
+	e.Bans++
+	e.Reason = reason
+	e.Permanent = d == 0
+	e.Until = now.Add(d)
+
+	return *e
+}
+
+// unban lifts any ban on peerID and forgets its ban history.
+func (b *banList) unban(peerID string) bool {
+	b.Lock()
+	defer b.Unlock()
+
+	_, ok := b.entries[peerID]
+	delete(b.entries, peerID)
+	return ok
+}
+
+// active returns the bans in effect at now.
+func (b *banList) active(now time.Time) []banEntry {
+	b.Lock()
+	defer b.Unlock()
+
+	res := make([]banEntry, 0)
+	for _, e := range b.entries {
+		if e.active(now) {
+			res = append(res, *e)
+		}
+	}
+	sort.Slice(res, func(i, j int) bool { return res[i].PeerID < res[j].PeerID })
+
+	return res
+}
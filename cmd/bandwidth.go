@@ -0,0 +1,382 @@
+// Copyright © 2018 J. Strobus White.
+// This file is part of the blocktop blockchain development kit.
+//
+// Blocktop is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// Blocktop is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with blocktop. If not, see <http://www.gnu.org/licenses/>.
+
+package cmd
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"math"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	spec "github.com/blocktop/go-spec"
+
+	"github.com/spf13/cast"
+	"github.com/spf13/viper"
+)
+
+// tokenBucket is a rate limiter allowing rate units per second with bursts
+// of up to burst units. A zero rate means unlimited. A bucket may go into
+// debt, so that a message larger than the burst passes when the bucket is
+// full and the following ones wait until the debt is paid back.
+type tokenBucket struct {
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+func newTokenBucket(rate float64, burst float64) *tokenBucket {
+	return &tokenBucket{rate: rate, burst: burst, tokens: burst, last: time.Now()}
+}
+
+func (b *tokenBucket) refill(now time.Time) {
+	b.tokens = math.Min(b.burst, b.tokens+b.rate*now.Sub(b.last).Seconds())
+	b.last = now
+}
+
+// ready reports whether n units may be taken now.
+func (b *tokenBucket) ready(n float64, now time.Time) bool {
+	if b.rate <= 0 {
+		return true
+	}
+	b.refill(now)
+	return b.tokens >= math.Min(n, b.burst)
+}
+
+// take takes n units if they may be taken now.
+func (b *tokenBucket) take(n float64, now time.Time) bool {
+	if !b.ready(n, now) {
+		return false
+	}
+	if b.rate > 0 {
+		b.tokens -= n
+	}
+	return true
+}
+
+// reserve takes n units, going into debt if need be, and returns how long
+// to wait until they are covered.
+func (b *tokenBucket) reserve(n float64, now time.Time) time.Duration {
+	if b.rate <= 0 {
+		return 0
+	}
+	b.refill(now)
+	b.tokens -= n
+	if b.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-b.tokens / b.rate * float64(time.Second))
+}
+
+// full reports whether the bucket has refilled completely, i.e. it would
+// be the same as a new bucket.
+func (b *tokenBucket) full(now time.Time) bool {
+	if b.rate <= 0 {
+		return true
+	}
+	b.refill(now)
+	return b.tokens >= b.burst
+}
+
+// gossipPeerIdle is how long the limiter keeps the bucket of a peer that
+// sent nothing.
+const gossipPeerIdle = 5 * time.Minute
+
+// gossipOutQueue is the number of broadcast messages that may wait for
+// bandwidth before further ones are dropped.
+const gossipOutQueue = 256
+
+// gossipLimiter caps the bandwidth used by block gossip, globally and per
+// peer, and rate limits gossip messages per protocol.
+//
+// Received messages over a limit are dropped. They have been received by
+// then, so inbound limits protect the node from processing floods, not the
+// link. Broadcast messages are instead delayed until the limits allow them
+// and only dropped when too many are waiting, so that the node does not
+// lose its own blocks.
+type gossipLimiter struct {
+	sync.Mutex
+	conns         *connLimits
+	globalRate    float64
+	peerRate      float64
+	maxMessage    float64
+	protocolRates map[string]float64
+	globalIn      *tokenBucket
+	globalOut     *tokenBucket
+	peerOut       *tokenBucket
+	peers         map[string]*tokenBucket
+	protocols     map[string]*tokenBucket
+	out           chan *gossipOutMessage
+	usage         gossipUsage
+	last          gossipUsage
+}
+
+type gossipOutMessage struct {
+	msg  *spec.NetworkMessage
+	next gossipHandler
+}
+
+type gossipUsage struct {
+	BytesIn         int64            `json:"bytesIn"`
+	BytesOut        int64            `json:"bytesOut"`
+	MessagesIn      int64            `json:"messagesIn"`
+	MessagesOut     int64            `json:"messagesOut"`
+	BytesInPerSec   int64            `json:"bytesInPerSec"`
+	BytesOutPerSec  int64            `json:"bytesOutPerSec"`
+	OutQueued       int              `json:"outQueued"`
+	Dropped         map[string]int64 `json:"dropped"`
+	GlobalLimit     int64            `json:"globalLimit"`
+	PeerLimit       int64            `json:"peerLimit"`
+	ConnectionUsage connUsage        `json:"connections"`
+}
+
+func buildGossipLimiter(conns *connLimits) *gossipLimiter {
+	l := &gossipLimiter{
+		conns:         conns,
+		globalRate:    viper.GetFloat64("node.bandwidth.global"),
+		peerRate:      viper.GetFloat64("node.bandwidth.perPeer"),
+		maxMessage:    viper.GetFloat64("node.gossip.maxMessageSize"),
+		protocolRates: make(map[string]float64),
+		peers:         make(map[string]*tokenBucket),
+		protocols:     make(map[string]*tokenBucket),
+		out:           make(chan *gossipOutMessage, gossipOutQueue),
+		usage:         gossipUsage{Dropped: make(map[string]int64)}}
+	l.globalIn = l.bandwidthBucket(l.globalRate)
+	l.globalOut = l.bandwidthBucket(l.globalRate)
+	l.peerOut = l.bandwidthBucket(l.peerRate)
+
+	// viper lower cases map keys, so protocols are matched case insensitively
+	for p, r := range viper.GetStringMap("node.gossip.rateLimits") {
+		l.protocolRates[p] = cast.ToFloat64(r)
+	}
+
+	registerControlMethod("network.usage", controlMethodDoc{
+		summary: "Gossip bandwidth usage and limits.",
+		result:  &gossipUsage{}},
+		func(json.RawMessage) (interface{}, error) {
+			return l.snapshot(), nil
+		})
+	registerKernelMetrics("network", func() interface{} {
+		u := l.snapshot()
+		return &u
+	})
+
+	return l
+}
+
+// bandwidthBucket returns a bucket of rate bytes per second whose burst
+// holds at least the largest gossip message, which could never pass
+// otherwise.
+func (l *gossipLimiter) bandwidthBucket(rate float64) *tokenBucket {
+	return newTokenBucket(rate, math.Max(rate, l.maxMessage))
+}
+
+// start samples the gossip throughput every second, evicts the buckets of
+// idle peers and sends broadcast messages until ctx is done.
+func (l *gossipLimiter) start(ctx context.Context) {
+	go func() {
+		ticker := time.NewTicker(time.Second)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case now := <-ticker.C:
+				l.Lock()
+				l.usage.BytesInPerSec = l.usage.BytesIn - l.last.BytesIn
+				l.usage.BytesOutPerSec = l.usage.BytesOut - l.last.BytesOut
+				l.last = l.usage
+				for p, b := range l.peers {
+					if now.Sub(b.last) > gossipPeerIdle && b.full(now) {
+						delete(l.peers, p)
+					}
+				}
+				l.Unlock()
+			}
+		}
+	}()
+
+	go l.send(ctx)
+}
+
+func (l *gossipLimiter) inbound(msg *spec.NetworkMessage, next gossipHandler) {
+	size := float64(len(msg.Data))
+	now := time.Now()
+
+	l.Lock()
+	pb, ok := l.peers[msg.From]
+	if !ok {
+		pb = l.bandwidthBucket(l.peerRate)
+		l.peers[msg.From] = pb
+	}
+	protocol := l.protocolBucket(msg)
+	reason := ""
+	switch {
+	case !protocol.ready(1, now):
+		reason = "protocolRate"
+	case !pb.ready(size, now):
+		reason = "peerBandwidth"
+	case !l.globalIn.ready(size, now):
+		reason = "globalBandwidth"
+	default:
+		protocol.take(1, now)
+		pb.take(size, now)
+		l.globalIn.take(size, now)
+		l.usage.BytesIn += int64(size)
+		l.usage.MessagesIn++
+	}
+	if reason != "" {
+		l.usage.Dropped["in."+reason]++
+	}
+	l.Unlock()
+
+	if reason == "" {
+		next(msg)
+	}
+}
+
+// outbound queues a broadcast message to be sent when the limits allow.
+func (l *gossipLimiter) outbound(msg *spec.NetworkMessage, next gossipHandler) {
+	select {
+	case l.out <- &gossipOutMessage{msg: msg, next: next}:
+	default:
+		l.Lock()
+		l.usage.Dropped["out.queueFull"]++
+		l.Unlock()
+		p2pLog.WithField(logFieldBlock, msg.Hash).Warn("Dropped broadcast message, too many are waiting for bandwidth")
+	}
+}
+
+// send sends queued broadcast messages in order, waiting for the limits.
+// A broadcast message is sent to every connected peer, so it is charged
+// once per peer against the global limit, and once against the per peer
+// limit, which every peer sees the same way.
+func (l *gossipLimiter) send(ctx context.Context) {
+	for {
+		var o *gossipOutMessage
+		select {
+		case <-ctx.Done():
+			return
+		case o = <-l.out:
+		}
+
+		size := float64(len(o.msg.Data))
+		peers := float64(len(l.conns.node.Host.Network().Peers()))
+		now := time.Now()
+
+		l.Lock()
+		wait := l.protocolBucket(o.msg).reserve(1, now)
+		if w := l.peerOut.reserve(size, now); w > wait {
+			wait = w
+		}
+		if w := l.globalOut.reserve(size*peers, now); w > wait {
+			wait = w
+		}
+		l.Unlock()
+
+		if wait > 0 {
+			t := time.NewTimer(wait)
+			select {
+			case <-ctx.Done():
+				t.Stop()
+				return
+			case <-t.C:
+			}
+		}
+
+		o.next(o.msg)
+
+		l.Lock()
+		l.usage.BytesOut += int64(size * peers)
+		l.usage.MessagesOut++
+		l.Unlock()
+	}
+}
+
+// protocolBucket returns the rate limiter for the message's protocol. The
+// caller must hold the lock.
+func (l *gossipLimiter) protocolBucket(msg *spec.NetworkMessage) *tokenBucket {
+	p := strings.ToLower(protocolName(msg))
+	b, ok := l.protocols[p]
+	if !ok {
+		rate, ok := l.protocolRates[p]
+		if !ok {
+			rate = l.protocolRates["*"]
+		}
+		b = newTokenBucket(rate, math.Max(rate, 1))
+		l.protocols[p] = b
+	}
+	return b
+}
+
+func (l *gossipLimiter) snapshot() gossipUsage {
+	l.Lock()
+	defer l.Unlock()
+
+	u := l.usage
+	u.Dropped = make(map[string]int64, len(l.usage.Dropped))
+	for k, v := range l.usage.Dropped {
+		u.Dropped[k] = v
+	}
+	u.OutQueued = len(l.out)
+	u.GlobalLimit = int64(l.globalRate)
+	u.PeerLimit = int64(l.peerRate)
+	u.ConnectionUsage = l.conns.usage()
+
+	return u
+}
+
+func protocolName(msg *spec.NetworkMessage) string {
+	if msg.Protocol == nil {
+		return ""
+	}
+	return msg.Protocol.String()
+}
+
+// String formats u as a section of the text kernel metrics.
+func (u *gossipUsage) String() string {
+	limit := func(l int64) string {
+		if l <= 0 {
+			return "unlimited"
+		}
+		return fmt.Sprintf("%d B/s", l)
+	}
+
+	var b strings.Builder
+	fmt.Fprintln(&b, "Network:")
+	fmt.Fprintf(&b, "  peers:          %d (%d inbound, %d outbound connections)\n",
+		u.ConnectionUsage.Peers, u.ConnectionUsage.Inbound, u.ConnectionUsage.Outbound)
+	fmt.Fprintf(&b, "  gossip in:      %d B/s, %d messages, %d bytes total\n", u.BytesInPerSec, u.MessagesIn, u.BytesIn)
+	fmt.Fprintf(&b, "  gossip out:     %d B/s, %d messages, %d bytes total, %d waiting\n", u.BytesOutPerSec, u.MessagesOut, u.BytesOut, u.OutQueued)
+	fmt.Fprintf(&b, "  global limit:   %s\n", limit(u.GlobalLimit))
+	fmt.Fprintf(&b, "  per peer limit: %s\n", limit(u.PeerLimit))
+
+	reasons := make([]string, 0, len(u.Dropped))
+	for r := range u.Dropped {
+		reasons = append(reasons, r)
+	}
+	sort.Strings(reasons)
+	for _, r := range reasons {
+		fmt.Fprintf(&b, "  dropped %s: %d\n", r, u.Dropped[r])
+	}
+	return b.String()
+}
@@ -0,0 +1,104 @@
+// Copyright © 2018 J. Strobus White.
+// This file is part of the blocktop blockchain development kit.
+//
+// Blocktop is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// Blocktop is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with blocktop. If not, see <http://www.gnu.org/licenses/>.
+
+package cmd
+
+import (
+	"testing"
+	"time"
+)
+
+func TestTokenBucket(t *testing.T) {
+	type step struct {
+		op   string // take, ready, reserve or full
+		n    float64
+		at   time.Duration
+		ok   bool
+		wait time.Duration
+	}
+
+	tests := []struct {
+		name  string
+		rate  float64
+		burst float64
+		steps []step
+	}{
+		{"unlimited", 0, 0, []step{
+			{"take", 1e9, 0, true, 0},
+			{"reserve", 1e9, 0, true, 0},
+			{"full", 0, 0, true, 0},
+		}},
+		{"burst then refill", 10, 20, []step{
+			{"take", 15, 0, true, 0},
+			{"take", 10, 0, false, 0},
+			{"ready", 5, 0, true, 0},
+			{"take", 5, 0, true, 0},
+			{"take", 1, 0, false, 0},
+			{"take", 5, 500 * time.Millisecond, true, 0},
+			{"full", 0, time.Second, false, 0},
+			{"full", 0, 2500 * time.Millisecond, true, 0},
+		}},
+		{"refill is capped at the burst", 10, 20, []step{
+			{"take", 20, 0, true, 0},
+			{"full", 0, time.Minute, true, 0},
+			{"take", 21, time.Minute, true, 0},
+			{"ready", 1, time.Minute, false, 0},
+		}},
+		{"larger than the burst passes when full", 10, 20, []step{
+			{"ready", 50, 0, true, 0},
+			{"take", 50, 0, true, 0},
+			{"ready", 1, 2 * time.Second, false, 0},
+			{"ready", 1, 3100 * time.Millisecond, true, 0},
+		}},
+		{"reserve goes into debt", 10, 20, []step{
+			{"reserve", 20, 0, true, 0},
+			{"reserve", 5, 0, true, 500 * time.Millisecond},
+			{"reserve", 10, 0, true, 1500 * time.Millisecond},
+			{"reserve", 10, 2 * time.Second, true, 500 * time.Millisecond},
+			{"full", 0, 4 * time.Second, false, 0},
+			{"full", 0, 6500 * time.Millisecond, true, 0},
+		}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			start := time.Now()
+			b := newTokenBucket(tt.rate, tt.burst)
+			b.last = start
+			for i, s := range tt.steps {
+				now := start.Add(s.at)
+				switch s.op {
+				case "take":
+					if ok := b.take(s.n, now); ok != s.ok {
+						t.Errorf("step %d: take(%v) = %v, want %v", i, s.n, ok, s.ok)
+					}
+				case "ready":
+					if ok := b.ready(s.n, now); ok != s.ok {
+						t.Errorf("step %d: ready(%v) = %v, want %v", i, s.n, ok, s.ok)
+					}
+				case "reserve":
+					if wait := b.reserve(s.n, now); wait != s.wait {
+						t.Errorf("step %d: reserve(%v) = %v, want %v", i, s.n, wait, s.wait)
+					}
+				case "full":
+					if ok := b.full(now); ok != s.ok {
+						t.Errorf("step %d: full = %v, want %v", i, ok, s.ok)
+					}
+				}
+			}
+		})
+	}
+}
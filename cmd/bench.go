@@ -0,0 +1,274 @@
+// Copyright © 2018 J. Strobus White.
+// This file is part of the blocktop blockchain development kit.
+//
+// Blocktop is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// Blocktop is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with blocktop. If not, see <http://www.gnu.org/licenses/>.
+
+package cmd
+
+import (
+	"fmt"
+	"io/ioutil"
+	"math"
+	"os"
+	"path"
+	"sort"
+	"text/tabwriter"
+	"time"
+
+	"github.com/spf13/cobra"
+)
+
+// benchCmd represents the bench command
+var benchCmd = &cobra.Command{
+	Use:   "bench",
+	Short: "Measures block propagation and consensus convergence on a local network.",
+	Long: `Usage: lucky bench [OPTIONS]
+
+Runs a network of nodes as child processes on the loopback interface for
+every combination of the swept parameters and measures:
+
+  - propagation latency percentiles, from a block's broadcast by its
+    producer to its receipt by each other node
+  - the share of compared blocks that were disqualified
+  - the share of blocks off the final consensus head's chain (orphans)
+  - the share of samples in which all nodes agreed on the consensus head
+  - CPU use and peak memory per node
+
+For example, to compare block frequencies and receive concurrency:
+
+	lucky bench --blockFrequency 1,2,4 --receiveConcurrency 1,2,4`,
+	Run: func(cmd *cobra.Command, args []string) {
+		dir, err := ioutil.TempDir("", "lucky-bench-")
+		if err != nil {
+			failWithError(err)
+		}
+		if !benchKeep {
+			defer os.RemoveAll(dir)
+		}
+
+		results := make([]*benchResult, 0)
+		for _, f := range benchFrequencies {
+			for _, rc := range benchReceiveConcurrency {
+				for _, bc := range benchBroadcastConcurrency {
+					run := &benchResult{BlockFrequency: f, ReceiveConcurrency: rc, BroadcastConcurrency: bc}
+					fmt.Fprintf(os.Stderr, "Running blockFrequency=%v receiveconcurrency=%d broadcastconcurrency=%d\n", f, rc, bc)
+					runDir := path.Join(dir, fmt.Sprintf("run%d", len(results)+1))
+					if err := run.measure(runDir); err != nil {
+						failWithError(err)
+					}
+					results = append(results, run)
+				}
+			}
+		}
+		if benchKeep {
+			fmt.Fprintln(os.Stderr, "Node configs and logs kept in", dir)
+		}
+
+		printResult(results, func() { printBenchResults(results) })
+	},
+}
+
+var (
+	benchNodes                int
+	benchBasePort             int
+	benchDuration             time.Duration
+	benchWarmup               time.Duration
+	benchFrequencies          []float64
+	benchReceiveConcurrency   []int
+	benchBroadcastConcurrency []int
+	benchKeep                 bool
+	benchJSON                 bool
+)
+
+func init() {
+	rootCmd.AddCommand(benchCmd)
+
+	flags := benchCmd.Flags()
+	flags.IntVarP(&benchNodes, "nodes", "n", 3, "number of nodes in the network")
+	flags.IntVar(&benchBasePort, "basePort", 31000, "first port used by the network")
+	flags.DurationVarP(&benchDuration, "duration", "d", time.Minute, "measurement time per run")
+	flags.DurationVar(&benchWarmup, "warmup", 10*time.Second, "time given to the network before measuring")
+	flags.Float64SliceVarP(&benchFrequencies, "blockFrequency", "f", []float64{1}, "block frequencies to sweep")
+	flags.IntSliceVar(&benchReceiveConcurrency, "receiveConcurrency", []int{2}, "blockchain.receiveconcurrency values to sweep")
+	flags.IntSliceVar(&benchBroadcastConcurrency, "broadcastConcurrency", []int{4}, "node.broadcastconcurrency values to sweep")
+	flags.BoolVar(&benchKeep, "keep", false, "keep node configs and logs")
+	flags.BoolVarP(&benchJSON, "json", "j", false, "output in json")
+	deprecateJSONFlag(flags)
+}
+
+// benchResult holds the parameters and measurements of one bench run.
+// Latencies are in milliseconds, rates and CPU in percent.
+type benchResult struct {
+	BlockFrequency       float64 `json:"blockFrequency"`
+	ReceiveConcurrency   int     `json:"receiveConcurrency"`
+	BroadcastConcurrency int     `json:"broadcastConcurrency"`
+	Blocks               int     `json:"blocks"`
+	Deliveries           int     `json:"deliveries"`
+	LatencyP50           float64 `json:"latencyP50"`
+	LatencyP90           float64 `json:"latencyP90"`
+	LatencyP99           float64 `json:"latencyP99"`
+	LatencyMax           float64 `json:"latencyMax"`
+	DisqualifiedRate     float64 `json:"disqualifiedRate"`
+	OrphanRate           float64 `json:"orphanRate"`
+	ConvergedRate        float64 `json:"convergedRate"`
+	CPUPercent           float64 `json:"cpuPercent"`
+	PeakMemoryMB         float64 `json:"peakMemoryMB"`
+}
+
+func (r *benchResult) measure(dir string) error {
+	net, err := newDevnet(dir, &devnetConfig{
+		Nodes:          benchNodes,
+		BasePort:       benchBasePort,
+		BlockFrequency: r.BlockFrequency,
+		Settings: map[string]interface{}{
+			"blockchain.receiveconcurrency": r.ReceiveConcurrency,
+			"node.broadcastconcurrency":     r.BroadcastConcurrency}})
+	if err != nil {
+		return err
+	}
+	if err = net.start(); err != nil {
+		return err
+	}
+	defer net.stop()
+
+	time.Sleep(benchWarmup)
+
+	start := time.Now()
+	cpuStart := make([]float64, len(net.nodes))
+	for i, n := range net.nodes {
+		var s runtimeStats
+		if err = callControlAt(n.controlAddr(), "diag.runtime", nil, &s); err != nil {
+			return err
+		}
+		cpuStart[i] = s.CPUSeconds
+	}
+
+	samples, converged := 0, 0
+	peakMem := uint64(0)
+	cpuUsed := 0.0
+	for time.Since(start) < benchDuration {
+		time.Sleep(time.Second)
+
+		heads := make(map[string]bool)
+		for _, n := range net.nodes {
+			var s runtimeStats
+			if callControlAt(n.controlAddr(), "diag.runtime", nil, &s) == nil && s.Sys > peakMem {
+				peakMem = s.Sys
+			}
+			if tree, err := fetchConsensusTree(n.controlAddr()); err == nil && tree.head() != nil {
+				heads[tree.head().Hash] = true
+			} else {
+				heads[""] = true
+			}
+		}
+		samples++
+		if len(heads) == 1 && !heads[""] {
+			converged++
+		}
+	}
+	elapsed := time.Since(start).Seconds()
+
+	produced := make(map[string]int64)
+	latencies := make([]float64, 0)
+	compared, disqualified := 0, 0
+	tracked := make([]*trackedBlocks, len(net.nodes))
+	for i, n := range net.nodes {
+		var s runtimeStats
+		if err = callControlAt(n.controlAddr(), "diag.runtime", nil, &s); err != nil {
+			return err
+		}
+		cpuUsed += s.CPUSeconds - cpuStart[i]
+
+		tracked[i] = &trackedBlocks{}
+		if err = callControlAt(n.controlAddr(), "blocks.tracked", &trackedBlocksParams{Since: start.UnixNano()}, tracked[i]); err != nil {
+			return err
+		}
+		for h, at := range tracked[i].Produced {
+			produced[h] = at
+		}
+		compared += tracked[i].Compared
+		disqualified += tracked[i].Disqualified
+	}
+	for _, t := range tracked {
+		for h, at := range t.Received {
+			if p, ok := produced[h]; ok && at >= p {
+				latencies = append(latencies, float64(at-p)/float64(time.Millisecond))
+			}
+		}
+	}
+
+	r.Blocks = len(produced)
+	r.Deliveries = len(latencies)
+	sort.Float64s(latencies)
+	r.LatencyP50 = percentile(latencies, 50)
+	r.LatencyP90 = percentile(latencies, 90)
+	r.LatencyP99 = percentile(latencies, 99)
+	r.LatencyMax = percentile(latencies, 100)
+	if compared > 0 {
+		r.DisqualifiedRate = 100 * float64(disqualified) / float64(compared)
+	}
+	if samples > 0 {
+		r.ConvergedRate = 100 * float64(converged) / float64(samples)
+	}
+	r.CPUPercent = 100 * cpuUsed / elapsed / float64(len(net.nodes))
+	r.PeakMemoryMB = float64(peakMem) / (1 << 20)
+
+	// Orphans are produced blocks still in the consensus tree of node 1
+	// that are not on the chain of its consensus head.
+	if tree, err := fetchConsensusTree(net.nodes[0].controlAddr()); err == nil && tree.head() != nil {
+		chain := make(map[string]bool)
+		for _, b := range tree.ancestors(tree.head().Hash) {
+			chain[b.Hash] = true
+		}
+		inTree, orphans := 0, 0
+		for h := range produced {
+			if _, ok := tree.blocks[h]; ok {
+				inTree++
+				if !chain[h] {
+					orphans++
+				}
+			}
+		}
+		if inTree > 0 {
+			r.OrphanRate = 100 * float64(orphans) / float64(inTree)
+		}
+	}
+
+	return nil
+}
+
+// percentile returns the p-th percentile of the sorted values.
+func percentile(sorted []float64, p float64) float64 {
+	if len(sorted) == 0 {
+		return 0
+	}
+	i := int(math.Ceil(p/100*float64(len(sorted)))) - 1
+	if i < 0 {
+		i = 0
+	}
+	return sorted[i]
+}
+
+func printBenchResults(results []*benchResult) {
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', tabwriter.AlignRight)
+	defer w.Flush()
+
+	fmt.Fprintln(w, "FREQ\tRECV\tBCAST\tBLOCKS\tP50 ms\tP90 ms\tP99 ms\tMAX ms\tDISQ %\tORPHAN %\tCONV %\tCPU %\tMEM MB\t")
+	for _, r := range results {
+		fmt.Fprintf(w, "%v\t%d\t%d\t%d\t%.1f\t%.1f\t%.1f\t%.1f\t%.1f\t%.1f\t%.1f\t%.1f\t%.1f\t\n",
+			r.BlockFrequency, r.ReceiveConcurrency, r.BroadcastConcurrency, r.Blocks,
+			r.LatencyP50, r.LatencyP90, r.LatencyP99, r.LatencyMax,
+			r.DisqualifiedRate, r.OrphanRate, r.ConvergedRate, r.CPUPercent, r.PeakMemoryMB)
+	}
+}
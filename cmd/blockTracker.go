@@ -0,0 +1,262 @@
+// Copyright © 2018 J. Strobus White.
+// This file is part of the blocktop blockchain development kit.
+//
+// Blocktop is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// Blocktop is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with blocktop. If not, see <http://www.gnu.org/licenses/>.
+
+package cmd
+
+import (
+	"encoding/json"
+	"sync"
+	"time"
+
+	spec "github.com/blocktop/go-spec"
+)
+
+const (
+	// maxTrackedBlocks bounds the number of blocks the block tracker
+	// remembers, blockTrackerHorizon how long it keeps them beyond that.
+	maxTrackedBlocks    = 20000
+	blockTrackerHorizon = 10 * time.Minute
+)
+
+// blockTracker records when the node first broadcast or received each
+// block, and which blocks the block comparator saw and disqualified. It
+// feeds propagation measurements such as those of lucky bench.
+type blockTracker struct {
+	sync.Mutex
+	produced     map[string]int64
+	received     map[string]int64
+	compared     map[string]int64
+	disqualified map[string]int64
+	from         map[string]string
+	lastBlock    time.Time
+	self         string
+}
+
+type trackedBlocks struct {
+	Produced     map[string]int64 `json:"produced"`
+	Received     map[string]int64 `json:"received"`
+	Compared     int              `json:"compared"`
+	Disqualified int              `json:"disqualified"`
+}
+
+type trackedBlocksParams struct {
+	Since int64 `json:"since"` // unix nanoseconds
+}
+
+// blockOrigin tells where a block came from: produced by this node, or
+// first received from Peer.
+type blockOrigin struct {
+	Hash  string `json:"hash"`
+	Local bool   `json:"local"`
+	Peer  string `json:"peer"`
+	Seen  int64  `json:"seen"` // unix nanoseconds
+}
+
+type blockOriginParams struct {
+	Hash string `json:"hash"`
+}
+
+type blockOriginsParams struct {
+	Hashes []string `json:"hashes"`
+}
+
+func buildBlockTracker(self string) *blockTracker {
+	t := &blockTracker{
+		produced:     make(map[string]int64),
+		received:     make(map[string]int64),
+		compared:     make(map[string]int64),
+		disqualified: make(map[string]int64),
+		from:         make(map[string]string),
+		self:         self}
+
+	registerControlMethod("blocks.origin", controlMethodDoc{
+		summary: "The peer a block was first seen from, or null if the block is not tracked.",
+		params:  &blockOriginParams{},
+		result:  &blockOrigin{}},
+		func(params json.RawMessage) (interface{}, error) {
+			var p blockOriginParams
+			if err := decodeControlParams(params, &p); err != nil {
+				return nil, err
+			}
+			return t.origin(p.Hash), nil
+		})
+
+	registerControlMethod("blocks.origins", controlMethodDoc{
+		summary: "The origins of several blocks by hash. Blocks that are not tracked are left out.",
+		params:  &blockOriginsParams{},
+		result:  map[string]*blockOrigin{}},
+		func(params json.RawMessage) (interface{}, error) {
+			var p blockOriginsParams
+			if err := decodeControlParams(params, &p); err != nil {
+				return nil, err
+			}
+			return t.origins(p.Hashes), nil
+		})
+
+	registerControlMethod("blocks.tracked", controlMethodDoc{
+		summary: "The blocks seen since a time in unix nanoseconds.",
+		params:  &trackedBlocksParams{},
+		result:  &trackedBlocks{}},
+		func(params json.RawMessage) (interface{}, error) {
+			var p trackedBlocksParams
+			if err := decodeControlParams(params, &p); err != nil {
+				return nil, err
+			}
+			return t.since(p.Since), nil
+		})
+
+	return t
+}
+
+func (t *blockTracker) inbound(msg *spec.NetworkMessage, next gossipHandler) {
+	t.Lock()
+	t.lastBlock = time.Now()
+	if _, ok := t.produced[msg.Hash]; !ok {
+		t.record(t.received, msg.Hash)
+		if _, ok := t.from[msg.Hash]; !ok {
+			if len(t.from) >= maxTrackedBlocks {
+				for h := range t.from {
+					if _, ok := t.received[h]; !ok {
+						delete(t.from, h)
+					}
+				}
+			}
+			t.from[msg.Hash] = msg.From
+		}
+	}
+	t.Unlock()
+
+	next(msg)
+}
+
+func (t *blockTracker) outbound(msg *spec.NetworkMessage, next gossipHandler) {
+	t.Lock()
+	t.lastBlock = time.Now()
+	if _, ok := t.received[msg.Hash]; !ok {
+		t.record(t.produced, msg.Hash)
+	}
+	t.Unlock()
+
+	next(msg)
+}
+
+// record notes the first time hash was seen. The caller must hold the
+// lock.
+func (t *blockTracker) record(m map[string]int64, hash string) {
+	if _, ok := m[hash]; ok {
+		return
+	}
+	now := time.Now()
+	if len(m) >= maxTrackedBlocks {
+		horizon := now.Add(-blockTrackerHorizon).UnixNano()
+		for h, at := range m {
+			if at < horizon {
+				delete(m, h)
+			}
+		}
+	}
+	m[hash] = now.UnixNano()
+}
+
+// comparator wraps the consensus block comparator to track compared and
+// disqualified blocks.
+func (t *blockTracker) comparator(compare spec.BlockComparator) spec.BlockComparator {
+	return func(blocks []spec.Block) spec.Block {
+		winner := compare(blocks)
+
+		t.Lock()
+		for _, b := range blocks {
+			t.record(t.compared, b.Hash())
+			if winner == nil || b.Hash() != winner.Hash() {
+				t.record(t.disqualified, b.Hash())
+			}
+		}
+		t.Unlock()
+
+		return winner
+	}
+}
+
+// origin returns where the block with hash came from, or nil if the
+// tracker does not know the block.
+func (t *blockTracker) origin(hash string) *blockOrigin {
+	t.Lock()
+	defer t.Unlock()
+	return t.originLocked(hash)
+}
+
+// origins returns the origins of the tracked blocks of hashes by hash.
+func (t *blockTracker) origins(hashes []string) map[string]*blockOrigin {
+	t.Lock()
+	defer t.Unlock()
+
+	res := make(map[string]*blockOrigin, len(hashes))
+	for _, h := range hashes {
+		if o := t.originLocked(h); o != nil {
+			res[h] = o
+		}
+	}
+	return res
+}
+
+// originLocked is origin for the caller holding the lock.
+func (t *blockTracker) originLocked(hash string) *blockOrigin {
+	if at, ok := t.produced[hash]; ok {
+		return &blockOrigin{Hash: hash, Local: true, Peer: t.self, Seen: at}
+	}
+	if at, ok := t.received[hash]; ok {
+		return &blockOrigin{Hash: hash, Peer: t.from[hash], Seen: at}
+	}
+	return nil
+}
+
+// lastActivity returns when a block was last broadcast or received, or
+// the zero time if none was.
+func (t *blockTracker) lastActivity() time.Time {
+	t.Lock()
+	defer t.Unlock()
+	return t.lastBlock
+}
+
+func (t *blockTracker) since(since int64) *trackedBlocks {
+	t.Lock()
+	defer t.Unlock()
+
+	res := &trackedBlocks{
+		Produced: make(map[string]int64),
+		Received: make(map[string]int64)}
+	for h, at := range t.produced {
+		if at >= since {
+			res.Produced[h] = at
+		}
+	}
+	for h, at := range t.received {
+		if at >= since {
+			res.Received[h] = at
+		}
+	}
+	for _, at := range t.compared {
+		if at >= since {
+			res.Compared++
+		}
+	}
+	for _, at := range t.disqualified {
+		if at >= since {
+			res.Disqualified++
+		}
+	}
+	return res
+}
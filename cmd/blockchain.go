@@ -36,7 +36,6 @@ import (
 	consensus "github.com/blocktop/go-consensus"
 	luckyblock "github.com/blocktop/go-luckyblock"
 	p2p "github.com/blocktop/go-network-libp2p"
-	rpc "github.com/blocktop/go-rpc-server"
 	spec "github.com/blocktop/go-spec"
 
 	"github.com/golang/glog"
@@ -57,20 +56,6 @@ var blockchainCmd = &cobra.Command{
 			failWithError(errors.New("config file not found. Use the init command to create it"))
 		}
 
-		node := buildNode()
-		cons := buildConsensus()
-		bg := buildBlockGenerator()
-		bc := buildBlockchain(cons, bg)
-
-		cfg := &kernel.KernelConfig{
-			Blockchain:     bc,
-			Consensus:      cons,
-			BlockFrequency: viper.GetFloat64("blockchain.blockFrequency"),
-			BlockPrototype: bg.BlockPrototype(),
-			NetworkNode:    node}
-
-		kernel.Init(cfg)
-
 		ctx, cancel := context.WithCancel(context.Background())
 		defer cancel()
 
@@ -81,32 +66,164 @@ var blockchainCmd = &cobra.Command{
 				failWithError(err)
 			}
 			pprof.StartCPUProfile(f)
+			onExit(pprof.StopCPUProfile)
 			defer pprof.StopCPUProfile()
 		}
 
-		err := node.Bootstrap(ctx)
+		stop, err := startNode(ctx)
 		if err != nil {
-			fmt.Fprintln(os.Stderr, err)
-			os.Exit(1)
+			cancel()
+			failWithError(err)
 		}
 
-		node.Listen(ctx)
-		bc.Start(ctx)
-		rpc.Start()
-		kernel.Start(ctx)
-
 		sig := make(chan os.Signal, 1)
 		signal.Notify(sig,
 			syscall.SIGINT,
 			syscall.SIGTERM,
 			syscall.SIGQUIT)
 
-		<-sig
+		s := <-sig
+		kernelLog.WithField("signal", s.String()).Info("Shutting down")
+
+		stop()
+	},
+}
+
+// startNode builds the node configured in viper and starts it, serving
+// until ctx is done. It returns a function that shuts the node down. If
+// it fails, the caller cancels ctx to stop what was started. The kernel is
+// a singleton, so a process runs at most one node, once.
+func startNode(ctx context.Context) (stop func(), err error) {
+	mdns, err := configureDiscovery()
+	if err != nil {
+		return nil, err
+	}
+	node, err := buildNode()
+	if err != nil {
+		return nil, err
+	}
+	// the servers stop with ctx, the node has to be closed
+	fail := func(err error) (func(), error) {
+		node.Close()
+		return nil, err
+	}
+	static, err := buildStaticPeers(node)
+	if err != nil {
+		return fail(err)
+	}
+	if _, err = buildAllowlist(node, static); err != nil {
+		return fail(err)
+	}
+	rep, err := buildReputation(node)
+	if err != nil {
+		return fail(err)
+	}
+	conns := buildConnLimits(node, rep, static)
+	limiter := buildGossipLimiter(conns)
+	faults, err := buildFaultInjector(node.PeerID())
+	if err != nil {
+		return fail(err)
+	}
+	tracker := buildBlockTracker(node.PeerID())
+	history := buildForkHistory()
+	recorder, err := buildMetricsRecorder()
+	if err != nil {
+		return fail(err)
+	}
+	health := buildNodeHealth(node, tracker, history)
+	bus := buildEventBus(node, history)
+	tracing, err := buildLifecycleTracer(node.PeerID())
+	if err != nil {
+		return fail(err)
+	}
+	gossip := newGossipNode(node)
+	gossip.use(rep)
+	gossip.use(limiter)
+	// The limiter queues broadcast messages and sends them later, so the
+	// tracer comes after it to see when a block actually goes out.
+	gossip.use(tracing)
+	gossip.use(faults)
+	gossip.use(tracker)
+	gossip.use(bus)
+	cons := buildConsensus(tracing.comparator(rep.comparator(tracker.comparator(history.comparator(luckyblock.BlockComparator)))))
+	bg := tracing.generator(buildBlockGenerator())
+	bc := buildBlockchain(cons, bg)
+
+	cfg := &kernel.KernelConfig{
+		Blockchain:     bc,
+		Consensus:      cons,
+		BlockFrequency: viper.GetFloat64("blockchain.blockFrequency"),
+		BlockPrototype: bg.BlockPrototype(),
+		NetworkNode:    gossip}
+
+	kernel.Init(cfg)
+
+	boot := buildBootstrapSources()
+	if !viper.GetBool("node.bootstrapper.disable") {
+		boot.refresh(ctx)
+	}
+
+	if err = node.Bootstrap(ctx); err != nil {
+		return fail(err)
+	}
 
+	node.Listen(ctx)
+	static.start(ctx)
+	if !viper.GetBool("node.bootstrapper.disable") {
+		boot.watch(ctx, node)
+	}
+	if mdns {
+		startMdnsDiscovery(ctx, node)
+	}
+	limiter.start(ctx)
+	bc.Start(ctx)
+	startRPCServer(ctx)
+	registerMetricsControlMethods()
+	history.start(ctx)
+	tracing.observe(ctx, history)
+	recorder.start(ctx)
+	registerDiagnosticsControlMethods()
+	startPprofServer(ctx)
+	watchMemory(ctx)
+	startControlServer(ctx)
+	health.start(ctx)
+	var apiSrv *apiServer
+	var stopGoAPI func()
+	if viper.GetBool("api.embed") {
+		if stopGoAPI, err = startGoAPI(); err != nil {
+			bc.Stop()
+			return fail(err)
+		}
+		apiSrv = newAPIServer(newLocalAPIBackend(bc, cons, rep, health, bus, tracker))
+		apiSrv.start()
+	}
+	kernel.Start(ctx)
+	kernelLog.WithField(logFieldPeer, node.PeerID()).Info("Node started")
+
+	return func() {
+		if apiSrv != nil {
+			actx, cancelAPI := context.WithTimeout(context.Background(), 5*time.Second)
+			apiSrv.stop(actx)
+			cancelAPI()
+			stopGoAPI()
+		}
 		kernel.Stop()
 		bc.Stop()
 		node.Close()
-	},
+
+		flush, cancelFlush := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancelFlush()
+		tracing.shutdown(flush)
+	}, nil
+}
+
+// dataDir returns the data directory of the node: --dataDir, which sets
+// store.dataDir, or else blockchain.dataDir.
+func dataDir() string {
+	if dir := viper.GetString("store.dataDir"); dir != "" {
+		return dir
+	}
+	return viper.GetString("blockchain.dataDir")
 }
 
 func init() {
@@ -122,10 +239,38 @@ func init() {
 	flags.BoolP("genesis", "g", false, "produce the genesis block")
 	flags.StringArrayP("bootstrapPeer", "b", []string{}, `address of peer to bootstrap with, may be specified
 more than once`)
+	flags.StringArray("bootstrapSource", []string{}, `source of bootstrap peers: dns:<domain>,
+dnsaddr:<domain>, file:<path> or an http(s) URL, may be
+specified more than once`)
 	flags.Bool("nobootstrap", false, "disable bootstrapping")
-	flags.Bool("nodiscovery", false, "disable peer discovery")
+	flags.StringArray("staticPeer", []string{}, `address of peer to always stay connected to, may be
+specified more than once`)
+	flags.StringArray("allowPeer", []string{}, `ID of peer allowed to connect, may be specified more
+than once. When given, all other peers except static peers are rejected`)
+	flags.String("discovery", "", `peer discovery mode: mdns (local network), dht,
+both or none (default both, or none if node.discovery.disable
+is set in the config file)`)
+	flags.Int("maxPeers", 32, "number of peers above which connections are trimmed")
+	flags.Int64("bandwidthLimit", 0, `max block gossip bandwidth in bytes/second in each
+direction, 0 for no limit. Received messages over the limit are
+dropped, broadcast messages are delayed`)
+	flags.Int64("peerBandwidthLimit", 0, `max block gossip bandwidth per peer in bytes/second in
+each direction, 0 for no limit`)
 	flags.Bool("trackall", false, `include immediately disqualified blocks in consensus metrics`)
 	flags.String("cpuprofile", "", "output file for CPU profile info")
+	flags.Bool("api", false, `serve the lucky API in this process at api.ext.port,
+and the API at api.host and api.port of the config file
+from a lucky api process that stops with the node`)
+	flags.String("healthAddr", "", `serve the /healthz and /readyz probes on this address,
+e.g. :28183 for Kubernetes probes`)
+	flags.String("pprofAddr", "", `serve net/http/pprof on this address, e.g.
+localhost:6060`)
+	flags.String("tracing", tracingNone, `export block lifecycle traces: none, otlp or file`)
+	flags.String("traceEndpoint", "localhost:4318", "OTLP/HTTP endpoint for traces")
+	flags.Bool("propagateTrace", false, `add trace context to broadcast blocks. Peers must run
+a lucky version that understands it`)
+	flags.Bool("recordMetrics", false, `record kernel and consensus metrics to the data
+directory, see lucky metrics history`)
 	flags.Float64P("blockFrequency", "f", 1.0, "Number of blocks per second. Can be a decimal number.")
 	flags.DurationP("consensusTime", "t", 30*time.Second, "The duration blocks are tracked before consensus is reached.")
 	viper.BindEnv("blockchain.dataDir", "LUCKY_DATA_DIR")
@@ -133,13 +278,27 @@ more than once`)
 
 	viper.BindPFlag("node.port", flags.Lookup("p2pport"))
 	viper.BindPFlag("node.bootstrapper.peers", flags.Lookup("bootstrapPeer"))
+	viper.BindPFlag("node.bootstrapper.sources", flags.Lookup("bootstrapSource"))
 	viper.BindPFlag("node.bootstrapper.disable", flags.Lookup("nobootstrap"))
+	viper.BindPFlag("node.discovery.mode", flags.Lookup("discovery"))
+	viper.BindPFlag("node.staticPeers", flags.Lookup("staticPeer"))
+	viper.BindPFlag("node.allowlist", flags.Lookup("allowPeer"))
+	viper.BindPFlag("node.connections.highWater", flags.Lookup("maxPeers"))
+	viper.BindPFlag("node.bandwidth.global", flags.Lookup("bandwidthLimit"))
+	viper.BindPFlag("node.bandwidth.perPeer", flags.Lookup("peerBandwidthLimit"))
 	viper.BindPFlag("store.dataDir", flags.Lookup("dataDir"))
 	viper.BindPFlag("blockchain.genesis", flags.Lookup("genesis"))
 	viper.BindPFlag("blockchain.metrics.trackall", flags.Lookup("trackall"))
 	viper.BindPFlag("blockchain.blockFrequency", flags.Lookup("blockFrequency"))
 	viper.BindPFlag("blockchain.consensus.time", flags.Lookup("consensusTime"))
 	viper.BindPFlag("diagnostics.cpuprofile", flags.Lookup("cpuprofile"))
+	viper.BindPFlag("api.embed", flags.Lookup("api"))
+	viper.BindPFlag("health.addr", flags.Lookup("healthAddr"))
+	viper.BindPFlag("diagnostics.pprofAddr", flags.Lookup("pprofAddr"))
+	viper.BindPFlag("diagnostics.history.enable", flags.Lookup("recordMetrics"))
+	viper.BindPFlag("diagnostics.tracing.exporter", flags.Lookup("tracing"))
+	viper.BindPFlag("diagnostics.tracing.endpoint", flags.Lookup("traceEndpoint"))
+	viper.BindPFlag("diagnostics.tracing.propagate", flags.Lookup("propagateTrace"))
 
 	viper.SetDefault("blockchain.dataDir", path.Join(homeDir, ".lucky", "data"))
 	viper.SetDefault("blockchain.genesis", false)
@@ -159,11 +318,25 @@ more than once`)
 		"/ip4/104.196.155.69/tcp/29190/ipfs/QmTTDpNa8ErE23Fs3YZFLnprv6UaXTWFsm11Tt2zcWgKBJ",
 		"/ip4/35.204.208.27/tcp/29190/ipfs/QmdKoGtMGzeqeZ9M1zt4zE5YsRRdH3h2b6oPKW9pmvb3Xc",
 		"/ip4/35.200.229.227/tcp/29190/ipfs/QmUCx8w8YjnhMLARdjHfTjf4S1DMqB5PhW2CUGHcDeMD4S"})
+	viper.SetDefault("node.bootstrapper.sources", []string{})
+	viper.SetDefault("node.staticPeers", []string{})
+	viper.SetDefault("node.redialInterval", 10) // seconds
+	viper.SetDefault("node.allowlist", []string{})
 	viper.SetDefault("node.port", 29190)
 	viper.SetDefault("node.addresses", []string{"/ip4/0.0.0.0/tcp/29190", "/ip6/::/tcp/29190"})
 	viper.SetDefault("node.discovery.disable", false)
 	viper.SetDefault("node.discovery.interval", 5) // second
 	viper.SetDefault("node.broadcastconcurrency", 4)
+	viper.SetDefault("node.connections.lowWater", 16)
+	viper.SetDefault("node.connections.highWater", 32)
+	viper.SetDefault("node.connections.maxInbound", 24)
+	viper.SetDefault("node.connections.maxOutbound", 16)
+	viper.SetDefault("node.connections.gracePeriod", 20*time.Second)
+	viper.SetDefault("node.bandwidth.global", 0)  // bytes/second, 0 is unlimited
+	viper.SetDefault("node.bandwidth.perPeer", 0) // bytes/second, 0 is unlimited
+	// messages/second by protocol, "*" applies to protocols not listed
+	viper.SetDefault("node.gossip.rateLimits", map[string]interface{}{"*": 0})
+	viper.SetDefault("node.gossip.maxMessageSize", 1<<20) // bytes, bandwidth limits allow bursts of this size
 	viper.SetDefault("store.ipfs.apiport", 5001)
 	viper.SetDefault("store.ipfs.gatewayport", 8081)
 	viper.SetDefault("store.ipfs.swarmport", 4001)
@@ -173,8 +346,7 @@ more than once`)
 	viper.SetDefault("store.ipfs.disablenat", false)
 }
 
-func buildConsensus() spec.Consensus {
-	blockComparator := luckyblock.BlockComparator
+func buildConsensus(blockComparator spec.BlockComparator) spec.Consensus {
 	cons := consensus.NewConsensus(blockComparator)
 
 	return cons
@@ -190,7 +362,7 @@ func buildBlockchain(cons spec.Consensus, bg spec.BlockGenerator) spec.Blockchai
 	return bc
 }
 
-func buildNode() *p2p.NetworkNode {
+func buildNode() (*p2p.NetworkNode, error) {
 	addresses := viper.GetStringSlice("node.addresses")
 	port := viper.GetInt("port")
 	for i, a := range addresses {
@@ -208,13 +380,26 @@ func buildNode() *p2p.NetworkNode {
 
 	node, err := p2p.NewNode()
 	if err != nil {
-		failWithError(err)
+		return nil, err
 	}
 
 	hostAddr, _ := ma.NewMultiaddr(fmt.Sprintf("/ipfs/%s", node.PeerID()))
-	addr := node.Host.Addrs()[0]
-	fullAddr := addr.Encapsulate(hostAddr)
-	fmt.Fprintf(os.Stderr, "P2P address: %s\n", fullAddr)
+	info := &nodeInfo{PeerID: node.PeerID(), Addresses: make([]string, 0)}
+	for _, addr := range node.Host.Addrs() {
+		info.Addresses = append(info.Addresses, addr.Encapsulate(hostAddr).String())
+	}
+	printResult(info, func() {
+		for _, a := range info.Addresses {
+			fmt.Fprintf(os.Stderr, "P2P address: %s\n", a)
+		}
+	})
+
+	return node, nil
+}
 
-	return node
+// nodeInfo is printed by lucky blockchain when the node is listening.
+// Addresses are the full P2P addresses of the node, including its peer ID.
+type nodeInfo struct {
+	PeerID    string   `json:"peerID"`
+	Addresses []string `json:"addresses"`
 }
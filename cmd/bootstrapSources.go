@@ -0,0 +1,254 @@
+// Copyright © 2018 J. Strobus White.
+// This file is part of the blocktop blockchain development kit.
+//
+// Blocktop is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// Blocktop is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with blocktop. If not, see <http://www.gnu.org/licenses/>.
+
+package cmd
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	p2p "github.com/blocktop/go-network-libp2p"
+
+	inet "github.com/libp2p/go-libp2p-net"
+	pstore "github.com/libp2p/go-libp2p-peerstore"
+	ma "github.com/multiformats/go-multiaddr"
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+)
+
+// maxDNSAddrDepth limits how many /dnsaddr indirections are followed when
+// resolving a DNS seed.
+const maxDNSAddrDepth = 4
+
+// bootstrapPeer is a bootstrap address along with the source it came from.
+type bootstrapPeer struct {
+	addr   ma.Multiaddr
+	info   *pstore.PeerInfo
+	source string
+}
+
+// bootstrapSources resolves the bootstrap peers from the literal addresses
+// in node.bootstrapper.peers and from node.bootstrapper.sources, which may
+// contain
+//
+//	dns:<domain>       TXT records of <domain> holding one multiaddr each
+//	dnsaddr:<domain>   TXT records of _dnsaddr.<domain> ("dnsaddr=<multiaddr>")
+//	file:<path>        a file with one multiaddr per line
+//	http(s)://<url>    a document with one multiaddr per line
+//
+// The merged list is handed to the P2P node's bootstrapper and re-resolved
+// every rebootstrapInterval.
+type bootstrapSources struct {
+	literal []string
+	sources []string
+	known   map[string]bool
+}
+
+func buildBootstrapSources() *bootstrapSources {
+	return &bootstrapSources{
+		literal: viper.GetStringSlice("node.bootstrapper.peers"),
+		sources: viper.GetStringSlice("node.bootstrapper.sources"),
+		known:   make(map[string]bool)}
+}
+
+// refresh resolves all sources and updates node.bootstrapper.peers. It
+// returns the peers not seen in an earlier refresh.
+func (b *bootstrapSources) refresh(ctx context.Context) []bootstrapPeer {
+	peers := make([]bootstrapPeer, 0)
+	seen := make(map[string]bool)
+	add := func(addrs []string, source string) {
+		for _, a := range addrs {
+			p, err := parseBootstrapAddr(a, source)
+			if err != nil {
+				p2pLog.WithFields(logrus.Fields{"addr": a, "source": source}).WithError(err).Warn("Ignoring bootstrap peer")
+				continue
+			}
+			if !seen[p.addr.String()] {
+				seen[p.addr.String()] = true
+				peers = append(peers, p)
+			}
+		}
+	}
+
+	add(b.literal, "config")
+	for _, src := range b.sources {
+		addrs, err := resolveBootstrapSource(ctx, src)
+		if err != nil {
+			p2pLog.WithField("source", src).WithError(err).Warn("Failed to resolve bootstrap source")
+			continue
+		}
+		add(addrs, src)
+	}
+
+	addrs := make([]string, len(peers))
+	added := make([]bootstrapPeer, 0)
+	for i, p := range peers {
+		addrs[i] = p.addr.String()
+		setPeerOrigin(p.info.ID.Pretty(), p.source)
+		if !b.known[addrs[i]] {
+			b.known[addrs[i]] = true
+			added = append(added, p)
+			p2pLog.WithFields(logrus.Fields{"addr": addrs[i], "source": p.source}).Info("Bootstrap peer")
+		}
+	}
+	viper.Set("node.bootstrapper.peers", addrs)
+
+	return added
+}
+
+// watch re-resolves the bootstrap sources every rebootstrapInterval until
+// ctx is done. Newly found peers are dialed right away while the node has
+// fewer than minPeers peers.
+func (b *bootstrapSources) watch(ctx context.Context, node *p2p.NetworkNode) {
+	if len(b.sources) == 0 {
+		return
+	}
+	interval := time.Duration(viper.GetInt("node.bootstrapper.rebootstrapInterval")) * time.Second
+
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+
+			minPeers := viper.GetInt("node.bootstrapper.minPeers")
+			for _, p := range b.refresh(ctx) {
+				network := node.Host.Network()
+				if len(network.Peers()) >= minPeers || network.Connectedness(p.info.ID) == inet.Connected {
+					continue
+				}
+				dctx, cancel := context.WithTimeout(ctx, 10*time.Second)
+				if err := node.Host.Connect(dctx, *p.info); err != nil {
+					p2pLog.WithField("addr", p.addr).WithError(err).Debug("Failed to connect to bootstrap peer")
+				}
+				cancel()
+			}
+		}
+	}()
+}
+
+func parseBootstrapAddr(a string, source string) (bootstrapPeer, error) {
+	addr, err := ma.NewMultiaddr(strings.TrimSpace(a))
+	if err != nil {
+		return bootstrapPeer{}, err
+	}
+	info, err := pstore.InfoFromP2pAddr(addr)
+	if err != nil {
+		return bootstrapPeer{}, err
+	}
+
+	return bootstrapPeer{addr, info, source}, nil
+}
+
+func resolveBootstrapSource(ctx context.Context, src string) ([]string, error) {
+	switch {
+	case strings.HasPrefix(src, "dns:"):
+		return net.DefaultResolver.LookupTXT(ctx, strings.TrimPrefix(src, "dns:"))
+	case strings.HasPrefix(src, "dnsaddr:"):
+		return resolveDNSAddr(ctx, strings.TrimPrefix(src, "dnsaddr:"), 0)
+	case strings.HasPrefix(src, "file:"):
+		f, err := os.Open(strings.TrimPrefix(src, "file:"))
+		if err != nil {
+			return nil, err
+		}
+		defer f.Close()
+		return readAddrList(f)
+	case strings.HasPrefix(src, "http://"), strings.HasPrefix(src, "https://"):
+		return fetchAddrList(ctx, src)
+	}
+
+	return nil, fmt.Errorf("unknown bootstrap source type")
+}
+
+func resolveDNSAddr(ctx context.Context, domain string, depth int) ([]string, error) {
+	if depth > maxDNSAddrDepth {
+		return nil, fmt.Errorf("too many dnsaddr indirections at %s", domain)
+	}
+
+	txts, err := net.DefaultResolver.LookupTXT(ctx, "_dnsaddr."+domain)
+	if err != nil {
+		return nil, err
+	}
+
+	addrs := make([]string, 0, len(txts))
+	for _, txt := range txts {
+		if !strings.HasPrefix(txt, "dnsaddr=") {
+			continue
+		}
+		a := strings.TrimPrefix(txt, "dnsaddr=")
+		if strings.HasPrefix(a, "/dnsaddr/") {
+			next := strings.SplitN(strings.TrimPrefix(a, "/dnsaddr/"), "/", 2)[0]
+			more, err := resolveDNSAddr(ctx, next, depth+1)
+			if err != nil {
+				p2pLog.WithField("source", next).WithError(err).Warn("Failed to resolve dnsaddr")
+				continue
+			}
+			addrs = append(addrs, more...)
+			continue
+		}
+		addrs = append(addrs, a)
+	}
+
+	return addrs, nil
+}
+
+func fetchAddrList(ctx context.Context, url string) ([]string, error) {
+	req, err := http.NewRequest(http.MethodGet, url, nil)
+	if err != nil {
+		return nil, err
+	}
+	ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+
+	res, err := http.DefaultClient.Do(req.WithContext(ctx))
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected HTTP status %s", res.Status)
+	}
+
+	return readAddrList(res.Body)
+}
+
+// readAddrList reads one address per line, skipping blank lines and lines
+// starting with #.
+func readAddrList(r io.Reader) ([]string, error) {
+	addrs := make([]string, 0)
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		addrs = append(addrs, line)
+	}
+
+	return addrs, scanner.Err()
+}
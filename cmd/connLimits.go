@@ -0,0 +1,175 @@
+// Copyright © 2018 J. Strobus White.
+// This file is part of the blocktop blockchain development kit.
+//
+// Blocktop is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// Blocktop is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with blocktop. If not, see <http://www.gnu.org/licenses/>.
+
+package cmd
+
+import (
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	p2p "github.com/blocktop/go-network-libp2p"
+
+	inet "github.com/libp2p/go-libp2p-net"
+	peer "github.com/libp2p/go-libp2p-peer"
+	"github.com/spf13/viper"
+)
+
+// connLimits enforces the connection limits in node.connections. New
+// connections beyond maxInbound or maxOutbound are closed right away. Once
+// the node has more than highWater peers it trims them down to lowWater,
+// closing the worst scoring and then the newest peers first. Static peers
+// and peers connected for less than gracePeriod are never trimmed.
+type connLimits struct {
+	sync.Mutex
+	node        *p2p.NetworkNode
+	rep         *peerReputation
+	protected   map[string]bool
+	connected   map[peer.ID]time.Time
+	lowWater    int
+	highWater   int
+	maxInbound  int
+	maxOutbound int
+	gracePeriod time.Duration
+	trimming    int32
+}
+
+func buildConnLimits(node *p2p.NetworkNode, rep *peerReputation, static *staticPeers) *connLimits {
+	l := &connLimits{
+		node:        node,
+		rep:         rep,
+		protected:   make(map[string]bool),
+		connected:   make(map[peer.ID]time.Time),
+		lowWater:    viper.GetInt("node.connections.lowWater"),
+		highWater:   viper.GetInt("node.connections.highWater"),
+		maxInbound:  viper.GetInt("node.connections.maxInbound"),
+		maxOutbound: viper.GetInt("node.connections.maxOutbound"),
+		gracePeriod: viper.GetDuration("node.connections.gracePeriod")}
+	if l.lowWater > l.highWater {
+		l.lowWater = l.highWater
+	}
+	for _, id := range static.ids() {
+		l.protected[id] = true
+	}
+
+	node.Host.Network().Notify(&inet.NotifyBundle{
+		ConnectedF:    l.connectedF,
+		DisconnectedF: l.disconnectedF})
+
+	return l
+}
+
+func (l *connLimits) connectedF(n inet.Network, c inet.Conn) {
+	l.Lock()
+	if _, ok := l.connected[c.RemotePeer()]; !ok {
+		l.connected[c.RemotePeer()] = time.Now()
+	}
+	l.Unlock()
+
+	if !l.protected[c.RemotePeer().Pretty()] {
+		dir := c.Stat().Direction
+		max := l.maxInbound
+		if dir == inet.DirOutbound {
+			max = l.maxOutbound
+		}
+		if max > 0 && l.count(n, dir) > max {
+			p2pLog.WithField(logFieldPeer, c.RemotePeer().Pretty()).Debug("Closing connection, connection limit reached")
+			go c.Close()
+			return
+		}
+	}
+
+	if l.highWater > 0 && len(n.Peers()) > l.highWater && atomic.CompareAndSwapInt32(&l.trimming, 0, 1) {
+		go func() {
+			defer atomic.StoreInt32(&l.trimming, 0)
+			l.trim(n)
+		}()
+	}
+}
+
+func (l *connLimits) disconnectedF(n inet.Network, c inet.Conn) {
+	if n.Connectedness(c.RemotePeer()) == inet.Connected {
+		return
+	}
+	l.Lock()
+	delete(l.connected, c.RemotePeer())
+	l.Unlock()
+}
+
+func (l *connLimits) count(n inet.Network, dir inet.Direction) int {
+	count := 0
+	for _, c := range n.Conns() {
+		if c.Stat().Direction == dir {
+			count++
+		}
+	}
+	return count
+}
+
+// trim closes peers until only lowWater are left.
+func (l *connLimits) trim(n inet.Network) {
+	type candidate struct {
+		id        peer.ID
+		score     float64
+		connected time.Time
+	}
+
+	now := time.Now()
+	scores := make(map[string]float64)
+	for _, ps := range l.rep.status() {
+		scores[ps.PeerID] = ps.Score
+	}
+
+	peers := n.Peers()
+	candidates := make([]candidate, 0, len(peers))
+	l.Lock()
+	for _, id := range peers {
+		since, ok := l.connected[id]
+		if l.protected[id.Pretty()] || (ok && now.Sub(since) < l.gracePeriod) {
+			continue
+		}
+		candidates = append(candidates, candidate{id, scores[id.Pretty()], since})
+	}
+	l.Unlock()
+
+	sort.Slice(candidates, func(i, j int) bool {
+		if candidates[i].score != candidates[j].score {
+			return candidates[i].score > candidates[j].score
+		}
+		return candidates[i].connected.After(candidates[j].connected)
+	})
+
+	excess := len(peers) - l.lowWater
+	for i := 0; i < excess && i < len(candidates); i++ {
+		p2pLog.WithField(logFieldPeer, candidates[i].id.Pretty()).Debug("Trimming connection")
+		n.ClosePeer(candidates[i].id)
+	}
+}
+
+type connUsage struct {
+	Peers    int `json:"peers"`
+	Inbound  int `json:"inbound"`
+	Outbound int `json:"outbound"`
+}
+
+func (l *connLimits) usage() connUsage {
+	n := l.node.Host.Network()
+	return connUsage{
+		Peers:    len(n.Peers()),
+		Inbound:  l.count(n, inet.DirInbound),
+		Outbound: l.count(n, inet.DirOutbound)}
+}
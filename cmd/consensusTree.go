@@ -0,0 +1,136 @@
+// Copyright © 2018 J. Strobus White.
+// This file is part of the blocktop blockchain development kit.
+//
+// Blocktop is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// Blocktop is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with blocktop. If not, see <http://www.gnu.org/licenses/>.
+
+package cmd
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+
+	consensus "github.com/blocktop/go-consensus"
+	rpcconsensus "github.com/blocktop/go-rpc-client/consensus"
+)
+
+// treeBlock is a block in a consensus tree.
+type treeBlock struct {
+	Hash       string `json:"hash"`
+	ParentHash string `json:"parentHash"`
+	Number     uint64 `json:"blockNumber"`
+	Head       bool   `json:"head,omitempty"`
+}
+
+// consensusTree is the consensus-finding tree of a node, decoded from
+// the consensus.Tree that rpcconsensus.GetTree returns in JSON format.
+type consensusTree struct {
+	blocks   map[string]*treeBlock
+	children map[string][]string
+	headHash string
+}
+
+// parseConsensusTree decodes a consensus tree in JSON format.
+func parseConsensusTree(data []byte) (*consensusTree, error) {
+	var ct consensus.Tree
+	if err := json.Unmarshal(data, &ct); err != nil {
+		return nil, fmt.Errorf("invalid consensus tree: %v", err)
+	}
+
+	t := &consensusTree{
+		blocks:   make(map[string]*treeBlock, len(ct.Blocks)),
+		children: make(map[string][]string),
+		headHash: ct.Head}
+	for _, b := range ct.Blocks {
+		if b == nil || b.Hash == "" {
+			continue
+		}
+		t.blocks[b.Hash] = &treeBlock{
+			Hash:       b.Hash,
+			ParentHash: b.ParentHash,
+			Number:     b.BlockNumber,
+			Head:       b.Hash == ct.Head}
+	}
+	if ct.Head != "" && t.blocks[ct.Head] == nil {
+		return nil, fmt.Errorf("invalid consensus tree: head %s is not in the tree", ct.Head)
+	}
+
+	for _, b := range t.blocks {
+		if _, ok := t.blocks[b.ParentHash]; ok {
+			t.children[b.ParentHash] = append(t.children[b.ParentHash], b.Hash)
+		}
+	}
+	for _, c := range t.children {
+		sort.Strings(c)
+	}
+
+	return t, nil
+}
+
+// leaves returns the blocks without children, highest first.
+func (t *consensusTree) leaves() []*treeBlock {
+	leaves := make([]*treeBlock, 0)
+	for h, b := range t.blocks {
+		if len(t.children[h]) == 0 {
+			leaves = append(leaves, b)
+		}
+	}
+	sort.Slice(leaves, func(i, j int) bool {
+		if leaves[i].Number != leaves[j].Number {
+			return leaves[i].Number > leaves[j].Number
+		}
+		return leaves[i].Hash < leaves[j].Hash
+	})
+	return leaves
+}
+
+// head returns the consensus head as reported by the consensus, or nil
+// if it has none yet.
+func (t *consensusTree) head() *treeBlock {
+	return t.blocks[t.headHash]
+}
+
+// ancestors returns the chain from the block with hash up to the oldest
+// ancestor in the tree, starting with the block itself.
+func (t *consensusTree) ancestors(hash string) []*treeBlock {
+	chain := make([]*treeBlock, 0)
+	for b, ok := t.blocks[hash]; ok; b, ok = t.blocks[b.ParentHash] {
+		chain = append(chain, b)
+		if len(chain) > len(t.blocks) {
+			break
+		}
+	}
+	return chain
+}
+
+// fetchConsensusTree retrieves the consensus tree from the control server
+// at addr.
+func fetchConsensusTree(addr string) (*consensusTree, error) {
+	var raw json.RawMessage
+	if err := callControlAt(addr, "consensus.tree", &metricsParams{Format: "json"}, &raw); err != nil {
+		return nil, err
+	}
+	return parseConsensusTree(raw)
+}
+
+// fetchConsensusTreeFrom retrieves the consensus tree from the RPC server
+// at addr (host:port), which need not be the local node.
+func fetchConsensusTreeFrom(addr string) (*consensusTree, error) {
+	req := &rpcconsensus.GetTreeRequest{}
+	var res rpcconsensus.GetTreeResponse
+	if err := postNodeRPC("http://"+addr+"/rpc", req.GetTree(rpcconsensus.GetTreeArgs{Format: "json"}), &res); err != nil {
+		return nil, err
+	}
+	return parseConsensusTree([]byte(res.Result.Tree))
+}
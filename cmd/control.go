@@ -0,0 +1,388 @@
+// Copyright © 2018 J. Strobus White.
+// This file is part of the blocktop blockchain development kit.
+//
+// Blocktop is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// Blocktop is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with blocktop. If not, see <http://www.gnu.org/licenses/>.
+
+package cmd
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/spf13/viper"
+)
+
+// The control server is lucky's own JSON-RPC 2.0 endpoint. It sits next to
+// the blocktop RPC server and exposes the state that lives in this process,
+// such as peer reputation, to the CLI. It accepts batches and
+// notifications, and lists its methods with rpc.discover, as does the RPC
+// gateway in front of the blocktop RPC server.
+
+const (
+	controlErrParse          = -32700
+	controlErrInvalidRequest = -32600
+	controlErrMethodNotFound = -32601
+	controlErrInvalidParams  = -32602
+	controlErrInternal       = -32603
+)
+
+const (
+	// controlMaxBatch is the number of requests allowed in a batch.
+	controlMaxBatch = 100
+	// controlMaxBody is the size allowed for a request body.
+	controlMaxBody = 4 << 20
+)
+
+// controlHandler handles one control method. params holds the raw JSON
+// params of the request and may be empty.
+type controlHandler func(params json.RawMessage) (interface{}, error)
+
+type controlRequest struct {
+	JSONRPC string          `json:"jsonrpc"`
+	Method  string          `json:"method"`
+	Params  json.RawMessage `json:"params,omitempty"`
+	ID      json.RawMessage `json:"id,omitempty"`
+}
+
+type controlResponse struct {
+	JSONRPC string          `json:"jsonrpc"`
+	Result  interface{}     `json:"result"`
+	Error   *controlError   `json:"error,omitempty"`
+	ID      json.RawMessage `json:"id"`
+}
+
+// MarshalJSON encodes r with exactly one of result and error, as JSON-RPC
+// 2.0 requires. A successful response has a result even if it is null.
+func (r *controlResponse) MarshalJSON() ([]byte, error) {
+	if r.Error == nil {
+		type response controlResponse
+		return json.Marshal((*response)(r))
+	}
+	return json.Marshal(&struct {
+		JSONRPC string          `json:"jsonrpc"`
+		Error   *controlError   `json:"error"`
+		ID      json.RawMessage `json:"id"`
+	}{r.JSONRPC, r.Error, r.ID})
+}
+
+// controlError is a JSON-RPC error. Data holds details for clients, such
+// as the method a request named; see controlErrorData.
+type controlError struct {
+	Code    int               `json:"code"`
+	Message string            `json:"message"`
+	Data    *controlErrorData `json:"data,omitempty"`
+}
+
+// controlErrorData are the details of a control error. Params is the
+// JSON schema of the params a method expects, and Suggestions are methods
+// with names like an unknown one.
+type controlErrorData struct {
+	Method      string      `json:"method,omitempty"`
+	Detail      string      `json:"detail,omitempty"`
+	Params      interface{} `json:"params,omitempty"`
+	Suggestions []string    `json:"suggestions,omitempty"`
+}
+
+func (e *controlError) Error() string {
+	return fmt.Sprintf("%s (code %d)", e.Message, e.Code)
+}
+
+func newControlError(code int, message string) *controlError {
+	return &controlError{Code: code, Message: message}
+}
+
+// hint returns advice for the user of the CLI on how to resolve e.
+func (e *controlError) hint() string {
+	var method string
+	if e.Data != nil {
+		method = e.Data.Method
+	}
+
+	switch e.Code {
+	case controlErrMethodNotFound:
+		h := "The node does not provide " + method + ". It may be running another version of lucky;\n" +
+			"list the methods it provides with rpc.discover."
+		if e.Data != nil && len(e.Data.Suggestions) > 0 {
+			h += "\nDid you mean " + strings.Join(e.Data.Suggestions, ", ") + "?"
+		}
+		return h
+	case controlErrInvalidParams:
+		return "The node rejected the parameters of " + method + ". Check the values given\n" +
+			"on the command line."
+	case controlErrInternal:
+		return "The node failed to handle " + method + ". Its log may have details."
+	case controlErrParse, controlErrInvalidRequest:
+		return "The node did not understand the request. The CLI and the node may be\n" +
+			"different versions of lucky."
+	}
+	return ""
+}
+
+// controlMethod is a registered control method with its documentation.
+type controlMethod struct {
+	doc     controlMethodDoc
+	handler controlHandler
+}
+
+var (
+	controlMethods   = make(map[string]*controlMethod)
+	controlMethodsMu sync.RWMutex
+
+	// controlPaths are plain HTTP endpoints served next to /rpc. They must
+	// be registered before the control server starts.
+	controlPaths = make(map[string]http.Handler)
+)
+
+// registerControlMethod registers the handler h of method name, which
+// rpc.discover describes with doc.
+func registerControlMethod(name string, doc controlMethodDoc, h controlHandler) {
+	controlMethodsMu.Lock()
+	defer controlMethodsMu.Unlock()
+
+	controlMethods[name] = &controlMethod{doc: doc, handler: h}
+}
+
+func registerControlPath(pattern string, h http.Handler) {
+	controlPaths[pattern] = h
+}
+
+func init() {
+	rootCmd.PersistentFlags().Int("controlport", 28181, "port for lucky control server")
+	viper.BindEnv("control.port", "LUCKY_CONTROL_PORT")
+	viper.BindPFlag("control.port", rootCmd.PersistentFlags().Lookup("controlport"))
+
+	viper.SetDefault("control.host", "localhost")
+	viper.SetDefault("control.port", 28181)
+}
+
+func controlAddr() string {
+	return fmt.Sprintf("%s:%d", viper.GetString("control.host"), viper.GetInt("control.port"))
+}
+
+// startControlServer serves the control RPC methods until ctx is done.
+func startControlServer(ctx context.Context) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/rpc", func(w http.ResponseWriter, r *http.Request) {
+		serveJSONRPC(w, r, handleControlRequest)
+	})
+	for pattern, h := range controlPaths {
+		mux.Handle(pattern, h)
+	}
+
+	srv := &http.Server{Addr: controlAddr(), Handler: mux}
+
+	go func() {
+		err := srv.ListenAndServe()
+		if err != nil && err != http.ErrServerClosed {
+			rpcLog.WithError(err).Error("Control server failed")
+		}
+	}()
+
+	go func() {
+		<-ctx.Done()
+		sctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		srv.Shutdown(sctx)
+	}()
+}
+
+// serveJSONRPC serves a single JSON-RPC 2.0 request or a batch, passing
+// each valid request to handle. Notifications, requests without an ID,
+// are handled but not answered.
+func serveJSONRPC(w http.ResponseWriter, r *http.Request, handle func(*controlRequest) *controlResponse) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	body, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, controlMaxBody))
+	if err != nil {
+		writeControlResponse(w, controlParseError(err))
+		return
+	}
+
+	body = bytes.TrimSpace(body)
+	if len(body) == 0 || body[0] != '[' {
+		writeControlResponse(w, handleJSONRPCMessage(body, handle))
+		return
+	}
+
+	var batch []json.RawMessage
+	if err := json.Unmarshal(body, &batch); err != nil {
+		writeControlResponse(w, controlParseError(err))
+		return
+	}
+	if len(batch) == 0 || len(batch) > controlMaxBatch {
+		res := &controlResponse{JSONRPC: "2.0"}
+		res.Error = newControlError(controlErrInvalidRequest, "invalid request")
+		res.Error.Data = &controlErrorData{Detail: fmt.Sprintf("a batch must hold 1 to %d requests", controlMaxBatch)}
+		writeControlResponse(w, res)
+		return
+	}
+
+	responses := make([]*controlResponse, 0, len(batch))
+	for _, msg := range batch {
+		if res := handleJSONRPCMessage(msg, handle); res != nil {
+			responses = append(responses, res)
+		}
+	}
+	if len(responses) == 0 {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(responses)
+}
+
+func writeControlResponse(w http.ResponseWriter, res *controlResponse) {
+	if res == nil {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(res)
+}
+
+func controlParseError(err error) *controlResponse {
+	res := &controlResponse{JSONRPC: "2.0"}
+	res.Error = newControlError(controlErrParse, "parse error")
+	res.Error.Data = &controlErrorData{Detail: err.Error()}
+	return res
+}
+
+// handleJSONRPCMessage handles one request of a body. It returns nil for
+// notifications.
+func handleJSONRPCMessage(msg json.RawMessage, handle func(*controlRequest) *controlResponse) *controlResponse {
+	var req controlRequest
+	if err := json.Unmarshal(msg, &req); err != nil {
+		if _, ok := err.(*json.SyntaxError); ok {
+			return controlParseError(err)
+		}
+		res := &controlResponse{JSONRPC: "2.0"}
+		res.Error = newControlError(controlErrInvalidRequest, "invalid request")
+		res.Error.Data = &controlErrorData{Detail: err.Error()}
+		return res
+	}
+
+	// invalid requests are answered even without an ID
+	if req.JSONRPC != "2.0" || req.Method == "" {
+		res := &controlResponse{JSONRPC: "2.0", ID: req.ID}
+		res.Error = newControlError(controlErrInvalidRequest, "invalid request")
+		res.Error.Data = &controlErrorData{Detail: `jsonrpc must be "2.0" and method must be given`}
+		return res
+	}
+
+	res := handle(&req)
+	if len(req.ID) == 0 {
+		return nil
+	}
+	return res
+}
+
+func handleControlRequest(req *controlRequest) *controlResponse {
+	res := &controlResponse{JSONRPC: "2.0", ID: req.ID}
+
+	controlMethodsMu.RLock()
+	m, ok := controlMethods[req.Method]
+	controlMethodsMu.RUnlock()
+	if !ok {
+		res.Error = newControlError(controlErrMethodNotFound, "method not found: "+req.Method)
+		res.Error.Data = &controlErrorData{Method: req.Method, Suggestions: similarMethods(req.Method, controlMethodNames())}
+		return res
+	}
+	return callControlMethod(m, req)
+}
+
+// callControlMethod handles req with m, adding the method and, for
+// invalid params, the schema of its params to errors.
+func callControlMethod(m *controlMethod, req *controlRequest) *controlResponse {
+	res := &controlResponse{JSONRPC: "2.0", ID: req.ID}
+	result, err := m.handler(req.Params)
+	if err != nil {
+		cerr, ok := err.(*controlError)
+		if !ok {
+			cerr = newControlError(controlErrInternal, err.Error())
+		}
+		if cerr.Data == nil {
+			cerr.Data = &controlErrorData{}
+		}
+		cerr.Data.Method = req.Method
+		if cerr.Code == controlErrInvalidParams && cerr.Data.Params == nil {
+			if m.doc.params != nil {
+				cerr.Data.Params = jsonSchema(reflect.TypeOf(m.doc.params))
+			}
+		}
+		res.Error = cerr
+		return res
+	}
+	res.Result = result
+
+	return res
+}
+
+func controlMethodNames() []string {
+	controlMethodsMu.RLock()
+	defer controlMethodsMu.RUnlock()
+
+	names := make([]string, 0, len(controlMethods))
+	for m := range controlMethods {
+		names = append(names, m)
+	}
+	return names
+}
+
+// similarMethods returns the methods of names in the namespace of method,
+// the part before the dot, or whose name ends like method's.
+func similarMethods(method string, names []string) []string {
+	ns, name := method, method
+	if i := strings.Index(method, "."); i >= 0 {
+		ns, name = method[:i], method[i+1:]
+	}
+
+	res := make([]string, 0)
+	for _, m := range names {
+		mns, mname := m, m
+		if i := strings.Index(m, "."); i >= 0 {
+			mns, mname = m[:i], m[i+1:]
+		}
+		if mns == ns || mname == name {
+			res = append(res, m)
+		}
+	}
+	sort.Strings(res)
+	return res
+}
+
+// decodeControlParams unmarshals params into v, reporting failures as
+// invalid params errors.
+func decodeControlParams(params json.RawMessage, v interface{}) error {
+	if len(params) == 0 {
+		return nil
+	}
+	if err := json.Unmarshal(params, v); err != nil {
+		cerr := newControlError(controlErrInvalidParams, "invalid params")
+		cerr.Data = &controlErrorData{Detail: err.Error()}
+		return cerr
+	}
+	return nil
+}
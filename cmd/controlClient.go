@@ -0,0 +1,213 @@
+// Copyright © 2018 J. Strobus White.
+// This file is part of the blocktop blockchain development kit.
+//
+// Blocktop is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// Blocktop is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with blocktop. If not, see <http://www.gnu.org/licenses/>.
+
+package cmd
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"sync/atomic"
+	"time"
+)
+
+var controlRequestID int64
+
+// callControl invokes method on the control server of the running node and
+// unmarshals the result into result, which may be nil.
+func callControl(method string, params interface{}, result interface{}) error {
+	return callControlAt(controlAddr(), method, params, result)
+}
+
+// callControlAt is like callControl for the control server at addr.
+func callControlAt(addr string, method string, params interface{}, result interface{}) error {
+	return callControlURL(fmt.Sprintf("http://%s/rpc", addr), method, params, result)
+}
+
+// callControlURL is like callControl for the control RPC endpoint URL
+// endpoint, e.g. http://localhost:28181/rpc.
+func callControlURL(endpoint string, method string, params interface{}, result interface{}) error {
+	return callControlTimeout(endpoint, rpcTimeout(), method, params, result)
+}
+
+// callControlTimeout is like callControlURL with another timeout than the
+// configured one, e.g. for long polls.
+func callControlTimeout(endpoint string, timeout time.Duration, method string, params interface{}, result interface{}) error {
+	var res controlResult
+	if err := postControl(&http.Client{Timeout: timeout}, endpoint, newControlCall(method, params), &res); err != nil {
+		return err
+	}
+	if err := res.decode(result); err != nil {
+		return classifyRPCError("control", controlHost(endpoint), err)
+	}
+	return nil
+}
+
+// callControlLong is like callControl for methods that take d to answer,
+// e.g. profiles sampled for d. They are given the configured timeout on
+// top of d, and are not retried since each attempt would start over.
+func callControlLong(method string, d time.Duration, params interface{}, result interface{}) error {
+	endpoint := fmt.Sprintf("http://%s/rpc", controlAddr())
+	reqb, err := json.Marshal(newControlCall(method, params))
+	if err != nil {
+		return err
+	}
+	timeout := rpcTimeout()
+	if timeout > 0 {
+		timeout += d
+	}
+
+	var res controlResult
+	err = classifyRPCError("control", controlHost(endpoint), postControlOnce(&http.Client{Timeout: timeout}, endpoint, reqb, &res))
+	if rerr, ok := err.(*rpcError); ok {
+		rerr.timeout = timeout
+	}
+	if err != nil {
+		return err
+	}
+	if err := res.decode(result); err != nil {
+		return classifyRPCError("control", controlHost(endpoint), err)
+	}
+	return nil
+}
+
+// controlHost returns the host:port of a control endpoint URL.
+func controlHost(endpoint string) string {
+	if u, err := url.Parse(endpoint); err == nil && u.Host != "" {
+		return u.Host
+	}
+	return endpoint
+}
+
+// controlCall is a request of a batch sent with callControlBatch. Result,
+// if not nil, receives the result, and Err is set if the call failed.
+type controlCall struct {
+	Method string
+	Params interface{}
+	Result interface{}
+	Err    error
+}
+
+// callControlBatch sends calls to the control server of the running node
+// as one batch. It returns an error if the batch failed as a whole;
+// errors of single calls are set in their Err.
+func callControlBatch(calls []*controlCall) error {
+	endpoint := fmt.Sprintf("http://%s/rpc", controlAddr())
+
+	reqs := make([]map[string]interface{}, 0, len(calls))
+	byID := make(map[int64]*controlCall, len(calls))
+	for _, c := range calls {
+		req := newControlCall(c.Method, c.Params)
+		reqs = append(reqs, req)
+		byID[req["id"].(int64)] = c
+	}
+
+	var res []controlResult
+	if err := postControl(rpcHTTPClient(), endpoint, reqs, &res); err != nil {
+		return err
+	}
+	for i := range res {
+		var id int64
+		if json.Unmarshal(res[i].ID, &id) != nil || byID[id] == nil {
+			continue
+		}
+		c := byID[id]
+		delete(byID, id)
+		c.Err = res[i].decode(c.Result)
+	}
+	for _, c := range byID {
+		c.Err = fmt.Errorf("no response to %s", c.Method)
+	}
+	return nil
+}
+
+func newControlCall(method string, params interface{}) map[string]interface{} {
+	req := map[string]interface{}{
+		"jsonrpc": "2.0",
+		"method":  method,
+		"id":      atomic.AddInt64(&controlRequestID, 1)}
+	if params != nil {
+		req["params"] = params
+	}
+	return req
+}
+
+type controlResult struct {
+	ID     json.RawMessage `json:"id"`
+	Result json.RawMessage `json:"result"`
+	Error  *controlError   `json:"error"`
+}
+
+func (r *controlResult) decode(result interface{}) error {
+	if r.Error != nil {
+		return r.Error
+	}
+	if result == nil || len(r.Result) == 0 {
+		return nil
+	}
+	return json.Unmarshal(r.Result, result)
+}
+
+// postControl posts req to endpoint with the configured retries and
+// decodes the response into res. A single error response is returned as
+// error even if a batch was sent. Errors are returned as rpcError.
+func postControl(client *http.Client, endpoint string, req interface{}, res interface{}) error {
+	reqb, err := json.Marshal(req)
+	if err != nil {
+		return err
+	}
+
+	return retryRPC("control", controlHost(endpoint), func() error {
+		return postControlOnce(client, endpoint, reqb, res)
+	})
+}
+
+// postControlOnce is postControl without retries.
+func postControlOnce(client *http.Client, endpoint string, reqb []byte, res interface{}) error {
+	httpRes, err := client.Post(endpoint, "application/json", bytes.NewReader(reqb))
+	if err != nil {
+		return err
+	}
+	defer httpRes.Body.Close()
+
+	body, err := ioutil.ReadAll(httpRes.Body)
+	if err != nil {
+		return err
+	}
+	if httpRes.StatusCode != http.StatusOK {
+		return &httpStatusError{code: httpRes.StatusCode, status: httpRes.Status}
+	}
+	if _, batch := res.(*[]controlResult); batch && len(body) > 0 && body[0] == '{' {
+		var single controlResult
+		if err := json.Unmarshal(body, &single); err != nil {
+			return err
+		}
+		if single.Error != nil {
+			return single.Error
+		}
+	}
+	return json.Unmarshal(body, res)
+}
+
+// controlUnreachable reports whether err means that no node is listening
+// on the control port.
+func controlUnreachable(err error) bool {
+	rerr, ok := err.(*rpcError)
+	return ok && rerr.kind == rpcErrUnreachable
+}
@@ -0,0 +1,170 @@
+// Copyright © 2018 J. Strobus White.
+// This file is part of the blocktop blockchain development kit.
+//
+// Blocktop is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// Blocktop is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with blocktop. If not, see <http://www.gnu.org/licenses/>.
+
+package cmd
+
+import (
+	"encoding/json"
+	"reflect"
+	"sort"
+	"strings"
+	"time"
+)
+
+// controlMethodDoc describes a control method for rpc.discover. params
+// and result are values of the types the method takes and returns, nil if
+// it takes no params. The fields of params are the params of the method,
+// unless positional is set, in which case params is its only param.
+type controlMethodDoc struct {
+	summary    string
+	params     interface{}
+	result     interface{}
+	positional bool
+}
+
+func init() {
+	registerControlMethod("rpc.discover", controlMethodDoc{
+		summary: "This OpenRPC document."},
+		func(json.RawMessage) (interface{}, error) {
+			return discoverControlMethods(), nil
+		})
+}
+
+// discoverControlMethods returns an OpenRPC document listing the
+// registered control methods.
+func discoverControlMethods() map[string]interface{} {
+	controlMethodsMu.RLock()
+	docs := make(map[string]controlMethodDoc, len(controlMethods))
+	for name, m := range controlMethods {
+		docs[name] = m.doc
+	}
+	controlMethodsMu.RUnlock()
+
+	return openRPCDocument("lucky control", docs)
+}
+
+// openRPCDocument returns an OpenRPC document titled title listing the
+// methods described by docs.
+func openRPCDocument(title string, docs map[string]controlMethodDoc) map[string]interface{} {
+	names := make([]string, 0, len(docs))
+	for name := range docs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	methods := make([]map[string]interface{}, 0, len(names))
+	for _, name := range names {
+		doc := docs[name]
+		params := make([]map[string]interface{}, 0)
+		structure := "by-name"
+		if doc.positional {
+			structure = "by-position"
+			params = append(params, map[string]interface{}{
+				"name":     "args",
+				"required": true,
+				"schema":   jsonSchema(reflect.TypeOf(doc.params))})
+		} else if doc.params != nil {
+			schema := jsonSchema(reflect.TypeOf(doc.params))
+			props, _ := schema["properties"].(map[string]interface{})
+			keys := make([]string, 0, len(props))
+			for k := range props {
+				keys = append(keys, k)
+			}
+			sort.Strings(keys)
+			for _, k := range keys {
+				params = append(params, map[string]interface{}{"name": k, "schema": props[k]})
+			}
+		}
+
+		result := map[string]interface{}{}
+		if doc.result != nil {
+			result = jsonSchema(reflect.TypeOf(doc.result))
+		}
+
+		m := map[string]interface{}{
+			"name":           name,
+			"paramStructure": structure,
+			"params":         params,
+			"result":         map[string]interface{}{"name": "result", "schema": result}}
+		if doc.summary != "" {
+			m["summary"] = doc.summary
+		}
+		methods = append(methods, m)
+	}
+
+	return map[string]interface{}{
+		"openrpc": "1.2.6",
+		"info":    map[string]interface{}{"title": title, "version": rootCmd.Version},
+		"methods": methods}
+}
+
+var (
+	timeType      = reflect.TypeOf(time.Time{})
+	marshalerType = reflect.TypeOf((*json.Marshaler)(nil)).Elem()
+)
+
+// jsonSchema returns the JSON schema of the JSON encoding of values of
+// type t. Types with their own encoding are described by an empty schema.
+func jsonSchema(t reflect.Type) map[string]interface{} {
+	for t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	if t == timeType {
+		return map[string]interface{}{"type": "string", "format": "date-time"}
+	}
+	if t.Implements(marshalerType) || reflect.PtrTo(t).Implements(marshalerType) {
+		return map[string]interface{}{}
+	}
+
+	switch t.Kind() {
+	case reflect.Bool:
+		return map[string]interface{}{"type": "boolean"}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return map[string]interface{}{"type": "integer"}
+	case reflect.Float32, reflect.Float64:
+		return map[string]interface{}{"type": "number"}
+	case reflect.String:
+		return map[string]interface{}{"type": "string"}
+	case reflect.Slice, reflect.Array:
+		if t.Elem().Kind() == reflect.Uint8 {
+			return map[string]interface{}{"type": "string", "contentEncoding": "base64"}
+		}
+		return map[string]interface{}{"type": "array", "items": jsonSchema(t.Elem())}
+	case reflect.Map:
+		return map[string]interface{}{"type": "object", "additionalProperties": jsonSchema(t.Elem())}
+	case reflect.Struct:
+		props := make(map[string]interface{})
+		for i := 0; i < t.NumField(); i++ {
+			f := t.Field(i)
+			if f.PkgPath != "" {
+				continue
+			}
+			name := f.Name
+			if tag := f.Tag.Get("json"); tag != "" {
+				if tag == "-" {
+					continue
+				}
+				if n := strings.Split(tag, ",")[0]; n != "" {
+					name = n
+				}
+			}
+			props[name] = jsonSchema(f.Type)
+		}
+		return map[string]interface{}{"type": "object", "properties": props}
+	}
+	return map[string]interface{}{}
+}
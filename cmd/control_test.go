@@ -0,0 +1,200 @@
+// Copyright © 2018 J. Strobus White.
+// This file is part of the blocktop blockchain development kit.
+//
+// Blocktop is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// Blocktop is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with blocktop. If not, see <http://www.gnu.org/licenses/>.
+
+package cmd
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+type testEchoParams struct {
+	Value string `json:"value"`
+}
+
+func registerTestControlMethods(t *testing.T) {
+	registerControlMethod("test.echo", controlMethodDoc{params: &testEchoParams{}},
+		func(params json.RawMessage) (interface{}, error) {
+			var p testEchoParams
+			if err := decodeControlParams(params, &p); err != nil {
+				return nil, err
+			}
+			return p.Value, nil
+		})
+	registerControlMethod("test.fail", controlMethodDoc{},
+		func(json.RawMessage) (interface{}, error) {
+			return nil, errors.New("boom")
+		})
+
+	t.Cleanup(func() {
+		controlMethodsMu.Lock()
+		delete(controlMethods, "test.echo")
+		delete(controlMethods, "test.fail")
+		controlMethodsMu.Unlock()
+	})
+}
+
+func TestHandleControlRequest(t *testing.T) {
+	registerTestControlMethods(t)
+
+	tests := []struct {
+		name        string
+		req         controlRequest
+		result      interface{}
+		code        int
+		params      bool
+		suggestions []string
+	}{
+		{"result", controlRequest{Method: "test.echo", Params: json.RawMessage(`{"value":"hi"}`)}, "hi", 0, false, nil},
+		{"no params", controlRequest{Method: "test.echo"}, "", 0, false, nil},
+		{"invalid params", controlRequest{Method: "test.echo", Params: json.RawMessage(`{"value":1}`)}, nil, controlErrInvalidParams, true, nil},
+		{"handler error", controlRequest{Method: "test.fail"}, nil, controlErrInternal, false, nil},
+		{"unknown method", controlRequest{Method: "test.echoes"}, nil, controlErrMethodNotFound, false, []string{"test.echo", "test.fail"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			res := handleControlRequest(&tt.req)
+			if tt.code == 0 {
+				if res.Error != nil {
+					t.Fatalf("unexpected error %v", res.Error)
+				}
+				if !reflect.DeepEqual(res.Result, tt.result) {
+					t.Errorf("result = %v, want %v", res.Result, tt.result)
+				}
+				return
+			}
+
+			if res.Error == nil {
+				t.Fatalf("no error, result %v", res.Result)
+			}
+			if res.Error.Code != tt.code {
+				t.Errorf("code = %d, want %d", res.Error.Code, tt.code)
+			}
+			if res.Error.Data == nil || res.Error.Data.Method != tt.req.Method {
+				t.Errorf("error data %+v does not name method %s", res.Error.Data, tt.req.Method)
+				return
+			}
+			if got := res.Error.Data.Params != nil; got != tt.params {
+				t.Errorf("params schema given = %v, want %v", got, tt.params)
+			}
+			if !reflect.DeepEqual(res.Error.Data.Suggestions, tt.suggestions) {
+				t.Errorf("suggestions = %v, want %v", res.Error.Data.Suggestions, tt.suggestions)
+			}
+		})
+	}
+}
+
+func TestServeJSONRPC(t *testing.T) {
+	registerTestControlMethods(t)
+
+	tests := []struct {
+		name   string
+		body   string
+		status int
+		// want is the response, compared as JSON, or empty for none
+		want string
+	}{
+		{"single",
+			`{"jsonrpc":"2.0","method":"test.echo","params":{"value":"a"},"id":1}`,
+			http.StatusOK,
+			`{"jsonrpc":"2.0","result":"a","id":1}`},
+		{"notification",
+			`{"jsonrpc":"2.0","method":"test.echo"}`,
+			http.StatusNoContent,
+			``},
+		{"batch",
+			`[{"jsonrpc":"2.0","method":"test.echo","params":{"value":"a"},"id":1},
+			  {"jsonrpc":"2.0","method":"test.echo","params":{"value":"b"}},
+			  {"jsonrpc":"2.0","method":"test.fail","id":"x"}]`,
+			http.StatusOK,
+			`[{"jsonrpc":"2.0","result":"a","id":1},
+			  {"jsonrpc":"2.0","error":{"code":-32603,"message":"boom","data":{"method":"test.fail"}},"id":"x"}]`},
+		{"batch of notifications",
+			`[{"jsonrpc":"2.0","method":"test.echo"},{"jsonrpc":"2.0","method":"test.fail"}]`,
+			http.StatusNoContent,
+			``},
+		{"invalid request in batch",
+			`[{"jsonrpc":"1.0","method":"test.echo","id":1},{"jsonrpc":"2.0","method":"test.echo","id":2}]`,
+			http.StatusOK,
+			`[{"jsonrpc":"2.0","error":{"code":-32600,"message":"invalid request","data":{"detail":"jsonrpc must be \"2.0\" and method must be given"}},"id":1},
+			  {"jsonrpc":"2.0","result":"","id":2}]`},
+		{"empty batch",
+			`[]`,
+			http.StatusOK,
+			`{"jsonrpc":"2.0","error":{"code":-32600,"message":"invalid request","data":{"detail":"a batch must hold 1 to 100 requests"}},"id":null}`},
+		{"parse error",
+			`{"jsonrpc":`,
+			http.StatusOK,
+			`{"jsonrpc":"2.0","error":{"code":-32700,"message":"parse error","data":{"detail":"unexpected end of JSON input"}},"id":null}`},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			r := httptest.NewRequest(http.MethodPost, "/rpc", strings.NewReader(tt.body))
+			serveJSONRPC(w, r, handleControlRequest)
+
+			if w.Code != tt.status {
+				t.Fatalf("status = %d, want %d", w.Code, tt.status)
+			}
+			if tt.want == "" {
+				if w.Body.Len() > 0 {
+					t.Errorf("unexpected body %s", w.Body)
+				}
+				return
+			}
+
+			var got, want interface{}
+			if err := json.Unmarshal(w.Body.Bytes(), &got); err != nil {
+				t.Fatalf("invalid response %s: %v", w.Body, err)
+			}
+			json.Unmarshal([]byte(tt.want), &want)
+			if !reflect.DeepEqual(got, want) {
+				t.Errorf("response = %s, want %s", w.Body, tt.want)
+			}
+		})
+	}
+}
+
+func TestSimilarMethods(t *testing.T) {
+	names := []string{"peers.list", "peers.ban", "faults.get", "kernel.metrics", "consensus.metrics", "rpc.discover"}
+
+	tests := []struct {
+		method string
+		want   []string
+	}{
+		{"peers.lst", []string{"peers.ban", "peers.list"}},
+		{"metrics", []string{"consensus.metrics", "kernel.metrics"}},
+		{"node.metrics", []string{"consensus.metrics", "kernel.metrics"}},
+		{"faults", []string{"faults.get"}},
+		{"faults.set", []string{"faults.get"}},
+		{"other.thing", []string{}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.method, func(t *testing.T) {
+			if got := similarMethods(tt.method, names); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("similarMethods(%q) = %v, want %v", tt.method, got, tt.want)
+			}
+		})
+	}
+}
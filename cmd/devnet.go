@@ -0,0 +1,285 @@
+// Copyright © 2018 J. Strobus White.
+// This file is part of the blocktop blockchain development kit.
+//
+// Blocktop is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// Blocktop is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with blocktop. If not, see <http://www.gnu.org/licenses/>.
+
+package cmd
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path"
+	"syscall"
+	"time"
+
+	"github.com/spf13/viper"
+)
+
+// Each devnet node uses devnetPortStride consecutive ports starting at
+// basePort + index*devnetPortStride.
+const devnetPortStride = 10
+
+// devnetConfig describes a local network of lucky nodes running as child
+// processes on the loopback interface.
+type devnetConfig struct {
+	Nodes          int
+	BasePort       int
+	BlockFrequency float64
+	ConsensusTime  time.Duration
+	Settings       map[string]interface{} // extra config applied to every node
+	InProcess      bool                   // run node 1 in this process
+}
+
+type devnetNode struct {
+	index       int
+	dir         string
+	configFile  string
+	peerID      string
+	p2pPort     int
+	controlPort int
+	inProcess   bool
+	cmd         *exec.Cmd
+	stopNode    func()
+	exited      chan struct{}
+}
+
+// devnet is a set of lucky nodes connected in a full mesh through static
+// peers, with discovery and public bootstrapping disabled.
+type devnet struct {
+	dir   string
+	nodes []*devnetNode
+}
+
+// newDevnet writes the config of every node below dir. Nodes are numbered
+// from 1, node 1 produces the genesis block.
+func newDevnet(dir string, cfg *devnetConfig) (*devnet, error) {
+	if cfg.Nodes < 1 {
+		return nil, errors.New("a devnet needs at least one node")
+	}
+
+	d := &devnet{dir: dir}
+	ids := make([]*nodeIdentity, cfg.Nodes)
+	for i := range ids {
+		id, err := generateIdentity()
+		if err != nil {
+			return nil, err
+		}
+		ids[i] = id
+
+		port := cfg.BasePort + i*devnetPortStride
+		d.nodes = append(d.nodes, &devnetNode{
+			index:       i + 1,
+			dir:         path.Join(dir, fmt.Sprintf("node%d", i+1)),
+			peerID:      id.PeerID,
+			p2pPort:     port,
+			controlPort: port + 2,
+			inProcess:   cfg.InProcess && i == 0})
+	}
+
+	for i, n := range d.nodes {
+		port := n.p2pPort
+		static := make([]string, 0, len(d.nodes)-1)
+		for _, o := range d.nodes {
+			if o != n {
+				static = append(static, fmt.Sprintf("/ip4/127.0.0.1/tcp/%d/ipfs/%s", o.p2pPort, o.peerID))
+			}
+		}
+
+		v := viper.New()
+		for k, val := range cfg.Settings {
+			v.Set(k, val)
+		}
+		v.Set("node.privateKey", ids[i].PrivateKey)
+		v.Set("node.publicKey", ids[i].PublicKey)
+		v.Set("node.peerID", ids[i].PeerID)
+		v.Set("node.port", port)
+		v.Set("node.addresses", []string{fmt.Sprintf("/ip4/127.0.0.1/tcp/%d", port)})
+		v.Set("node.staticPeers", static)
+		v.Set("node.discovery.mode", discoveryNone)
+		v.Set("node.bootstrapper.disable", true)
+		v.Set("rpc.port", port+1)
+		v.Set("rpc.internalPort", port+6)
+		v.Set("control.port", n.controlPort)
+		v.Set("store.ipfs.apiport", port+3)
+		v.Set("store.ipfs.gatewayport", port+4)
+		v.Set("store.ipfs.swarmport", port+5)
+		v.Set("blockchain.dataDir", path.Join(n.dir, "data"))
+		v.Set("store.dataDir", path.Join(n.dir, "data"))
+		v.Set("blockchain.genesis", n.index == 1)
+		if cfg.BlockFrequency > 0 {
+			v.Set("blockchain.blockFrequency", cfg.BlockFrequency)
+		}
+		if cfg.ConsensusTime > 0 {
+			v.Set("blockchain.consensus.time", cfg.ConsensusTime)
+		}
+
+		makeDirAll(n.dir)
+		n.configFile = path.Join(n.dir, "config.yaml")
+		if err := v.WriteConfigAs(n.configFile); err != nil {
+			return nil, err
+		}
+	}
+
+	return d, nil
+}
+
+func (n *devnetNode) controlAddr() string {
+	return fmt.Sprintf("localhost:%d", n.controlPort)
+}
+
+func (n *devnetNode) running() bool {
+	if n.exited == nil {
+		return false
+	}
+	select {
+	case <-n.exited:
+		return false
+	default:
+		return true
+	}
+}
+
+// start launches the node and waits until its control server answers.
+func (n *devnetNode) start() error {
+	var err error
+	if n.inProcess {
+		err = n.launchInProcess()
+	} else {
+		err = n.launch()
+	}
+	if err != nil {
+		return err
+	}
+
+	deadline := time.Now().Add(60 * time.Second)
+	for time.Now().Before(deadline) {
+		if !n.running() {
+			return fmt.Errorf("node %d exited during startup, see %s", n.index, path.Join(n.dir, "node.log"))
+		}
+		if callControlAt(n.controlAddr(), "peers.list", nil, nil) == nil {
+			return nil
+		}
+		time.Sleep(250 * time.Millisecond)
+	}
+	n.stop()
+	return fmt.Errorf("node %d did not start within 60s", n.index)
+}
+
+// launch starts the node as a child process logging to node.log.
+func (n *devnetNode) launch() error {
+	exe, err := os.Executable()
+	if err != nil {
+		return err
+	}
+	log, err := os.OpenFile(path.Join(n.dir, "node.log"), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+
+	n.cmd = exec.Command(exe, "blockchain", "--config", n.configFile)
+	n.cmd.Stdout = log
+	n.cmd.Stderr = log
+	if err = n.cmd.Start(); err != nil {
+		log.Close()
+		return err
+	}
+	n.exited = make(chan struct{})
+	go func() {
+		n.cmd.Wait()
+		log.Close()
+		close(n.exited)
+	}()
+	return nil
+}
+
+// launchInProcess starts the node in this process. It logs to the log of
+// this process. Since the kernel is a singleton, it can only be done once
+// per process.
+func (n *devnetNode) launchInProcess() error {
+	if n.stopNode != nil {
+		return fmt.Errorf("node %d runs in process and cannot be started again", n.index)
+	}
+
+	// the node reads its config from viper. Its settings are laid over the
+	// config of this process, which keeps its config file, rather than
+	// replacing it.
+	v := viper.New()
+	v.SetConfigFile(n.configFile)
+	if err := v.ReadInConfig(); err != nil {
+		return err
+	}
+	for _, k := range v.AllKeys() {
+		viper.Set(k, v.Get(k))
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	stop, err := startNode(ctx)
+	if err != nil {
+		cancel()
+		return fmt.Errorf("node %d: %v", n.index, err)
+	}
+	exited := make(chan struct{})
+	n.stopNode = func() {
+		stop()
+		cancel()
+		close(exited)
+	}
+	n.exited = exited
+	return nil
+}
+
+// stop shuts the node down, killing it if it does not exit within 10s.
+func (n *devnetNode) stop() {
+	if !n.running() {
+		return
+	}
+	if n.inProcess {
+		n.stopNode()
+		return
+	}
+	n.cmd.Process.Signal(syscall.SIGTERM)
+	select {
+	case <-n.exited:
+	case <-time.After(10 * time.Second):
+		n.cmd.Process.Kill()
+		<-n.exited
+	}
+}
+
+func (d *devnet) start() error {
+	for _, n := range d.nodes {
+		if err := n.start(); err != nil {
+			d.stop()
+			return err
+		}
+	}
+	return nil
+}
+
+func (d *devnet) stop() {
+	for _, n := range d.nodes {
+		n.stop()
+	}
+}
+
+// node returns the node with the 1-based index i.
+func (d *devnet) node(i int) (*devnetNode, error) {
+	if i < 1 || i > len(d.nodes) {
+		return nil, fmt.Errorf("no node %d in a devnet of %d nodes", i, len(d.nodes))
+	}
+	return d.nodes[i-1], nil
+}
@@ -0,0 +1,59 @@
+// Copyright © 2018 J. Strobus White.
+// This file is part of the blocktop blockchain development kit.
+//
+// Blocktop is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// Blocktop is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with blocktop. If not, see <http://www.gnu.org/licenses/>.
+
+package cmd
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/spf13/cobra"
+)
+
+// diagCmd represents the diag command
+var diagCmd = &cobra.Command{
+	Use:   "diag",
+	Short: "Diagnoses a running lucky blockchain.",
+	Long: `Usage: lucky diag [OPTIONS]
+       lucky diag [SUBCOMMAND] [OPTIONS]
+
+Shows the runtime statistics of a running node. The subcommands capture
+profiles and other diagnostics.`,
+	Run: func(cmd *cobra.Command, args []string) {
+		var s runtimeStats
+		if err := callControl("diag.runtime", nil, &s); err != nil {
+			failWithError(err)
+		}
+
+		printResult(&s, func() {
+			fmt.Printf("uptime:      %v\n", (time.Duration(s.Uptime) * time.Second).String())
+			fmt.Printf("goroutines:  %d\n", s.Goroutines)
+			fmt.Printf("heap:        %.1f MB (%.1f MB reserved)\n", float64(s.HeapAlloc)/(1<<20), float64(s.HeapSys)/(1<<20))
+			fmt.Printf("sys:         %.1f MB\n", float64(s.Sys)/(1<<20))
+			fmt.Printf("GC cycles:   %d\n", s.NumGC)
+			fmt.Printf("CPU time:    %.1fs\n", s.CPUSeconds)
+		})
+	},
+}
+
+var diagInJson bool
+
+func init() {
+	rootCmd.AddCommand(diagCmd)
+
+	diagCmd.Flags().BoolVarP(&diagInJson, "json", "j", false, "output in json")
+	deprecateJSONFlag(diagCmd.Flags())
+}
@@ -0,0 +1,429 @@
+// Copyright © 2018 J. Strobus White.
+// This file is part of the blocktop blockchain development kit.
+//
+// Blocktop is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// Blocktop is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with blocktop. If not, see <http://www.gnu.org/licenses/>.
+
+package cmd
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"runtime"
+	"runtime/debug"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+	yaml "gopkg.in/yaml.v2"
+)
+
+// diagBundleCmd represents the bundle command
+var diagBundleCmd = &cobra.Command{
+	Use:   "bundle",
+	Short: "Collects diagnostics into a tar.gz for bug reports.",
+	Long: `Usage: lucky diag bundle [OPTIONS]
+
+Gathers the config with secrets removed, version and build info, recent
+logs of lucky (log.file) and of the blocktop libraries (glog files), and
+from the running node its kernel and consensus metrics, consensus tree,
+fork history, peers, network usage, runtime statistics and heap and
+goroutine profiles into a single tar.gz. Anything that
+cannot be collected, e.g. because the node is not running, is listed in
+errors.txt in the bundle.`,
+	Run: func(cmd *cobra.Command, args []string) {
+		out := bundleOut
+		if out == "" {
+			out = fmt.Sprintf("lucky-bundle-%s.tar.gz", time.Now().Format("20060102-150405"))
+		}
+
+		f, err := os.Create(out)
+		if err != nil {
+			failWithError(err)
+		}
+		b := newDiagBundle(f)
+		b.collect()
+		if err = b.close(); err != nil {
+			failWithError(err)
+		}
+		if err = f.Close(); err != nil {
+			failWithError(err)
+		}
+
+		res := &bundleFile{File: out, Errors: b.errors}
+		if res.Errors == nil {
+			res.Errors = []string{}
+		}
+		printResult(res, func() {
+			fmt.Printf("Wrote %s", out)
+			if len(b.errors) > 0 {
+				fmt.Printf(" (%d items could not be collected, see errors.txt)", len(b.errors))
+			}
+			fmt.Println()
+		})
+	},
+}
+
+// bundleFile is the output of lucky diag bundle. Errors lists the items
+// that could not be collected.
+type bundleFile struct {
+	File   string   `json:"file"`
+	Errors []string `json:"errors"`
+}
+
+var (
+	bundleOut      string
+	bundleLogBytes int64
+	bundleCPU      time.Duration
+)
+
+// redactedConfigKeys are removed from the config in a bundle. Keys
+// containing any of these are redacted.
+var redactedConfigKeys = []string{"privatekey", "password", "secret", "token"}
+
+func init() {
+	diagCmd.AddCommand(diagBundleCmd)
+
+	flags := diagBundleCmd.Flags()
+	flags.StringVarP(&bundleOut, "out", "o", "", "output file (default is lucky-bundle-<time>.tar.gz)")
+	flags.Int64Var(&bundleLogBytes, "logBytes", 10<<20, "bytes to include from the end of each log file")
+	flags.DurationVar(&bundleCPU, "cpu", 0, "also capture a CPU profile for this long")
+}
+
+type diagBundle struct {
+	gz     *gzip.Writer
+	tw     *tar.Writer
+	now    time.Time
+	errors []string
+}
+
+func newDiagBundle(w io.Writer) *diagBundle {
+	gz := gzip.NewWriter(w)
+	return &diagBundle{gz: gz, tw: tar.NewWriter(gz), now: time.Now()}
+}
+
+func (b *diagBundle) collect() {
+	b.addYAML("config.yaml", redactConfig(viper.AllSettings()))
+	b.addJSON("version.json", buildVersion())
+	b.addLogs()
+
+	b.addControl(map[string]*controlCall{
+		"runtime.json":           {Method: "diag.runtime"},
+		"kernel-metrics.json":    {Method: "kernel.metrics", Params: &metricsParams{Format: "json"}},
+		"consensus-metrics.json": {Method: "consensus.metrics", Params: &metricsParams{Format: "json"}},
+		"consensus-tree.json":    {Method: "consensus.tree", Params: &metricsParams{Format: "json"}},
+		"peers.json":             {Method: "peers.list"},
+		"bans.json":              {Method: "peers.bans"},
+		"network-usage.json":     {Method: "network.usage"},
+		"faults.json":            {Method: "faults.get"}})
+	b.addRPC("consensus-history.json", "consensus.history", &forkHistoryParams{Since: "1h"})
+
+	b.addProfile(profileHeap, 0)
+	b.addProfile(profileGoroutine, 0)
+	if bundleCPU > 0 {
+		b.addProfile(profileCPU, bundleCPU)
+	}
+
+	if len(b.errors) > 0 {
+		b.add("errors.txt", []byte(strings.Join(b.errors, "\n")+"\n"))
+	}
+}
+
+func (b *diagBundle) close() error {
+	if err := b.tw.Close(); err != nil {
+		return err
+	}
+	return b.gz.Close()
+}
+
+func (b *diagBundle) fail(name string, err error) {
+	b.errors = append(b.errors, fmt.Sprintf("%s: %v", name, err))
+}
+
+func (b *diagBundle) add(name string, data []byte) {
+	hdr := &tar.Header{
+		Name:    path.Join("lucky-bundle", name),
+		Mode:    0644,
+		Size:    int64(len(data)),
+		ModTime: b.now}
+	if err := b.tw.WriteHeader(hdr); err != nil {
+		failWithError(err)
+	}
+	if _, err := b.tw.Write(data); err != nil {
+		failWithError(err)
+	}
+}
+
+func (b *diagBundle) addJSON(name string, v interface{}) {
+	data, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		b.fail(name, err)
+		return
+	}
+	b.add(name, data)
+}
+
+func (b *diagBundle) addYAML(name string, v interface{}) {
+	data, err := yaml.Marshal(v)
+	if err != nil {
+		b.fail(name, err)
+		return
+	}
+	b.add(name, data)
+}
+
+// addRPC adds the result of a call to a method of lucky on the RPC server.
+func (b *diagBundle) addRPC(name string, method string, params interface{}) {
+	var res json.RawMessage
+	if err := callNodeRPC(method, params, &res); err != nil {
+		b.fail(name, err)
+		return
+	}
+	b.addJSON(name, res)
+}
+
+// addControl adds the results of calls, fetched in one batch, under the
+// file names they are keyed by.
+func (b *diagBundle) addControl(calls map[string]*controlCall) {
+	names := make([]string, 0, len(calls))
+	batch := make([]*controlCall, 0, len(calls))
+	for name, c := range calls {
+		c.Result = &json.RawMessage{}
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		batch = append(batch, calls[name])
+	}
+
+	err := callControlBatch(batch)
+	for _, name := range names {
+		c := calls[name]
+		switch {
+		case err != nil:
+			b.fail(name, err)
+		case c.Err != nil:
+			b.fail(name, c.Err)
+		default:
+			b.addJSON(name, c.Result)
+		}
+	}
+}
+
+func (b *diagBundle) addProfile(kind string, d time.Duration) {
+	name := path.Join("profiles", kind+".pb.gz")
+	params := &profileParams{Type: kind}
+	if d > 0 {
+		params.Duration = d.String()
+	}
+
+	var res profileResult
+	if err := callControlLong("diag.profile", d, params, &res); err != nil {
+		b.fail(name, err)
+		return
+	}
+	b.add(name, res.Data)
+}
+
+// maxBundleLogBackups is the number of rotated log files in a bundle.
+const maxBundleLogBackups = 2
+
+// addLogs adds the tails of the log files of the node, those of lucky and
+// the glog files of the blocktop libraries, which it asks the node for.
+// Since a bundle without logs is of little use for a bug report, it warns
+// if it finds neither.
+func (b *diagBundle) addLogs() {
+	var logs nodeLogs
+	lucky, glog := false, false
+	if err := callControl("diag.logs", nil, &logs); err != nil {
+		b.fail("logs", err)
+	} else {
+		lucky = b.addLuckyLogs(logs.File)
+		glog = b.addGlogLogs(logs.Glog)
+	}
+	if !lucky && !glog {
+		fmt.Fprintln(os.Stderr, "Warning: the bundle holds no logs, see errors.txt in the bundle")
+	}
+}
+
+func (b *diagBundle) addLuckyLogs(file string) bool {
+	if file == "" {
+		b.fail("logs", fmt.Errorf("the node has no log file, set log.file or --logFile"))
+		return false
+	}
+
+	// rotated backups are named <name>-<time><ext>, optionally gzipped
+	backups, _ := filepath.Glob(strings.TrimSuffix(file, filepath.Ext(file)) + "-*" + filepath.Ext(file) + "*")
+	sort.Strings(backups)
+	if len(backups) > maxBundleLogBackups {
+		backups = backups[len(backups)-maxBundleLogBackups:]
+	}
+	return b.addLogFiles("logs", append(backups, file))
+}
+
+// addGlogLogs adds the newest of the glog files of the node.
+func (b *diagBundle) addGlogLogs(files []string) bool {
+	if len(files) == 0 {
+		b.fail("logs/glog", fmt.Errorf("the node has no glog files, does it run with --logtostderr?"))
+		return false
+	}
+	if len(files) > maxBundleLogBackups+1 {
+		files = files[len(files)-maxBundleLogBackups-1:]
+	}
+	return b.addLogFiles("logs/glog", files)
+}
+
+// nodeLogs are the log files of a node.
+type nodeLogs struct {
+	File string   `json:"file,omitempty"` // lucky's log file
+	Glog []string `json:"glog"`           // glog INFO files, oldest first
+}
+
+func registerLogsControlMethod() {
+	registerControlMethod("diag.logs", controlMethodDoc{
+		summary: "The log files of the node.",
+		result:  &nodeLogs{}},
+		func(json.RawMessage) (interface{}, error) {
+			return readNodeLogs(), nil
+		})
+}
+
+// readNodeLogs returns the log files of this process. glog writes them to
+// its log_dir, or the temp directory, named
+// <program>.<host>.<user>.log.<severity>.<time>.<pid>, so that the newest
+// sort last. The INFO files hold the messages of all severities.
+func readNodeLogs() *nodeLogs {
+	logs := &nodeLogs{Glog: make([]string, 0)}
+	if file := viper.GetString("log.file"); file != "" {
+		logs.File, _ = filepath.Abs(file)
+	}
+
+	dir := os.TempDir()
+	if f := flag.Lookup("log_dir"); f != nil && f.Value.String() != "" {
+		dir = f.Value.String()
+	}
+	program := filepath.Base(os.Args[0])
+	files, _ := filepath.Glob(filepath.Join(dir, fmt.Sprintf("%s.*.log.INFO.*.%d", program, os.Getpid())))
+	for _, f := range files {
+		if abs, err := filepath.Abs(f); err == nil {
+			logs.Glog = append(logs.Glog, abs)
+		}
+	}
+	sort.Strings(logs.Glog)
+	return logs
+}
+
+// addLogFiles adds the tails of files below dir and returns whether any
+// could be read.
+func (b *diagBundle) addLogFiles(dir string, files []string) bool {
+	added := false
+	for _, f := range files {
+		data, err := tailFile(f, bundleLogBytes)
+		if err != nil {
+			b.fail(path.Join(dir, path.Base(f)), err)
+			continue
+		}
+		b.add(path.Join(dir, path.Base(f)), data)
+		added = true
+	}
+	return added
+}
+
+func tailFile(file string, n int64) ([]byte, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	info, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	if info.Size() > n {
+		if strings.HasSuffix(file, ".gz") {
+			return nil, fmt.Errorf("compressed log is larger than %d bytes", n)
+		}
+		if _, err = f.Seek(info.Size()-n, io.SeekStart); err != nil {
+			return nil, err
+		}
+	}
+	return ioutil.ReadAll(f)
+}
+
+// redactConfig returns a copy of settings without secrets.
+func redactConfig(settings map[string]interface{}) map[string]interface{} {
+	res := make(map[string]interface{}, len(settings))
+	for k, v := range settings {
+		if redactedKey(k) {
+			res[k] = "REDACTED"
+			continue
+		}
+		if m, ok := v.(map[string]interface{}); ok {
+			v = redactConfig(m)
+		}
+		res[k] = v
+	}
+	return res
+}
+
+func redactedKey(key string) bool {
+	key = strings.ToLower(key)
+	for _, r := range redactedConfigKeys {
+		if strings.Contains(key, r) {
+			return true
+		}
+	}
+	return false
+}
+
+type versionInfo struct {
+	Version   string            `json:"version"`
+	GoVersion string            `json:"goVersion"`
+	OS        string            `json:"os"`
+	Arch      string            `json:"arch"`
+	Module    string            `json:"module,omitempty"`
+	Deps      map[string]string `json:"deps,omitempty"`
+	Settings  map[string]string `json:"settings,omitempty"`
+}
+
+func buildVersion() *versionInfo {
+	v := &versionInfo{
+		Version:   rootCmd.Version,
+		GoVersion: runtime.Version(),
+		OS:        runtime.GOOS,
+		Arch:      runtime.GOARCH}
+
+	if info, ok := debug.ReadBuildInfo(); ok {
+		v.Module = info.Main.Path + "@" + info.Main.Version
+		v.Deps = make(map[string]string)
+		for _, d := range info.Deps {
+			v.Deps[d.Path] = d.Version
+		}
+		v.Settings = make(map[string]string)
+		for _, s := range info.Settings {
+			v.Settings[s.Key] = s.Value
+		}
+	}
+	return v
+}
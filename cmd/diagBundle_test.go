@@ -0,0 +1,67 @@
+// Copyright © 2018 J. Strobus White.
+// This file is part of the blocktop blockchain development kit.
+//
+// Blocktop is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// Blocktop is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with blocktop. If not, see <http://www.gnu.org/licenses/>.
+
+package cmd
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestRedactConfig(t *testing.T) {
+	tests := []struct {
+		name     string
+		settings map[string]interface{}
+		want     map[string]interface{}
+	}{
+		{"empty",
+			map[string]interface{}{},
+			map[string]interface{}{}},
+		{"plain values",
+			map[string]interface{}{"rpc": map[string]interface{}{"port": 28180}, "log": "info"},
+			map[string]interface{}{"rpc": map[string]interface{}{"port": 28180}, "log": "info"}},
+		{"secret keys",
+			map[string]interface{}{"privateKey": "abc", "apiToken": "t", "password": "p", "clientSecret": "s"},
+			map[string]interface{}{"privateKey": "REDACTED", "apiToken": "REDACTED", "password": "REDACTED", "clientSecret": "REDACTED"}},
+		{"nested",
+			map[string]interface{}{"api": map[string]interface{}{
+				"tls":  map[string]interface{}{"cert": "c.pem", "keyPassword": "p"},
+				"auth": map[string]interface{}{"tokens": []interface{}{"a", "b"}}}},
+			map[string]interface{}{"api": map[string]interface{}{
+				"tls":  map[string]interface{}{"cert": "c.pem", "keyPassword": "REDACTED"},
+				"auth": map[string]interface{}{"tokens": "REDACTED"}}}},
+		{"secret section",
+			map[string]interface{}{"secrets": map[string]interface{}{"a": "b"}},
+			map[string]interface{}{"secrets": "REDACTED"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := redactConfig(tt.settings); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("redactConfig() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRedactConfigCopies(t *testing.T) {
+	nested := map[string]interface{}{"password": "p"}
+	settings := map[string]interface{}{"db": nested}
+	redactConfig(settings)
+	if nested["password"] != "p" {
+		t.Errorf("redactConfig changed its input: %v", settings)
+	}
+}
@@ -0,0 +1,88 @@
+// Copyright © 2018 J. Strobus White.
+// This file is part of the blocktop blockchain development kit.
+//
+// Blocktop is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// Blocktop is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with blocktop. If not, see <http://www.gnu.org/licenses/>.
+
+package cmd
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"time"
+
+	"github.com/spf13/cobra"
+)
+
+// diagProfileCmd represents the profile command
+var diagProfileCmd = &cobra.Command{
+	Use:   "profile",
+	Short: "Captures a profile from a running lucky blockchain.",
+	Long: `Usage: lucky diag profile --type cpu|heap|goroutine|mutex|block [OPTIONS]
+
+Captures a profile in pprof format and writes it to the file given by -o,
+for use with go tool pprof. The cpu, mutex and block profiles are sampled
+for --duration, at most 5m, and hold only what happened in that time;
+mutex and block profiles round it up to whole seconds. Heap and goroutine
+profiles are a snapshot. The node is
+given --timeout on top of --duration to answer, and the call is not
+retried.`,
+	Run: func(cmd *cobra.Command, args []string) {
+		if profileOut == "" {
+			failWithError(errors.New("an output file is required, use -o"))
+		}
+
+		params := &profileParams{Type: profileType}
+		var d time.Duration
+		switch profileType {
+		case profileCPU, profileMutex, profileBlock:
+			d = profileDuration
+			params.Duration = d.String()
+			fmt.Fprintf(progressOutput(), "Capturing %s profile for %v...\n", profileType, profileDuration)
+		}
+
+		var res profileResult
+		if err := callControlLong("diag.profile", d, params, &res); err != nil {
+			failWithError(err)
+		}
+		if err := ioutil.WriteFile(profileOut, res.Data, 0644); err != nil {
+			failWithError(err)
+		}
+		printResult(&profileFile{Type: res.Type, File: profileOut, Bytes: len(res.Data)}, func() {
+			fmt.Printf("Wrote %s profile to %s\n", res.Type, profileOut)
+		})
+	},
+}
+
+// profileFile is the output of lucky diag profile.
+type profileFile struct {
+	Type  string `json:"type"`
+	File  string `json:"file"`
+	Bytes int    `json:"bytes"`
+}
+
+var (
+	profileType     string
+	profileDuration time.Duration
+	profileOut      string
+)
+
+func init() {
+	diagCmd.AddCommand(diagProfileCmd)
+
+	flags := diagProfileCmd.Flags()
+	flags.StringVar(&profileType, "type", profileCPU, "profile type: cpu, heap, goroutine, mutex or block")
+	flags.DurationVar(&profileDuration, "duration", 30*time.Second, "sampling time for cpu, mutex and block profiles")
+	flags.StringVarP(&profileOut, "out", "o", "", "file to write the profile to")
+}
@@ -0,0 +1,65 @@
+// Copyright © 2018 J. Strobus White.
+// This file is part of the blocktop blockchain development kit.
+//
+// Blocktop is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// Blocktop is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with blocktop. If not, see <http://www.gnu.org/licenses/>.
+
+package cmd
+
+import (
+	"encoding/json"
+	"runtime"
+	"time"
+)
+
+type runtimeStats struct {
+	Goroutines int     `json:"goroutines"`
+	HeapAlloc  uint64  `json:"heapAlloc"`
+	HeapSys    uint64  `json:"heapSys"`
+	Sys        uint64  `json:"sys"`
+	NumGC      uint32  `json:"numGC"`
+	CPUSeconds float64 `json:"cpuSeconds"` // user and system CPU time used by the process
+	Uptime     float64 `json:"uptime"`     // seconds
+}
+
+var processStart = time.Now()
+
+func readRuntimeStats() *runtimeStats {
+	var ms runtime.MemStats
+	runtime.ReadMemStats(&ms)
+
+	s := &runtimeStats{
+		Goroutines: runtime.NumGoroutine(),
+		HeapAlloc:  ms.HeapAlloc,
+		HeapSys:    ms.HeapSys,
+		Sys:        ms.Sys,
+		NumGC:      ms.NumGC,
+		Uptime:     time.Since(processStart).Seconds()}
+
+	if cpu, err := processCPUTime(); err == nil {
+		s.CPUSeconds = cpu.Seconds()
+	}
+
+	return s
+}
+
+func registerDiagnosticsControlMethods() {
+	registerControlMethod("diag.runtime", controlMethodDoc{
+		summary: "Go runtime statistics of the node.",
+		result:  &runtimeStats{}},
+		func(json.RawMessage) (interface{}, error) {
+			return readRuntimeStats(), nil
+		})
+	registerProfileControlMethod()
+	registerLogsControlMethod()
+}
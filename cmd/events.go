@@ -0,0 +1,304 @@
+// Copyright © 2018 J. Strobus White.
+// This file is part of the blocktop blockchain development kit.
+//
+// Blocktop is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// Blocktop is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with blocktop. If not, see <http://www.gnu.org/licenses/>.
+
+package cmd
+
+import (
+	"encoding/json"
+	"sync"
+	"time"
+
+	p2p "github.com/blocktop/go-network-libp2p"
+	spec "github.com/blocktop/go-spec"
+	inet "github.com/libp2p/go-libp2p-net"
+)
+
+// Event types published on the event bus. The fork event types
+// branchCreated, branchPruned and headChanged are published as well.
+const (
+	eventBlockProduced    = "blockProduced"
+	eventBlockReceived    = "blockReceived"
+	eventPeerConnected    = "peerConnected"
+	eventPeerDisconnected = "peerDisconnected"
+)
+
+const (
+	// maxRecentEvents is the number of events kept for clients that
+	// resume a stream or poll through the control server.
+	maxRecentEvents = 1000
+	// eventBufferSize is the number of events a subscriber may fall
+	// behind before it is dropped.
+	eventBufferSize = 256
+	// maxEventPollWait bounds how long events.poll waits for an event.
+	maxEventPollWait = time.Minute
+	// seenBlocksSize is the number of block hashes remembered to tell new
+	// blocks from relayed and duplicate ones.
+	seenBlocksSize = 4096
+)
+
+// nodeEvent is something that happened in the node. IDs increase by one
+// with each event.
+type nodeEvent struct {
+	ID   uint64      `json:"id"`
+	Type string      `json:"type"`
+	Time time.Time   `json:"time"`
+	Data interface{} `json:"data"`
+}
+
+type blockEvent struct {
+	Hash     string `json:"hash"`
+	Peer     string `json:"peer,omitempty"`
+	Protocol string `json:"protocol,omitempty"`
+}
+
+type peerEvent struct {
+	Peer      string `json:"peer"`
+	Addr      string `json:"addr,omitempty"`
+	Direction string `json:"direction,omitempty"`
+}
+
+type eventPollParams struct {
+	After  uint64   `json:"after"`
+	Types  []string `json:"types,omitempty"`
+	Wait   string   `json:"wait,omitempty"`   // duration to wait for an event
+	Latest bool     `json:"latest,omitempty"` // only return the last event ID
+}
+
+type eventPollResult struct {
+	Events []*nodeEvent `json:"events"`
+	Last   uint64       `json:"last"`
+}
+
+type eventSubscriber struct {
+	types map[string]bool
+	ch    chan *nodeEvent
+}
+
+// eventBus fans the events of the node out to API clients. It is fed by
+// the gossip node, the fork history and the network.
+type eventBus struct {
+	sync.Mutex
+	last        uint64
+	recent      []*nodeEvent
+	subscribers map[*eventSubscriber]bool
+	wake        chan struct{}
+	seen        map[string]bool
+	seenOrder   []string
+}
+
+func buildEventBus(node *p2p.NetworkNode, history *forkHistory) *eventBus {
+	b := &eventBus{
+		recent:      make([]*nodeEvent, 0, maxRecentEvents),
+		subscribers: make(map[*eventSubscriber]bool),
+		wake:        make(chan struct{}),
+		seen:        make(map[string]bool)}
+
+	history.subscribe(func(e forkEvent) {
+		if e.Type != forkBlockConfirmed {
+			b.publish(e.Type, e)
+		}
+	})
+
+	node.Host.Network().Notify(&inet.NotifyBundle{
+		ConnectedF: func(n inet.Network, c inet.Conn) {
+			if len(n.ConnsToPeer(c.RemotePeer())) == 1 {
+				b.publish(eventPeerConnected, newPeerEvent(c))
+			}
+		},
+		DisconnectedF: func(n inet.Network, c inet.Conn) {
+			if n.Connectedness(c.RemotePeer()) != inet.Connected {
+				b.publish(eventPeerDisconnected, newPeerEvent(c))
+			}
+		}})
+
+	registerControlMethod("events.poll", controlMethodDoc{
+		summary: "Node events after an event ID, waiting up to wait for new ones.",
+		params:  &eventPollParams{},
+		result:  &eventPollResult{}},
+		func(params json.RawMessage) (interface{}, error) {
+			var p eventPollParams
+			if err := decodeControlParams(params, &p); err != nil {
+				return nil, err
+			}
+			var wait time.Duration
+			if p.Wait != "" {
+				var err error
+				if wait, err = time.ParseDuration(p.Wait); err != nil {
+					return nil, newControlError(controlErrInvalidParams, err.Error())
+				}
+			}
+			if wait > maxEventPollWait {
+				wait = maxEventPollWait
+			}
+			return b.poll(&p, wait), nil
+		})
+
+	return b
+}
+
+func newPeerEvent(c inet.Conn) *peerEvent {
+	e := &peerEvent{Peer: c.RemotePeer().Pretty()}
+	if addr := c.RemoteMultiaddr(); addr != nil {
+		e.Addr = addr.String()
+	}
+	switch c.Stat().Direction {
+	case inet.DirInbound:
+		e.Direction = "inbound"
+	case inet.DirOutbound:
+		e.Direction = "outbound"
+	}
+	return e
+}
+
+func (b *eventBus) publish(typ string, data interface{}) {
+	b.Lock()
+	defer b.Unlock()
+
+	b.last++
+	e := &nodeEvent{ID: b.last, Type: typ, Time: time.Now(), Data: data}
+	if len(b.recent) == maxRecentEvents {
+		b.recent = append(b.recent[:0], b.recent[1:]...)
+	}
+	b.recent = append(b.recent, e)
+
+	for s := range b.subscribers {
+		if !s.wants(typ) {
+			continue
+		}
+		select {
+		case s.ch <- e:
+		default:
+			// the subscriber fell behind, it can resume from the
+			// recent events
+			delete(b.subscribers, s)
+			close(s.ch)
+		}
+	}
+
+	close(b.wake)
+	b.wake = make(chan struct{})
+}
+
+func (s *eventSubscriber) wants(typ string) bool {
+	return len(s.types) == 0 || s.types[typ]
+}
+
+func newEventSubscriber(types []string) *eventSubscriber {
+	s := &eventSubscriber{types: make(map[string]bool), ch: make(chan *nodeEvent, eventBufferSize)}
+	for _, t := range types {
+		s.types[t] = true
+	}
+	return s
+}
+
+// subscribe returns a channel of the events of the given types, or of
+// all types if none are given, starting after the event with ID after, or
+// with the next event if after is 0. The channel is closed when cancel is
+// called or the subscriber falls behind.
+func (b *eventBus) subscribe(types []string, after uint64) (<-chan *nodeEvent, func()) {
+	s := newEventSubscriber(types)
+
+	b.Lock()
+	if after > 0 {
+		for _, e := range b.recent {
+			if e.ID > after && s.wants(e.Type) && len(s.ch) < eventBufferSize {
+				s.ch <- e
+			}
+		}
+	}
+	b.subscribers[s] = true
+	b.Unlock()
+
+	cancel := func() {
+		b.Lock()
+		defer b.Unlock()
+		if b.subscribers[s] {
+			delete(b.subscribers, s)
+			close(s.ch)
+		}
+	}
+	return s.ch, cancel
+}
+
+// poll returns the recent events after p.After, waiting up to wait for
+// one if there are none.
+func (b *eventBus) poll(p *eventPollParams, wait time.Duration) *eventPollResult {
+	s := newEventSubscriber(p.Types)
+	deadline := time.Now().Add(wait)
+
+	for {
+		b.Lock()
+		res := &eventPollResult{Events: make([]*nodeEvent, 0), Last: b.last}
+		if !p.Latest {
+			for _, e := range b.recent {
+				if e.ID > p.After && s.wants(e.Type) {
+					res.Events = append(res.Events, e)
+				}
+			}
+		}
+		wake := b.wake
+		b.Unlock()
+
+		remaining := time.Until(deadline)
+		if len(res.Events) > 0 || p.Latest || remaining <= 0 {
+			return res
+		}
+		select {
+		case <-wake:
+		case <-time.After(remaining):
+		}
+	}
+}
+
+// seenBlock records hash and reports whether it was seen before. The
+// caller must hold the lock.
+func (b *eventBus) seenBlock(hash string) bool {
+	if b.seen[hash] {
+		return true
+	}
+	if len(b.seenOrder) == seenBlocksSize {
+		delete(b.seen, b.seenOrder[0])
+		b.seenOrder = b.seenOrder[1:]
+	}
+	b.seen[hash] = true
+	b.seenOrder = append(b.seenOrder, hash)
+	return false
+}
+
+// inbound publishes the first receipt of each block.
+func (b *eventBus) inbound(msg *spec.NetworkMessage, next gossipHandler) {
+	b.Lock()
+	seen := b.seenBlock(msg.Hash)
+	b.Unlock()
+	if !seen {
+		b.publish(eventBlockReceived, &blockEvent{Hash: msg.Hash, Peer: msg.From, Protocol: protocolName(msg)})
+	}
+
+	next(msg)
+}
+
+// outbound publishes blocks broadcast by the node that it did not receive
+// first, i.e. the blocks it produced.
+func (b *eventBus) outbound(msg *spec.NetworkMessage, next gossipHandler) {
+	b.Lock()
+	seen := b.seenBlock(msg.Hash)
+	b.Unlock()
+	if !seen {
+		b.publish(eventBlockProduced, &blockEvent{Hash: msg.Hash, Protocol: protocolName(msg)})
+	}
+
+	next(msg)
+}
@@ -0,0 +1,280 @@
+// Copyright © 2018 J. Strobus White.
+// This file is part of the blocktop blockchain development kit.
+//
+// Blocktop is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// Blocktop is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with blocktop. If not, see <http://www.gnu.org/licenses/>.
+
+package cmd
+
+import (
+	"encoding/json"
+	"fmt"
+	"math/rand"
+	"sync"
+	"time"
+
+	spec "github.com/blocktop/go-spec"
+
+	"github.com/spf13/cast"
+	"github.com/spf13/viper"
+)
+
+// faultDuration is a time.Duration that is written as a string such as
+// "250ms" in JSON.
+type faultDuration time.Duration
+
+func (d faultDuration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(time.Duration(d).String())
+}
+
+func (d *faultDuration) UnmarshalJSON(b []byte) error {
+	var s string
+	if err := json.Unmarshal(b, &s); err != nil {
+		return err
+	}
+	v, err := time.ParseDuration(s)
+	*d = faultDuration(v)
+	return err
+}
+
+// faultConfig describes the faults injected into received block messages.
+// Percentages are 0 to 100. Partition splits the network into groups of
+// peer IDs: while it lasts, the node only accepts messages from peers in
+// its own group. A zero PartitionFor keeps the partition until cleared.
+type faultConfig struct {
+	Drop         float64       `json:"drop"`
+	Duplicate    float64       `json:"duplicate"`
+	Reorder      float64       `json:"reorder"`
+	Latency      faultDuration `json:"latency"`
+	Jitter       faultDuration `json:"jitter"`
+	Partition    [][]string    `json:"partition,omitempty"`
+	PartitionFor faultDuration `json:"partitionFor,omitempty"`
+}
+
+func (c *faultConfig) validate() error {
+	for _, p := range []float64{c.Drop, c.Duplicate, c.Reorder} {
+		if p < 0 || p > 100 {
+			return fmt.Errorf("fault percentage %v out of range 0-100", p)
+		}
+	}
+	if c.Latency < 0 || c.Jitter < 0 || c.PartitionFor < 0 {
+		return fmt.Errorf("fault durations must not be negative")
+	}
+	return nil
+}
+
+type faultStats struct {
+	Dropped     int64 `json:"dropped"`
+	Partitioned int64 `json:"partitioned"`
+	Duplicated  int64 `json:"duplicated"`
+	Reordered   int64 `json:"reordered"`
+	Delayed     int64 `json:"delayed"`
+}
+
+type faultStatus struct {
+	Config         faultConfig `json:"config"`
+	PartitionUntil *time.Time  `json:"partitionUntil,omitempty"`
+	Stats          faultStats  `json:"stats"`
+}
+
+// faultInjector is a gossip middleware that drops, delays, duplicates and
+// reorders received block messages and partitions the node from groups of
+// peers, so that fork scenarios can be reproduced locally. It is configured
+// from the faults section of the config and through the control methods
+// faults.get, faults.set and faults.clear.
+type faultInjector struct {
+	sync.Mutex
+	self           string
+	cfg            faultConfig
+	group          map[string]bool
+	partitionUntil time.Time
+	stats          faultStats
+	rng            *rand.Rand
+}
+
+func init() {
+	viper.SetDefault("faults.drop", 0)
+	viper.SetDefault("faults.duplicate", 0)
+	viper.SetDefault("faults.reorder", 0)
+	viper.SetDefault("faults.latency", time.Duration(0))
+	viper.SetDefault("faults.jitter", time.Duration(0))
+	viper.SetDefault("faults.partitionFor", time.Duration(0))
+}
+
+func buildFaultInjector(self string) (*faultInjector, error) {
+	f := &faultInjector{self: self, rng: rand.New(rand.NewSource(time.Now().UnixNano()))}
+
+	cfg := faultConfig{
+		Drop:         viper.GetFloat64("faults.drop"),
+		Duplicate:    viper.GetFloat64("faults.duplicate"),
+		Reorder:      viper.GetFloat64("faults.reorder"),
+		Latency:      faultDuration(viper.GetDuration("faults.latency")),
+		Jitter:       faultDuration(viper.GetDuration("faults.jitter")),
+		PartitionFor: faultDuration(viper.GetDuration("faults.partitionFor"))}
+	for _, g := range cast.ToSlice(viper.Get("faults.partition")) {
+		cfg.Partition = append(cfg.Partition, cast.ToStringSlice(g))
+	}
+	if err := f.configure(cfg); err != nil {
+		return nil, err
+	}
+
+	f.registerControlMethods()
+
+	return f, nil
+}
+
+func (f *faultInjector) configure(cfg faultConfig) error {
+	if err := cfg.validate(); err != nil {
+		return err
+	}
+
+	f.Lock()
+	defer f.Unlock()
+
+	f.cfg = cfg
+	f.group = nil
+	f.partitionUntil = time.Time{}
+	for _, g := range cfg.Partition {
+		for _, id := range g {
+			if id != f.self {
+				continue
+			}
+			f.group = make(map[string]bool)
+			for _, id := range g {
+				f.group[id] = true
+			}
+		}
+	}
+	if f.group != nil && cfg.PartitionFor > 0 {
+		f.partitionUntil = time.Now().Add(time.Duration(cfg.PartitionFor))
+	}
+	if f.active() {
+		p2pLog.WithField("faults", cfg).Warn("Fault injection enabled")
+	}
+
+	return nil
+}
+
+// active reports whether any fault is configured. The caller must hold
+// the lock.
+func (f *faultInjector) active() bool {
+	c := f.cfg
+	return c.Drop > 0 || c.Duplicate > 0 || c.Reorder > 0 || c.Latency > 0 || c.Jitter > 0 || f.group != nil
+}
+
+func (f *faultInjector) chance(percent float64) bool {
+	return percent > 0 && f.rng.Float64()*100 < percent
+}
+
+func (f *faultInjector) inbound(msg *spec.NetworkMessage, next gossipHandler) {
+	now := time.Now()
+
+	f.Lock()
+	if f.group != nil && !f.partitionUntil.IsZero() && now.After(f.partitionUntil) {
+		p2pLog.Info("Partition healed")
+		f.group = nil
+		f.partitionUntil = time.Time{}
+	}
+	if !f.active() {
+		f.Unlock()
+		next(msg)
+		return
+	}
+
+	if f.group != nil && !f.group[msg.From] {
+		f.stats.Partitioned++
+		f.Unlock()
+		return
+	}
+	if f.chance(f.cfg.Drop) {
+		f.stats.Dropped++
+		f.Unlock()
+		return
+	}
+
+	delay := time.Duration(f.cfg.Latency)
+	if f.cfg.Jitter > 0 {
+		delay += time.Duration(f.rng.Int63n(int64(f.cfg.Jitter)))
+	}
+	if f.chance(f.cfg.Reorder) {
+		// hold the message back long enough for later messages to overtake it
+		delay += time.Duration(f.cfg.Latency+f.cfg.Jitter) + 500*time.Millisecond
+		f.stats.Reordered++
+	}
+	copies := 1
+	if f.chance(f.cfg.Duplicate) {
+		copies++
+		f.stats.Duplicated++
+	}
+	if delay > 0 {
+		f.stats.Delayed++
+	}
+	f.Unlock()
+
+	for i := 0; i < copies; i++ {
+		if delay > 0 {
+			time.AfterFunc(delay, func() { next(msg) })
+		} else {
+			next(msg)
+		}
+	}
+}
+
+func (f *faultInjector) outbound(msg *spec.NetworkMessage, next gossipHandler) {
+	next(msg)
+}
+
+func (f *faultInjector) status() faultStatus {
+	f.Lock()
+	defer f.Unlock()
+
+	s := faultStatus{Config: f.cfg, Stats: f.stats}
+	if !f.partitionUntil.IsZero() {
+		until := f.partitionUntil
+		s.PartitionUntil = &until
+	}
+	return s
+}
+
+func (f *faultInjector) registerControlMethods() {
+	registerControlMethod("faults.get", controlMethodDoc{
+		summary: "The fault injection config and statistics.",
+		result:  &faultStatus{}},
+		func(json.RawMessage) (interface{}, error) {
+			return f.status(), nil
+		})
+
+	registerControlMethod("faults.set", controlMethodDoc{
+		summary: "Replaces the fault injection config.",
+		params:  &faultConfig{},
+		result:  &faultStatus{}},
+		func(params json.RawMessage) (interface{}, error) {
+			var cfg faultConfig
+			if err := decodeControlParams(params, &cfg); err != nil {
+				return nil, err
+			}
+			if err := f.configure(cfg); err != nil {
+				return nil, newControlError(controlErrInvalidParams, err.Error())
+			}
+			return f.status(), nil
+		})
+
+	registerControlMethod("faults.clear", controlMethodDoc{
+		summary: "Stops all fault injection.",
+		result:  &faultStatus{}},
+		func(json.RawMessage) (interface{}, error) {
+			f.configure(faultConfig{})
+			p2pLog.Info("Fault injection cleared")
+			return f.status(), nil
+		})
+}
@@ -0,0 +1,73 @@
+// Copyright © 2018 J. Strobus White.
+// This file is part of the blocktop blockchain development kit.
+//
+// Blocktop is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// Blocktop is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with blocktop. If not, see <http://www.gnu.org/licenses/>.
+
+package cmd
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/spf13/cobra"
+)
+
+// faultsCmd represents the faults command
+var faultsCmd = &cobra.Command{
+	Use:   "faults",
+	Short: "Shows the faults injected into a running lucky blockchain.",
+	Long: `Usage: lucky faults [OPTIONS]
+       lucky faults [SUBCOMMAND] [OPTIONS]
+
+Fault injection drops, delays, duplicates and reorders the block messages
+a node receives, or partitions it from other peers, for testing how
+consensus recovers. Faults can also be set in the faults section of the
+config file.`,
+	Run: func(cmd *cobra.Command, args []string) {
+		var s faultStatus
+		if err := callControl("faults.get", nil, &s); err != nil {
+			failWithError(err)
+		}
+		printResult(&s, func() { printFaultStatus(&s) })
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(faultsCmd)
+}
+
+func printFaultStatus(s *faultStatus) {
+	c := s.Config
+	fmt.Printf("drop:       %v%%\n", c.Drop)
+	fmt.Printf("duplicate:  %v%%\n", c.Duplicate)
+	fmt.Printf("reorder:    %v%%\n", c.Reorder)
+	fmt.Printf("latency:    %v\n", time.Duration(c.Latency))
+	fmt.Printf("jitter:     %v\n", time.Duration(c.Jitter))
+	if len(c.Partition) == 0 {
+		fmt.Println("partition:  none")
+	} else {
+		groups := make([]string, len(c.Partition))
+		for i, g := range c.Partition {
+			groups[i] = "{" + strings.Join(g, ",") + "}"
+		}
+		fmt.Printf("partition:  %s\n", strings.Join(groups, " "))
+		if s.PartitionUntil != nil {
+			fmt.Printf("heals at:   %s\n", s.PartitionUntil.Format(time.RFC3339))
+		}
+	}
+	st := s.Stats
+	fmt.Printf("messages dropped %d, partitioned %d, duplicated %d, reordered %d, delayed %d\n",
+		st.Dropped, st.Partitioned, st.Duplicated, st.Reordered, st.Delayed)
+}
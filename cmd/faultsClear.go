@@ -0,0 +1,39 @@
+// Copyright © 2018 J. Strobus White.
+// This file is part of the blocktop blockchain development kit.
+//
+// Blocktop is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// Blocktop is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with blocktop. If not, see <http://www.gnu.org/licenses/>.
+
+package cmd
+
+import (
+	"github.com/spf13/cobra"
+)
+
+// faultsClearCmd represents the clear command
+var faultsClearCmd = &cobra.Command{
+	Use:   "clear",
+	Short: "Stops injecting faults into a running lucky blockchain.",
+	Long:  `Usage: lucky faults clear`,
+	Run: func(cmd *cobra.Command, args []string) {
+		var s faultStatus
+		if err := callControl("faults.clear", nil, &s); err != nil {
+			failWithError(err)
+		}
+		printResult(&s, func() { printFaultStatus(&s) })
+	},
+}
+
+func init() {
+	faultsCmd.AddCommand(faultsClearCmd)
+}
@@ -0,0 +1,82 @@
+// Copyright © 2018 J. Strobus White.
+// This file is part of the blocktop blockchain development kit.
+//
+// Blocktop is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// Blocktop is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with blocktop. If not, see <http://www.gnu.org/licenses/>.
+
+package cmd
+
+import (
+	"strings"
+	"time"
+
+	"github.com/spf13/cobra"
+)
+
+// faultsSetCmd represents the set command
+var faultsSetCmd = &cobra.Command{
+	Use:   "set",
+	Short: "Sets the faults injected into a running lucky blockchain.",
+	Long: `Usage: lucky faults set [OPTIONS]
+
+Replaces the current faults. For example, to drop 20% of received blocks
+and delay the rest by 100-150ms:
+
+	lucky faults set --drop 20 --latency 100ms --jitter 50ms
+
+To partition the network into two groups for a minute, run on every node:
+
+	lucky faults set --partition ID1,ID2 --partition ID3,ID4,ID5 --partitionFor 1m`,
+	Run: func(cmd *cobra.Command, args []string) {
+		cfg := faultConfig{
+			Drop:         faultsSetDrop,
+			Duplicate:    faultsSetDuplicate,
+			Reorder:      faultsSetReorder,
+			Latency:      faultDuration(faultsSetLatency),
+			Jitter:       faultDuration(faultsSetJitter),
+			PartitionFor: faultDuration(faultsSetPartitionFor)}
+		for _, g := range faultsSetPartition {
+			cfg.Partition = append(cfg.Partition, strings.Split(g, ","))
+		}
+
+		var s faultStatus
+		if err := callControl("faults.set", cfg, &s); err != nil {
+			failWithError(err)
+		}
+		printResult(&s, func() { printFaultStatus(&s) })
+	},
+}
+
+var (
+	faultsSetDrop         float64
+	faultsSetDuplicate    float64
+	faultsSetReorder      float64
+	faultsSetLatency      time.Duration
+	faultsSetJitter       time.Duration
+	faultsSetPartition    []string
+	faultsSetPartitionFor time.Duration
+)
+
+func init() {
+	faultsCmd.AddCommand(faultsSetCmd)
+
+	flags := faultsSetCmd.Flags()
+	flags.Float64Var(&faultsSetDrop, "drop", 0, "percentage of received block messages to drop")
+	flags.Float64Var(&faultsSetDuplicate, "duplicate", 0, "percentage of received block messages to duplicate")
+	flags.Float64Var(&faultsSetReorder, "reorder", 0, "percentage of received block messages to deliver out of order")
+	flags.DurationVar(&faultsSetLatency, "latency", 0, "latency added to received block messages")
+	flags.DurationVar(&faultsSetJitter, "jitter", 0, "random latency of up to this duration added on top")
+	flags.StringArrayVar(&faultsSetPartition, "partition", []string{}, `comma separated peer IDs forming one side of
+a partition, may be specified more than once`)
+	flags.DurationVar(&faultsSetPartitionFor, "partitionFor", 0, "how long the partition lasts, 0 until cleared")
+}
@@ -0,0 +1,402 @@
+// Copyright © 2018 J. Strobus White.
+// This file is part of the blocktop blockchain development kit.
+//
+// Blocktop is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// Blocktop is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with blocktop. If not, see <http://www.gnu.org/licenses/>.
+
+package cmd
+
+import (
+	"context"
+	"encoding/json"
+	"sort"
+	"sync"
+	"time"
+
+	rpcconsensus "github.com/blocktop/go-rpc-client/consensus"
+	spec "github.com/blocktop/go-spec"
+
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+)
+
+const (
+	forkBranchCreated = "branchCreated"
+	forkBranchPruned  = "branchPruned"
+	forkHeadChanged   = "headChanged"
+
+	// forkBlockConfirmed is passed to observers when a block leaves the
+	// tree on the chain of the consensus head. It is not recorded.
+	forkBlockConfirmed = "blockConfirmed"
+)
+
+// forkEvent is a change in the shape of the consensus tree. Depth is the
+// reorg depth of a head change, or the length of a pruned branch.
+type forkEvent struct {
+	Time     time.Time `json:"time"`
+	Type     string    `json:"type"`
+	Hash     string    `json:"hash"`
+	Number   uint64    `json:"blockNumber"`
+	Previous string    `json:"previous,omitempty"`
+	Parent   string    `json:"parentHash,omitempty"`
+	Depth    int       `json:"depth,omitempty"`
+}
+
+type forkHistoryParams struct {
+	Since string   `json:"since,omitempty"` // duration before now, e.g. "1h"
+	Types []string `json:"types,omitempty"`
+}
+
+// forkHistoryResult is the result of the consensus.history RPC
+// method. Since is the start of the window the events cover, which is
+// later than requested if the node has not recorded that long or events
+// were dropped.
+type forkHistoryResult struct {
+	Since  time.Time   `json:"since"`
+	Events []forkEvent `json:"events"`
+}
+
+// forkHistory records fork events. Branches are detected as the block
+// comparator sees each block, so that short-lived forks are not missed
+// between samples of the consensus tree. The samples find the head
+// changes and the blocks that left the tree: those on the chain of the
+// consensus head are confirmed, any other block leaving the tree was
+// pruned.
+type forkHistory struct {
+	sync.Mutex
+	events    []forkEvent
+	seen      map[string]*seenBlock
+	children  map[string][]string
+	headHash  string
+	sampled   time.Time
+	interval  time.Duration
+	retention time.Duration
+	maxEvents int
+	observers []func(forkEvent)
+	pending   []forkEvent
+	notifying sync.Mutex
+	headAt    time.Time
+	since     time.Time
+}
+
+// seenBlock is a block known to the fork history and when it was first
+// seen.
+type seenBlock struct {
+	*treeBlock
+	at time.Time
+}
+
+func init() {
+	viper.SetDefault("blockchain.consensus.history.interval", time.Second)
+	viper.SetDefault("blockchain.consensus.history.retention", 24*time.Hour)
+	viper.SetDefault("blockchain.consensus.history.maxEvents", 100000)
+}
+
+func buildForkHistory() *forkHistory {
+	h := &forkHistory{
+		events:    make([]forkEvent, 0),
+		seen:      make(map[string]*seenBlock),
+		children:  make(map[string][]string),
+		interval:  viper.GetDuration("blockchain.consensus.history.interval"),
+		retention: viper.GetDuration("blockchain.consensus.history.retention"),
+		maxEvents: viper.GetInt("blockchain.consensus.history.maxEvents"),
+		since:     time.Now()}
+
+	registerRPCMethod("consensus.history", controlMethodDoc{
+		summary: "The fork events of the consensus tree and the start of the window they cover.",
+		params:  &forkHistoryParams{},
+		result:  &forkHistoryResult{}},
+		func(params json.RawMessage) (interface{}, error) {
+			var p forkHistoryParams
+			if err := decodeControlParams(params, &p); err != nil {
+				return nil, err
+			}
+			since := time.Time{}
+			if p.Since != "" {
+				d, err := time.ParseDuration(p.Since)
+				if err != nil {
+					return nil, newControlError(controlErrInvalidParams, err.Error())
+				}
+				since = time.Now().Add(-d)
+			}
+			return h.query(since, p.Types), nil
+		})
+
+	return h
+}
+
+// lastHeadChange returns when the consensus head last changed, or was
+// first observed, or the zero time if there has been no head yet.
+func (h *forkHistory) lastHeadChange() time.Time {
+	h.Lock()
+	defer h.Unlock()
+	return h.headAt
+}
+
+// subscribe adds f to the functions called with each fork event. f is
+// called in the order of the events and must not block.
+func (h *forkHistory) subscribe(f func(forkEvent)) {
+	h.Lock()
+	defer h.Unlock()
+	h.observers = append(h.observers, f)
+}
+
+// comparator wraps the consensus block comparator to record a branch as
+// soon as a block with a sibling is compared.
+func (h *forkHistory) comparator(compare spec.BlockComparator) spec.BlockComparator {
+	return func(blocks []spec.Block) spec.Block {
+		now := time.Now()
+		h.Lock()
+		for _, b := range blocks {
+			h.see(&treeBlock{Hash: b.Hash(), ParentHash: b.ParentHash(), Number: b.BlockNumber()}, now, true)
+		}
+		h.Unlock()
+		h.notify()
+
+		return compare(blocks)
+	}
+}
+
+// start samples the consensus tree until ctx is done.
+func (h *forkHistory) start(ctx context.Context) {
+	go func() {
+		ticker := time.NewTicker(h.interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+
+			res, err := rpcconsensus.GetTree("json")
+			if err != nil {
+				consensusLog.WithError(err).Trace("Fork history: failed to get consensus tree")
+				continue
+			}
+			tree, err := parseConsensusTree([]byte(res.Tree))
+			if err != nil {
+				consensusLog.WithError(err).Trace("Fork history: failed to parse consensus tree")
+				continue
+			}
+			h.observe(tree, time.Now())
+		}
+	}()
+}
+
+// see adds b to the known blocks. A new block starts a branch if its
+// parent already has another child; record is false to learn the blocks
+// of the first sample without reporting their branches.
+// The caller must hold the lock.
+func (h *forkHistory) see(b *treeBlock, now time.Time, record bool) {
+	if _, ok := h.seen[b.Hash]; ok {
+		return
+	}
+	h.seen[b.Hash] = &seenBlock{treeBlock: b, at: now}
+	if record && len(h.children[b.ParentHash]) > 0 {
+		h.add(forkEvent{Time: now, Type: forkBranchCreated, Hash: b.Hash, Number: b.Number, Previous: b.ParentHash})
+	}
+	h.children[b.ParentHash] = append(h.children[b.ParentHash], b.Hash)
+}
+
+// chain returns the known blocks from hash up to the oldest known
+// ancestor, starting with the block itself. The caller must hold the lock.
+func (h *forkHistory) chain(hash string) []*seenBlock {
+	chain := make([]*seenBlock, 0)
+	for b, ok := h.seen[hash]; ok; b, ok = h.seen[b.ParentHash] {
+		chain = append(chain, b)
+		if len(chain) > len(h.seen) {
+			break
+		}
+	}
+	return chain
+}
+
+func (h *forkHistory) observe(tree *consensusTree, now time.Time) {
+	defer h.notify()
+	h.Lock()
+	defer h.Unlock()
+
+	first := h.sampled.IsZero()
+	blocks := make([]*treeBlock, 0, len(tree.blocks))
+	for _, b := range tree.blocks {
+		blocks = append(blocks, b)
+	}
+	sort.Slice(blocks, func(i, j int) bool {
+		if blocks[i].Number != blocks[j].Number {
+			return blocks[i].Number < blocks[j].Number
+		}
+		return blocks[i].Hash < blocks[j].Hash
+	})
+	for _, b := range blocks {
+		h.see(b, now, !first)
+	}
+
+	head := tree.head()
+	onChain := make(map[string]bool)
+	if head != nil {
+		for _, b := range h.chain(head.Hash) {
+			onChain[b.Hash] = true
+		}
+	}
+
+	// Known blocks that left the tree are confirmed if on the head chain.
+	// The others were pruned, and the gone blocks without children are
+	// the tips of the pruned branches. Blocks seen by the comparator
+	// since the last sample may not have been added to the tree yet.
+	gone := make([]*seenBlock, 0)
+	for hash, b := range h.seen {
+		if _, ok := tree.blocks[hash]; !ok && !b.at.After(h.sampled) {
+			gone = append(gone, b)
+		}
+	}
+	for _, b := range gone {
+		if onChain[b.Hash] {
+			// confirmations are only passed to the observers
+			h.pending = append(h.pending, forkEvent{Time: now, Type: forkBlockConfirmed, Hash: b.Hash, Number: b.Number})
+			continue
+		}
+		if len(h.children[b.Hash]) > 0 {
+			continue
+		}
+		depth := 0
+		for _, a := range h.chain(b.Hash) {
+			if _, ok := tree.blocks[a.Hash]; ok || onChain[a.Hash] {
+				break
+			}
+			depth++
+		}
+		h.add(forkEvent{Time: now, Type: forkBranchPruned, Hash: b.Hash, Number: b.Number, Depth: depth})
+	}
+
+	if head != nil && head.Hash != h.headHash {
+		if !first {
+			e := forkEvent{Time: now, Type: forkHeadChanged, Hash: head.Hash, Number: head.Number, Parent: head.ParentHash}
+			if h.headHash != "" {
+				e.Previous = h.headHash
+				e.Depth = h.reorgDepth(h.headHash, onChain)
+			}
+			h.add(e)
+		}
+		// the first head observed counts as a change, so that a node
+		// whose head never moves is still reported stale
+		h.headAt = now
+		h.headHash = head.Hash
+	}
+
+	for _, b := range gone {
+		h.forget(b)
+	}
+	h.sampled = now
+	h.expire(now)
+}
+
+// reorgDepth returns how many blocks of the old head's chain were
+// abandoned when the head moved to the chain onChain. The caller must
+// hold the lock.
+func (h *forkHistory) reorgDepth(oldHead string, onChain map[string]bool) int {
+	oldChain := h.chain(oldHead)
+	for i, b := range oldChain {
+		if onChain[b.Hash] {
+			return i
+		}
+	}
+	return len(oldChain)
+}
+
+// forget removes b from the known blocks. The caller must hold the lock.
+func (h *forkHistory) forget(b *seenBlock) {
+	delete(h.seen, b.Hash)
+	siblings := h.children[b.ParentHash]
+	for i, c := range siblings {
+		if c == b.Hash {
+			siblings = append(siblings[:i:i], siblings[i+1:]...)
+			break
+		}
+	}
+	if len(siblings) == 0 {
+		delete(h.children, b.ParentHash)
+	} else {
+		h.children[b.ParentHash] = siblings
+	}
+}
+
+// add appends an event and queues it for the observers. The caller must
+// hold the lock and call notify once it is released.
+func (h *forkHistory) add(e forkEvent) {
+	consensusLog.WithFields(logrus.Fields{logFieldBlock: e.Hash, logFieldHeight: e.Number}).Debug("Consensus " + e.Type)
+	h.events = append(h.events, e)
+	h.pending = append(h.pending, e)
+}
+
+// notify passes the queued events to the observers, which are called
+// without the lock so that they may query the history. The caller must
+// not hold the lock.
+func (h *forkHistory) notify() {
+	h.notifying.Lock()
+	defer h.notifying.Unlock()
+
+	h.Lock()
+	events, observers := h.pending, h.observers
+	h.pending = nil
+	h.Unlock()
+
+	for _, e := range events {
+		for _, f := range observers {
+			f(e)
+		}
+	}
+}
+
+// expire drops events beyond the retention time or count. The caller must
+// hold the lock.
+func (h *forkHistory) expire(now time.Time) {
+	cut := sort.Search(len(h.events), func(i int) bool {
+		return now.Sub(h.events[i].Time) <= h.retention
+	})
+	if over := len(h.events) - h.maxEvents; over > cut {
+		cut = over
+	}
+	if cut > 0 {
+		if h.events[cut-1].Time.After(h.since) {
+			h.since = h.events[cut-1].Time
+		}
+		h.events = append(h.events[:0:0], h.events[cut:]...)
+	}
+}
+
+func (h *forkHistory) query(since time.Time, types []string) *forkHistoryResult {
+	h.Lock()
+	defer h.Unlock()
+
+	want := make(map[string]bool)
+	for _, t := range types {
+		want[t] = true
+	}
+
+	res := &forkHistoryResult{Since: since, Events: make([]forkEvent, 0)}
+	if res.Since.Before(h.since) {
+		res.Since = h.since
+	}
+	if oldest := time.Now().Add(-h.retention); res.Since.Before(oldest) {
+		res.Since = oldest
+	}
+	for _, e := range h.events {
+		if e.Time.Before(since) || (len(want) > 0 && !want[e.Type]) {
+			continue
+		}
+		res.Events = append(res.Events, e)
+	}
+	return res
+}
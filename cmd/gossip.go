@@ -0,0 +1,78 @@
+// Copyright © 2018 J. Strobus White.
+// This file is part of the blocktop blockchain development kit.
+//
+// Blocktop is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// Blocktop is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with blocktop. If not, see <http://www.gnu.org/licenses/>.
+
+package cmd
+
+import (
+	p2p "github.com/blocktop/go-network-libp2p"
+	spec "github.com/blocktop/go-spec"
+)
+
+// gossipHandler passes a network message on to the next stage.
+type gossipHandler func(msg *spec.NetworkMessage)
+
+// gossipMiddleware sees every message the kernel broadcasts or receives.
+// A middleware drops a message by not calling next.
+type gossipMiddleware interface {
+	inbound(msg *spec.NetworkMessage, next gossipHandler)
+	outbound(msg *spec.NetworkMessage, next gossipHandler)
+}
+
+// gossipNode wraps the P2P node handed to the kernel so that lucky can
+// observe and shape block gossip. Middleware must be added with use before
+// the node is given to the kernel.
+type gossipNode struct {
+	*p2p.NetworkNode
+	middleware []gossipMiddleware
+}
+
+func newGossipNode(node *p2p.NetworkNode) *gossipNode {
+	return &gossipNode{NetworkNode: node}
+}
+
+func (n *gossipNode) use(m gossipMiddleware) {
+	n.middleware = append(n.middleware, m)
+}
+
+// Broadcast runs each message through the outbound middleware before
+// handing it to the P2P node.
+func (n *gossipNode) Broadcast(msgs []*spec.NetworkMessage) {
+	send := n.chain(false, func(msg *spec.NetworkMessage) {
+		n.NetworkNode.Broadcast([]*spec.NetworkMessage{msg})
+	})
+	for _, msg := range msgs {
+		send(msg)
+	}
+}
+
+// OnMessageReceived runs received messages through the inbound middleware
+// before handing them to receiver.
+func (n *gossipNode) OnMessageReceived(receiver spec.MessageReceiver) {
+	n.NetworkNode.OnMessageReceived(spec.MessageReceiver(n.chain(true, gossipHandler(receiver))))
+}
+
+func (n *gossipNode) chain(inbound bool, final gossipHandler) gossipHandler {
+	h := final
+	for i := len(n.middleware) - 1; i >= 0; i-- {
+		m, next := n.middleware[i], h
+		if inbound {
+			h = func(msg *spec.NetworkMessage) { m.inbound(msg, next) }
+		} else {
+			h = func(msg *spec.NetworkMessage) { m.outbound(msg, next) }
+		}
+	}
+	return h
+}
@@ -0,0 +1,752 @@
+// Copyright © 2018 J. Strobus White.
+// This file is part of the blocktop blockchain development kit.
+//
+// Blocktop is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// Blocktop is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with blocktop. If not, see <http://www.gnu.org/licenses/>.
+
+package cmd
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	graphql "github.com/graph-gophers/graphql-go"
+)
+
+const graphQLSchema = `
+schema {
+	query: Query
+	subscription: Subscription
+}
+
+type Query {
+	# A block of the consensus tree by hash or by number. Of several blocks
+	# with the same number, the one on the chain of the consensus head is
+	# returned.
+	block(hash: String, number: Int): Block
+	# The consensus head.
+	head: Block
+	# The last blocks of the consensus tree, highest first. With chain
+	# "head" only blocks on the chain of the consensus head. At most 100.
+	blocks(last: Int = 10, chain: String): [Block!]!
+	# The branches of the consensus tree, the one holding the head first.
+	branches: [ConsensusBranch!]!
+	peers: [Peer!]!
+	peer(id: String!): Peer
+	kernelMetrics: KernelMetrics!
+}
+
+type Subscription {
+	# The new consensus head each time it changes.
+	newHeads: Block!
+	# Node events of the given types, or all types.
+	events(types: [String!]): Event!
+}
+
+type Block {
+	hash: String!
+	parentHash: String!
+	number: Int!
+	# Whether the block is the consensus head.
+	head: Boolean!
+	onHeadChain: Boolean!
+	parent: Block
+	# The chain from this block back to the oldest block in the tree, at
+	# most 100 blocks.
+	ancestors(limit: Int = 10): [Block!]!
+	children: [Block!]!
+	# Competing blocks with the same parent.
+	siblings: [Block!]!
+	branch: ConsensusBranch!
+	# The peer that produced the block, or that the block was first
+	# received from. Null if the node did not track the block.
+	producer: Peer
+	# Whether this node produced the block.
+	local: Boolean!
+}
+
+type ConsensusBranch {
+	tip: Block!
+	# The blocks of the branch, tip first.
+	blocks: [Block!]!
+	length: Int!
+	# The block the branch forks from, null for the trunk.
+	forkPoint: Block
+	# Whether the branch holds the consensus head.
+	head: Boolean!
+}
+
+type Peer {
+	id: String!
+	addrs: [String!]!
+	origin: String
+	# Null if the peer is not connected.
+	score: Float
+	offenses: [Offense!]!
+	connected: Boolean!
+}
+
+type Offense {
+	name: String!
+	count: Int!
+}
+
+type KernelMetrics {
+	# The metrics as reported by the kernel.
+	json: String!
+	# The numeric metrics with dotted names, optionally below prefix.
+	values(prefix: String): [Metric!]!
+}
+
+type Metric {
+	name: String!
+	value: Float!
+}
+
+type Event {
+	id: ID!
+	type: String!
+	time: String!
+	# The event data as JSON.
+	data: String!
+}
+`
+
+// Limits of GraphQL queries on top of their depth. A list argument may
+// ask for at most graphQLMaxList items, and a request may resolve at most
+// graphQLMaxItems list items in all, which bounds nested lists such as the
+// children of the ancestors of the blocks of every branch.
+const (
+	graphQLMaxDepth       = 12
+	graphQLMaxList        = 100
+	graphQLMaxItems       = 5000
+	graphQLMaxQueryLength = 16 << 10
+)
+
+// newGraphQLSchema returns the GraphQL schema served by the API, resolved
+// against backend.
+func newGraphQLSchema(backend apiBackend) *graphql.Schema {
+	return graphql.MustParseSchema(graphQLSchema, &graphQLResolver{backend: backend},
+		graphql.MaxDepth(graphQLMaxDepth),
+		graphql.MaxQueryLength(graphQLMaxQueryLength),
+		graphql.MaxParallelism(10))
+}
+
+type graphQLBudgetKey struct{}
+
+// withGraphQLBudget returns a context for executing one request, counting
+// the list items it resolves against graphQLMaxItems.
+func withGraphQLBudget(ctx context.Context) context.Context {
+	return context.WithValue(ctx, graphQLBudgetKey{}, new(int64))
+}
+
+type graphQLResolver struct {
+	backend apiBackend
+}
+
+// treeView is the consensus tree a query is resolved against, so that all
+// blocks in one response come from the same tree. The origins of its
+// blocks and the peers are fetched once, when first needed.
+type treeView struct {
+	backend apiBackend
+	tree    *consensusTree
+	head    *treeBlock
+	onChain map[string]bool
+	spent   *int64
+
+	originsOnce sync.Once
+	origins     map[string]*blockOrigin
+	originsErr  error
+	peersOnce   sync.Once
+	peers       []peerStatus
+	peersErr    error
+	highestMu   sync.Mutex
+	highest     map[string]uint64
+}
+
+func (r *graphQLResolver) view(ctx context.Context) (*treeView, error) {
+	raw, err := r.backend.consensusTree()
+	if err != nil {
+		return nil, err
+	}
+	tree, err := parseConsensusTree(raw)
+	if err != nil {
+		return nil, err
+	}
+	return newTreeView(ctx, r.backend, tree), nil
+}
+
+func newTreeView(ctx context.Context, backend apiBackend, tree *consensusTree) *treeView {
+	spent, _ := ctx.Value(graphQLBudgetKey{}).(*int64)
+	if spent == nil {
+		spent = new(int64)
+	}
+	return &treeView{backend: backend, tree: tree, head: tree.head(), onChain: headChain(tree), spent: spent}
+}
+
+// spend counts n resolved list items against the budget of the request.
+func (v *treeView) spend(n int) error {
+	if atomic.AddInt64(v.spent, int64(n)) > graphQLMaxItems {
+		return fmt.Errorf("query too complex: it resolves more than %d list items", graphQLMaxItems)
+	}
+	return nil
+}
+
+// listLimit checks a list size argument.
+func listLimit(name string, n int32) error {
+	if n < 0 || n > graphQLMaxList {
+		return fmt.Errorf("%s must be between 0 and %d", name, graphQLMaxList)
+	}
+	return nil
+}
+
+// origin returns the origin of the block with hash, fetching the origins
+// of all blocks of the view on first use.
+func (v *treeView) origin(hash string) (*blockOrigin, error) {
+	v.originsOnce.Do(func() {
+		hashes := make([]string, 0, len(v.tree.blocks)+1)
+		for h := range v.tree.blocks {
+			hashes = append(hashes, h)
+		}
+		if v.head != nil && v.tree.blocks[v.head.Hash] == nil {
+			hashes = append(hashes, v.head.Hash)
+		}
+		v.origins, v.originsErr = v.backend.blockOrigins(hashes)
+	})
+	return v.origins[hash], v.originsErr
+}
+
+// peer returns the connected peer with id, or a bare peer if it is not
+// connected, fetching the peers on first use.
+func (v *treeView) peer(id string) (*peerResolver, error) {
+	v.peersOnce.Do(func() {
+		v.peers, v.peersErr = v.backend.peers()
+	})
+	if v.peersErr != nil {
+		return nil, v.peersErr
+	}
+	return peerFrom(v.peers, id), nil
+}
+
+// highestBelow returns the highest block number in the subtree of the
+// block with hash.
+func (v *treeView) highestBelow(hash string) uint64 {
+	v.highestMu.Lock()
+	defer v.highestMu.Unlock()
+	if v.highest == nil {
+		v.highest = make(map[string]uint64)
+	}
+	return v.highestBelowLocked(hash)
+}
+
+func (v *treeView) highestBelowLocked(hash string) uint64 {
+	if n, ok := v.highest[hash]; ok {
+		return n
+	}
+	n := v.tree.blocks[hash].Number
+	for _, c := range v.tree.children[hash] {
+		if cn := v.highestBelowLocked(c); cn > n {
+			n = cn
+		}
+	}
+	v.highest[hash] = n
+	return n
+}
+
+func (v *treeView) block(b *treeBlock) *blockResolver {
+	if b == nil {
+		return nil
+	}
+	return &blockResolver{v: v, b: b}
+}
+
+func (v *treeView) blocks(hashes []string) []*blockResolver {
+	res := make([]*blockResolver, 0, len(hashes))
+	for _, h := range hashes {
+		if b, ok := v.tree.blocks[h]; ok {
+			res = append(res, v.block(b))
+		}
+	}
+	sort.Slice(res, func(i, j int) bool { return res[i].b.Hash < res[j].b.Hash })
+	return res
+}
+
+func (r *graphQLResolver) Block(ctx context.Context, args struct {
+	Hash   *string
+	Number *int32
+}) (*blockResolver, error) {
+	v, err := r.view(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if args.Hash != nil {
+		return v.block(v.tree.blocks[*args.Hash]), nil
+	}
+	if args.Number == nil {
+		return nil, errors.New("hash or number is required")
+	}
+
+	var found *treeBlock
+	for _, b := range v.tree.blocks {
+		if b.Number != uint64(*args.Number) {
+			continue
+		}
+		if found == nil || v.onChain[b.Hash] && !v.onChain[found.Hash] ||
+			v.onChain[b.Hash] == v.onChain[found.Hash] && b.Hash < found.Hash {
+			found = b
+		}
+	}
+	return v.block(found), nil
+}
+
+func (r *graphQLResolver) Head(ctx context.Context) (*blockResolver, error) {
+	v, err := r.view(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return v.block(v.head), nil
+}
+
+func (r *graphQLResolver) Blocks(ctx context.Context, args struct {
+	Last  int32
+	Chain *string
+}) ([]*blockResolver, error) {
+	if err := listLimit("last", args.Last); err != nil {
+		return nil, err
+	}
+	v, err := r.view(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	blocks := make([]*treeBlock, 0, len(v.tree.blocks))
+	switch {
+	case args.Chain == nil:
+		for _, b := range v.tree.blocks {
+			blocks = append(blocks, b)
+		}
+	case *args.Chain == "head":
+		if v.head != nil {
+			blocks = v.tree.ancestors(v.head.Hash)
+		}
+	default:
+		return nil, errors.New("unknown chain: " + *args.Chain)
+	}
+	sort.Slice(blocks, func(i, j int) bool {
+		if blocks[i].Number != blocks[j].Number {
+			return blocks[i].Number > blocks[j].Number
+		}
+		return blocks[i].Hash < blocks[j].Hash
+	})
+	if int(args.Last) < len(blocks) {
+		blocks = blocks[:args.Last]
+	}
+	if err := v.spend(len(blocks)); err != nil {
+		return nil, err
+	}
+
+	res := make([]*blockResolver, 0, len(blocks))
+	for _, b := range blocks {
+		res = append(res, v.block(b))
+	}
+	return res, nil
+}
+
+func (r *graphQLResolver) Branches(ctx context.Context) ([]*branchResolver, error) {
+	v, err := r.view(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	leaves := v.tree.leaves()
+	if err := v.spend(len(leaves)); err != nil {
+		return nil, err
+	}
+	res := make([]*branchResolver, 0, len(leaves))
+	for _, leaf := range leaves {
+		res = append(res, v.branch(leaf))
+	}
+	sort.SliceStable(res, func(i, j int) bool { return res[i].Head() && !res[j].Head() })
+	return res, nil
+}
+
+func (r *graphQLResolver) Peers() ([]*peerResolver, error) {
+	peers, err := r.backend.peers()
+	if err != nil {
+		return nil, err
+	}
+	sort.Slice(peers, func(i, j int) bool { return peers[i].PeerID < peers[j].PeerID })
+
+	res := make([]*peerResolver, 0, len(peers))
+	for i := range peers {
+		res = append(res, &peerResolver{p: &peers[i], connected: true})
+	}
+	return res, nil
+}
+
+func (r *graphQLResolver) Peer(args struct{ ID string }) (*peerResolver, error) {
+	return findPeer(r.backend, args.ID)
+}
+
+// findPeer returns the connected peer with id, or a bare peer if it is
+// not connected.
+func findPeer(backend apiBackend, id string) (*peerResolver, error) {
+	peers, err := backend.peers()
+	if err != nil {
+		return nil, err
+	}
+	return peerFrom(peers, id), nil
+}
+
+// peerFrom returns the peer with id of the connected peers, or a bare
+// peer if it is not connected.
+func peerFrom(peers []peerStatus, id string) *peerResolver {
+	for i := range peers {
+		if peers[i].PeerID == id {
+			return &peerResolver{p: &peers[i], connected: true}
+		}
+	}
+	return &peerResolver{p: &peerStatus{PeerID: id}}
+}
+
+func (r *graphQLResolver) KernelMetrics() (*kernelMetricsResolver, error) {
+	raw, err := r.backend.kernelMetrics()
+	if err != nil {
+		return nil, err
+	}
+	return &kernelMetricsResolver{raw: raw}, nil
+}
+
+func (r *graphQLResolver) NewHeads(ctx context.Context) <-chan *blockResolver {
+	events, cancel := r.backend.events([]string{forkHeadChanged}, 0)
+	ch := make(chan *blockResolver)
+
+	go func() {
+		defer close(ch)
+		defer cancel()
+
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case e, ok := <-events:
+				if !ok {
+					return
+				}
+				b := r.headBlock(e)
+				if b == nil {
+					continue
+				}
+				select {
+				case ch <- b:
+				case <-ctx.Done():
+					return
+				}
+			}
+		}
+	}()
+
+	return ch
+}
+
+// headBlock resolves the block of a headChanged event, from the current
+// tree if it still holds the block.
+func (r *graphQLResolver) headBlock(e *nodeEvent) *blockResolver {
+	var fe forkEvent
+	data, _ := json.Marshal(e.Data)
+	if json.Unmarshal(data, &fe) != nil || fe.Hash == "" {
+		return nil
+	}
+
+	v, err := r.view(context.Background())
+	if err != nil {
+		v = newTreeView(context.Background(), r.backend, &consensusTree{
+			blocks:   make(map[string]*treeBlock),
+			children: make(map[string][]string)})
+	}
+	if b, ok := v.tree.blocks[fe.Hash]; ok {
+		return v.block(b)
+	}
+	b := &treeBlock{Hash: fe.Hash, ParentHash: fe.Parent, Number: fe.Number, Head: true}
+	v.onChain = map[string]bool{fe.Hash: true}
+	v.head = b
+	return v.block(b)
+}
+
+func (r *graphQLResolver) Events(ctx context.Context, args struct{ Types *[]string }) <-chan *eventResolver {
+	var types []string
+	if args.Types != nil {
+		types = *args.Types
+	}
+	events, cancel := r.backend.events(types, 0)
+	ch := make(chan *eventResolver)
+
+	go func() {
+		defer close(ch)
+		defer cancel()
+
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case e, ok := <-events:
+				if !ok {
+					return
+				}
+				select {
+				case ch <- &eventResolver{e: e}:
+				case <-ctx.Done():
+					return
+				}
+			}
+		}
+	}()
+
+	return ch
+}
+
+type blockResolver struct {
+	v *treeView
+	b *treeBlock
+}
+
+func (r *blockResolver) Hash() string       { return r.b.Hash }
+func (r *blockResolver) ParentHash() string { return r.b.ParentHash }
+func (r *blockResolver) Number() int32      { return int32(r.b.Number) }
+func (r *blockResolver) OnHeadChain() bool  { return r.v.onChain[r.b.Hash] }
+
+func (r *blockResolver) Head() bool {
+	return r.v.head != nil && r.v.head.Hash == r.b.Hash
+}
+
+func (r *blockResolver) Parent() *blockResolver {
+	return r.v.block(r.v.tree.blocks[r.b.ParentHash])
+}
+
+func (r *blockResolver) Ancestors(args struct{ Limit int32 }) ([]*blockResolver, error) {
+	if err := listLimit("limit", args.Limit); err != nil {
+		return nil, err
+	}
+	chain := r.v.tree.ancestors(r.b.Hash)
+	if len(chain) > 0 {
+		chain = chain[1:]
+	}
+	if int(args.Limit) < len(chain) {
+		chain = chain[:args.Limit]
+	}
+	if err := r.v.spend(len(chain)); err != nil {
+		return nil, err
+	}
+
+	res := make([]*blockResolver, 0, len(chain))
+	for _, b := range chain {
+		res = append(res, r.v.block(b))
+	}
+	return res, nil
+}
+
+func (r *blockResolver) Children() ([]*blockResolver, error) {
+	res := r.v.blocks(r.v.tree.children[r.b.Hash])
+	return res, r.v.spend(len(res))
+}
+
+func (r *blockResolver) Siblings() ([]*blockResolver, error) {
+	res := r.v.blocks(r.v.tree.children[r.b.ParentHash])
+	for i, s := range res {
+		if s.b.Hash == r.b.Hash {
+			res = append(res[:i], res[i+1:]...)
+			break
+		}
+	}
+	return res, r.v.spend(len(res))
+}
+
+// Branch returns the branch the block is on. A block with several
+// children is on the branch of the child on the head chain, or else of
+// the child with the highest descendant.
+func (r *blockResolver) Branch() *branchResolver {
+	tip := r.b
+	for {
+		children := r.v.tree.children[tip.Hash]
+		if len(children) == 0 {
+			break
+		}
+		var next *treeBlock
+		var nextHighest uint64
+		for _, h := range children {
+			c, highest := r.v.tree.blocks[h], r.v.highestBelow(h)
+			if next == nil || r.v.onChain[h] || !r.v.onChain[next.Hash] && highest > nextHighest {
+				next, nextHighest = c, highest
+			}
+		}
+		tip = next
+	}
+	return r.v.branch(tip)
+}
+
+func (r *blockResolver) Producer() (*peerResolver, error) {
+	o, err := r.v.origin(r.b.Hash)
+	if err != nil || o == nil || o.Peer == "" {
+		return nil, err
+	}
+	if o.Local {
+		return &peerResolver{p: &peerStatus{PeerID: o.Peer, Origin: "self"}, connected: true}, nil
+	}
+	return r.v.peer(o.Peer)
+}
+
+func (r *blockResolver) Local() (bool, error) {
+	o, err := r.v.origin(r.b.Hash)
+	return o != nil && o.Local, err
+}
+
+// branchResolver is the chain from a leaf of the tree down to the block
+// where it forks from another branch, or to the oldest block.
+type branchResolver struct {
+	v      *treeView
+	blocks []*treeBlock
+	fork   *treeBlock
+}
+
+func (v *treeView) branch(tip *treeBlock) *branchResolver {
+	br := &branchResolver{v: v}
+	for _, b := range v.tree.ancestors(tip.Hash) {
+		br.blocks = append(br.blocks, b)
+		if len(v.tree.children[b.ParentHash]) > 1 {
+			br.fork = v.tree.blocks[b.ParentHash]
+			break
+		}
+	}
+	return br
+}
+
+func (r *branchResolver) Tip() *blockResolver { return r.v.block(r.blocks[0]) }
+func (r *branchResolver) Length() int32       { return int32(len(r.blocks)) }
+
+func (r *branchResolver) Blocks() ([]*blockResolver, error) {
+	if err := r.v.spend(len(r.blocks)); err != nil {
+		return nil, err
+	}
+	res := make([]*blockResolver, 0, len(r.blocks))
+	for _, b := range r.blocks {
+		res = append(res, r.v.block(b))
+	}
+	return res, nil
+}
+
+func (r *branchResolver) ForkPoint() *blockResolver {
+	return r.v.block(r.fork)
+}
+
+func (r *branchResolver) Head() bool {
+	return r.v.onChain[r.blocks[0].Hash]
+}
+
+type peerResolver struct {
+	p         *peerStatus
+	connected bool
+}
+
+func (r *peerResolver) ID() string      { return r.p.PeerID }
+func (r *peerResolver) Connected() bool { return r.connected }
+
+func (r *peerResolver) Addrs() []string {
+	if r.p.Addrs == nil {
+		return []string{}
+	}
+	return r.p.Addrs
+}
+
+func (r *peerResolver) Origin() *string {
+	if r.p.Origin == "" {
+		return nil
+	}
+	return &r.p.Origin
+}
+
+func (r *peerResolver) Score() *float64 {
+	if !r.connected {
+		return nil
+	}
+	return &r.p.Score
+}
+
+func (r *peerResolver) Offenses() []*offenseResolver {
+	res := make([]*offenseResolver, 0, len(r.p.Offenses))
+	for name, count := range r.p.Offenses {
+		res = append(res, &offenseResolver{name: name, count: int32(count)})
+	}
+	sort.Slice(res, func(i, j int) bool { return res[i].name < res[j].name })
+	return res
+}
+
+type offenseResolver struct {
+	name  string
+	count int32
+}
+
+func (r *offenseResolver) Name() string { return r.name }
+func (r *offenseResolver) Count() int32 { return r.count }
+
+type kernelMetricsResolver struct {
+	raw json.RawMessage
+}
+
+func (r *kernelMetricsResolver) JSON() string { return string(r.raw) }
+
+func (r *kernelMetricsResolver) Values(args struct{ Prefix *string }) ([]*metricResolver, error) {
+	var v interface{}
+	if err := json.Unmarshal(r.raw, &v); err != nil {
+		return nil, err
+	}
+	values := make(map[string]float64)
+	flattenMetrics("", v, values)
+
+	res := make([]*metricResolver, 0, len(values))
+	for name, value := range values {
+		if args.Prefix == nil || strings.HasPrefix(name, *args.Prefix) {
+			res = append(res, &metricResolver{name: name, value: value})
+		}
+	}
+	sort.Slice(res, func(i, j int) bool { return res[i].name < res[j].name })
+	return res, nil
+}
+
+type metricResolver struct {
+	name  string
+	value float64
+}
+
+func (r *metricResolver) Name() string   { return r.name }
+func (r *metricResolver) Value() float64 { return r.value }
+
+type eventResolver struct {
+	e *nodeEvent
+}
+
+func (r *eventResolver) ID() graphql.ID { return graphql.ID(strconv.FormatUint(r.e.ID, 10)) }
+func (r *eventResolver) Type() string   { return r.e.Type }
+func (r *eventResolver) Time() string   { return r.e.Time.Format(time.RFC3339Nano) }
+
+func (r *eventResolver) Data() string {
+	data, _ := json.Marshal(r.e.Data)
+	return string(data)
+}
@@ -0,0 +1,85 @@
+// Copyright © 2018 J. Strobus White.
+// This file is part of the blocktop blockchain development kit.
+//
+// Blocktop is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// Blocktop is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with blocktop. If not, see <http://www.gnu.org/licenses/>.
+
+package cmd
+
+import (
+	"encoding/json"
+	"fmt"
+
+	"github.com/spf13/cobra"
+)
+
+// healthCmd represents the health command
+var healthCmd = &cobra.Command{
+	Use:   "health",
+	Short: "Checks whether a running lucky blockchain is ready.",
+	Long: `Usage: lucky health [OPTIONS]
+
+Queries the /readyz endpoint of the control server, or /healthz with
+--live, prints the result of each check and exits with a non-zero status
+if the node is unhealthy, or with the exit codes of other commands if it
+cannot be reached. The control server only listens on localhost; start
+the node with --healthAddr to serve the same endpoints to Kubernetes
+probes or systemd watchdogs on their own listener.`,
+	Run: func(cmd *cobra.Command, args []string) {
+		endpoint := "/readyz"
+		if healthLive {
+			endpoint = "/healthz"
+		}
+
+		var report healthReport
+		err := retryRPC("control", controlAddr(), func() error {
+			res, err := rpcHTTPClient().Get("http://" + controlAddr() + endpoint)
+			if err != nil {
+				return err
+			}
+			defer res.Body.Close()
+			return json.NewDecoder(res.Body).Decode(&report)
+		})
+		if err != nil {
+			failWithError(err)
+		}
+
+		printResult(&report, func() {
+			for _, c := range report.Checks {
+				status := healthOK
+				if !c.OK {
+					status = healthFail
+				}
+				fmt.Printf("%-8s %-4s %s\n", c.Name, status, c.Detail)
+			}
+			fmt.Println("status:", report.Status)
+		})
+
+		if report.Status != healthOK {
+			exit(1)
+		}
+	},
+}
+
+var (
+	healthLive   bool
+	healthInJson bool
+)
+
+func init() {
+	rootCmd.AddCommand(healthCmd)
+
+	healthCmd.Flags().BoolVar(&healthLive, "live", false, "check liveness only")
+	healthCmd.Flags().BoolVarP(&healthInJson, "json", "j", false, "output in json")
+	deprecateJSONFlag(healthCmd.Flags())
+}
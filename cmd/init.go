@@ -35,40 +35,23 @@ import (
 var initCmd = &cobra.Command{
 	Use:   "init",
 	Short: "Creates the configuration file required by lucky.",
-	Long: `Usage: lucky init [OPTIONS]`,
+	Long: `Usage: lucky init [OPTIONS]
+
+Generates the identity of a node and writes it to a new config file. With
+--output json or yaml the result is printed as an initResult document:
+configFile, peerID, publicKey and addresses.`,
 	Run: func(cmd *cobra.Command, args []string) {
 		if cfgFile != "" && fileExists(cfgFile) {
-			fmt.Println("Config file already exists:", cfgFile)
-			os.Exit(1)
-		}
-
-		r := rand.Reader
-		priv, pub, err := crypto.GenerateKeyPairWithReader(crypto.RSA, 2048, r)
-		if err != nil {
-			failWithError(err)
-		}
-		privKeyBytes, err := crypto.MarshalPrivateKey(priv)
-		if err != nil {
-			failWithError(err)
+			failWithError(fmt.Errorf("config file already exists: %s", cfgFile))
 		}
-		privKeyStr := crypto.ConfigEncodeKey(privKeyBytes)
-		viper.Set("node.privateKey", privKeyStr)
 
-		pubKeyBytes, err := crypto.MarshalPublicKey(pub)
-		if err != nil {
-			failWithError(err)
-		}
-		pubKeyStr := crypto.ConfigEncodeKey(pubKeyBytes)
+		id, err := generateIdentity()
 		if err != nil {
 			failWithError(err)
 		}
-		viper.Set("node.publicKey", pubKeyStr)
-
-		peerID, err := peer.IDFromPublicKey(pub)
-		if err != nil {
-			failWithError(err)
-		}
-		viper.Set("node.peerID", peerID.Pretty())
+		viper.Set("node.privateKey", id.PrivateKey)
+		viper.Set("node.publicKey", id.PublicKey)
+		viper.Set("node.peerID", id.PeerID)
 
 		port := viper.GetInt("node.port")
 		if port != 29190 {
@@ -88,9 +71,31 @@ var initCmd = &cobra.Command{
 		if err != nil {
 			failWithError(err)
 		}
+
+		res := &initResult{
+			ConfigFile: cfgFile,
+			PeerID:     id.PeerID,
+			PublicKey:  id.PublicKey,
+			Addresses:  viper.GetStringSlice("node.addresses")}
+		printResult(res, func() {
+			fmt.Println("Created config file", res.ConfigFile)
+			fmt.Println("peer ID:   ", res.PeerID)
+			for _, a := range res.Addresses {
+				fmt.Println("listen on: ", a)
+			}
+		})
 	},
 }
 
+// initResult is the output of lucky init. The private key is only written
+// to the config file.
+type initResult struct {
+	ConfigFile string   `json:"configFile"`
+	PeerID     string   `json:"peerID"`
+	PublicKey  string   `json:"publicKey"`
+	Addresses  []string `json:"addresses"`
+}
+
 func init() {
 	rootCmd.AddCommand(initCmd)
 
@@ -108,10 +113,90 @@ func init() {
 	// initCmd.Flags().BoolP("toggle", "t", false, "Help message for toggle")
 }
 
+// nodeIdentity is the key pair and peer ID of a node, encoded as stored in
+// the config file.
+type nodeIdentity struct {
+	PrivateKey string
+	PublicKey  string
+	PeerID     string
+}
+
+func generateIdentity() (*nodeIdentity, error) {
+	r := rand.Reader
+	priv, pub, err := crypto.GenerateKeyPairWithReader(crypto.RSA, 2048, r)
+	if err != nil {
+		return nil, err
+	}
+	privKeyBytes, err := crypto.MarshalPrivateKey(priv)
+	if err != nil {
+		return nil, err
+	}
+	pubKeyBytes, err := crypto.MarshalPublicKey(pub)
+	if err != nil {
+		return nil, err
+	}
+	peerID, err := peer.IDFromPublicKey(pub)
+	if err != nil {
+		return nil, err
+	}
+
+	return &nodeIdentity{
+		PrivateKey: crypto.ConfigEncodeKey(privKeyBytes),
+		PublicKey:  crypto.ConfigEncodeKey(pubKeyBytes),
+		PeerID:     peerID.Pretty()}, nil
+}
+
+var exitHooks []func()
+
+// onExit adds f to the functions run by exit, such as flushing a CPU
+// profile. Hooks run in reverse order.
+func onExit(f func()) {
+	exitHooks = append(exitHooks, f)
+}
+
+// exit runs the exit hooks and exits with code.
+func exit(code int) {
+	for i := len(exitHooks) - 1; i >= 0; i-- {
+		exitHooks[i]()
+	}
+	os.Exit(code)
+}
+
 func failWithError(err error) {
+	code := 1
+	var hint string
+	cause := err
+	switch e := err.(type) {
+	case *rpcError:
+		code, hint, cause = e.exitCode(), e.hint(), e.err
+	case *controlError:
+		hint = e.hint()
+	}
+	var detail string
+	var data *controlErrorData
+	if cerr, ok := cause.(*controlError); ok && cerr.Data != nil {
+		detail, data = cerr.Data.Detail, cerr.Data
+	}
+
+	if structuredOutput() {
+		e := &outputError{Error: err.Error(), Code: code, Detail: detail, Hint: hint}
+		if data != nil {
+			e.Data = data
+		}
+		writeDocument(os.Stdout, e)
+		exit(code)
+	}
+
 	fmt.Println("An error occurred executing the command:")
 	fmt.Println(err)
-	os.Exit(1)
+	if detail != "" {
+		fmt.Println(detail)
+	}
+	if hint != "" {
+		fmt.Println()
+		fmt.Println(hint)
+	}
+	exit(code)
 }
 
 func fileExists(filePath string) bool {
@@ -0,0 +1,192 @@
+// Copyright © 2018 J. Strobus White.
+// This file is part of the blocktop blockchain development kit.
+//
+// Blocktop is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// Blocktop is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with blocktop. If not, see <http://www.gnu.org/licenses/>.
+
+package cmd
+
+import (
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	glogcobra "github.com/blocktop/go-glog-cobra"
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/pflag"
+	"github.com/spf13/viper"
+	lumberjack "gopkg.in/natefinch/lumberjack.v2"
+)
+
+// Subsystems lucky logs for. The blocktop libraries log through glog,
+// which keeps its own -v level and format. It logs to stderr with text
+// logs, and to glog files with JSON logs or a log file; see redirectGlog.
+const (
+	logKernel    = "kernel"
+	logConsensus = "consensus"
+	logP2P       = "p2p"
+	logRPC       = "rpc"
+	logStore     = "store"
+	logDiag      = "diag"
+)
+
+// Log fields shared across subsystems.
+const (
+	logFieldPeer   = "peer"
+	logFieldBlock  = "block"
+	logFieldHeight = "height"
+)
+
+var subsystemLoggers = make(map[string]*logrus.Logger)
+
+var (
+	kernelLog    = newSubsystemLog(logKernel)
+	consensusLog = newSubsystemLog(logConsensus)
+	p2pLog       = newSubsystemLog(logP2P)
+	rpcLog       = newSubsystemLog(logRPC)
+	storeLog     = newSubsystemLog(logStore)
+	diagLog      = newSubsystemLog(logDiag)
+)
+
+// newSubsystemLog returns the log entry for subsystem. Each subsystem has
+// its own logger so that its level can be set separately.
+func newSubsystemLog(subsystem string) *logrus.Entry {
+	l := logrus.New()
+	subsystemLoggers[subsystem] = l
+	return l.WithField("subsystem", subsystem)
+}
+
+func init() {
+	flags := rootCmd.PersistentFlags()
+	flags.String("logFormat", "text", `log format of lucky: text or json. With json the
+blocktop libraries write glog files to --log_dir`)
+	flags.String("logLevel", "info", `log level, optionally per subsystem, e.g.
+info,p2p=debug,consensus=warn. Subsystems are kernel,
+consensus, p2p, rpc, store and diag`)
+	flags.String("logFile", "", `write logs to this file, rotated by size and age. The
+blocktop libraries write glog files next to it`)
+
+	viper.BindPFlag("log.format", flags.Lookup("logFormat"))
+	viper.BindPFlag("log.level", flags.Lookup("logLevel"))
+	viper.BindPFlag("log.file", flags.Lookup("logFile"))
+
+	viper.SetDefault("log.format", "text")
+	viper.SetDefault("log.level", "info")
+	viper.SetDefault("log.file", "")
+	viper.SetDefault("log.maxSize", 100) // megabytes
+	viper.SetDefault("log.maxAge", 7)    // days
+	viper.SetDefault("log.maxBackups", 5)
+	viper.SetDefault("log.compress", false)
+}
+
+// configureLogging applies the log settings to the subsystem loggers.
+func configureLogging() {
+	var formatter logrus.Formatter
+	switch format := viper.GetString("log.format"); format {
+	case "text":
+		formatter = &logrus.TextFormatter{FullTimestamp: true}
+	case "json":
+		formatter = &logrus.JSONFormatter{}
+	default:
+		failWithError(errors.New("unknown log format: " + format))
+	}
+
+	var out io.Writer = os.Stderr
+	if file := viper.GetString("log.file"); file != "" {
+		out = &lumberjack.Logger{
+			Filename:   file,
+			MaxSize:    viper.GetInt("log.maxSize"),
+			MaxAge:     viper.GetInt("log.maxAge"),
+			MaxBackups: viper.GetInt("log.maxBackups"),
+			Compress:   viper.GetBool("log.compress")}
+	}
+
+	def, levels, err := parseLogLevels(viper.GetString("log.level"))
+	if err != nil {
+		failWithError(err)
+	}
+
+	for subsystem, l := range subsystemLoggers {
+		l.SetFormatter(formatter)
+		l.SetOutput(out)
+		if level, ok := levels[subsystem]; ok {
+			l.SetLevel(level)
+		} else {
+			l.SetLevel(def)
+		}
+	}
+}
+
+// glog flags that redirectGlog sets.
+const (
+	glogLogDir          = "log_dir"
+	glogStderrThreshold = "stderrthreshold"
+)
+
+// redirectGlog keeps the glog output of the blocktop libraries off stderr
+// by writing it only to glog files, which go to the directory of the log
+// file if there is one and to the temp directory otherwise. glog flags
+// given on the command line take precedence.
+func redirectGlog(flags *pflag.FlagSet) {
+	if b, _ := flags.GetBool(glogcobra.LogToStdErr); b {
+		return
+	}
+	if !flags.Changed(glogLogDir) {
+		if file := viper.GetString("log.file"); file != "" {
+			dir := filepath.Dir(file)
+			if err := os.MkdirAll(dir, 0755); err != nil {
+				failWithError(err)
+			}
+			flags.Set(glogLogDir, dir)
+		}
+	}
+	if !flags.Changed(glogStderrThreshold) {
+		flags.Set(glogStderrThreshold, "FATAL")
+	}
+}
+
+// parseLogLevels parses a comma separated list of levels. An entry without
+// a subsystem sets the default level.
+func parseLogLevels(s string) (logrus.Level, map[string]logrus.Level, error) {
+	def := logrus.InfoLevel
+	levels := make(map[string]logrus.Level)
+
+	for _, entry := range strings.Split(s, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+
+		subsystem, name := "", entry
+		if i := strings.Index(entry, "="); i >= 0 {
+			subsystem, name = strings.TrimSpace(entry[:i]), strings.TrimSpace(entry[i+1:])
+		}
+		level, err := logrus.ParseLevel(name)
+		if err != nil {
+			return def, nil, err
+		}
+
+		if subsystem == "" {
+			def = level
+			continue
+		}
+		if _, ok := subsystemLoggers[subsystem]; !ok {
+			return def, nil, errors.New("unknown log subsystem: " + subsystem)
+		}
+		levels[subsystem] = level
+	}
+
+	return def, levels, nil
+}
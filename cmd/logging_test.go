@@ -0,0 +1,64 @@
+// Copyright © 2018 J. Strobus White.
+// This file is part of the blocktop blockchain development kit.
+//
+// Blocktop is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// Blocktop is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with blocktop. If not, see <http://www.gnu.org/licenses/>.
+
+package cmd
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/sirupsen/logrus"
+)
+
+func TestParseLogLevels(t *testing.T) {
+	tests := []struct {
+		in     string
+		def    logrus.Level
+		levels map[string]logrus.Level
+		err    bool
+	}{
+		{"", logrus.InfoLevel, map[string]logrus.Level{}, false},
+		{"debug", logrus.DebugLevel, map[string]logrus.Level{}, false},
+		{"warn,p2p=debug", logrus.WarnLevel, map[string]logrus.Level{logP2P: logrus.DebugLevel}, false},
+		{" p2p = trace , consensus=error ,", logrus.InfoLevel,
+			map[string]logrus.Level{logP2P: logrus.TraceLevel, logConsensus: logrus.ErrorLevel}, false},
+		{"info,error", logrus.ErrorLevel, map[string]logrus.Level{}, false},
+		{"loud", 0, nil, true},
+		{"p2p=loud", 0, nil, true},
+		{"mempool=debug", 0, nil, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.in, func(t *testing.T) {
+			def, levels, err := parseLogLevels(tt.in)
+			if tt.err {
+				if err == nil {
+					t.Errorf("no error, levels %v %v", def, levels)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if def != tt.def {
+				t.Errorf("default = %v, want %v", def, tt.def)
+			}
+			if !reflect.DeepEqual(levels, tt.levels) {
+				t.Errorf("levels = %v, want %v", levels, tt.levels)
+			}
+		})
+	}
+}
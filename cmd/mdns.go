@@ -0,0 +1,98 @@
+// Copyright © 2018 J. Strobus White.
+// This file is part of the blocktop blockchain development kit.
+//
+// Blocktop is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// Blocktop is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with blocktop. If not, see <http://www.gnu.org/licenses/>.
+
+package cmd
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	p2p "github.com/blocktop/go-network-libp2p"
+
+	inet "github.com/libp2p/go-libp2p-net"
+	pstore "github.com/libp2p/go-libp2p-peerstore"
+	"github.com/libp2p/go-libp2p/p2p/discovery"
+	"github.com/spf13/viper"
+)
+
+const (
+	discoveryNone = "none"
+	discoveryDHT  = "dht"
+	discoveryMDNS = "mdns"
+	discoveryBoth = "both"
+)
+
+// configureDiscovery validates node.discovery.mode and translates it into
+// the settings of the P2P node's own DHT discovery. Without a mode, the
+// legacy node.discovery.disable decides: it disables discovery, otherwise
+// both mDNS and DHT discovery run. It returns whether mDNS discovery
+// should run.
+func configureDiscovery() (bool, error) {
+	mode := viper.GetString("node.discovery.mode")
+	if mode == "" {
+		return !viper.GetBool("node.discovery.disable"), nil
+	}
+
+	switch mode {
+	case discoveryNone, discoveryDHT, discoveryMDNS, discoveryBoth:
+	default:
+		return false, fmt.Errorf("invalid discovery mode %q, must be one of mdns, dht, both or none", mode)
+	}
+
+	viper.Set("node.discovery.disable", mode != discoveryDHT && mode != discoveryBoth)
+
+	return mode == discoveryMDNS || mode == discoveryBoth, nil
+}
+
+// mdnsNotifee connects to peers announced over mDNS on the local network.
+type mdnsNotifee struct {
+	ctx  context.Context
+	node *p2p.NetworkNode
+}
+
+func (n *mdnsNotifee) HandlePeerFound(pi pstore.PeerInfo) {
+	if pi.ID == n.node.Host.ID() || n.node.Host.Network().Connectedness(pi.ID) == inet.Connected {
+		return
+	}
+
+	p2pLog.WithField(logFieldPeer, pi.ID.Pretty()).Debug("Discovered peer via mDNS")
+	setPeerOrigin(pi.ID.Pretty(), "mdns")
+	ctx, cancel := context.WithTimeout(n.ctx, 10*time.Second)
+	defer cancel()
+	if err := n.node.Host.Connect(ctx, pi); err != nil {
+		p2pLog.WithField(logFieldPeer, pi.ID.Pretty()).WithError(err).Debug("Failed to connect to mDNS peer")
+	}
+}
+
+// startMdnsDiscovery announces the node on the local network and connects
+// to other lucky nodes found there until ctx is done.
+func startMdnsDiscovery(ctx context.Context, node *p2p.NetworkNode) {
+	interval := time.Duration(viper.GetInt("node.discovery.interval")) * time.Second
+	tag := "_" + viper.GetString("blockchain.name") + "._tcp"
+
+	svc, err := discovery.NewMdnsService(ctx, node.Host, interval, tag)
+	if err != nil {
+		p2pLog.WithError(err).Error("Failed to start mDNS discovery")
+		return
+	}
+	svc.RegisterNotifee(&mdnsNotifee{ctx, node})
+
+	go func() {
+		<-ctx.Done()
+		svc.Close()
+	}()
+}
@@ -17,6 +17,7 @@
 package cmd
 
 import (
+	"encoding/json"
 	"fmt"
 
 	"github.com/spf13/cobra"
@@ -29,29 +30,59 @@ var metricsCmd = &cobra.Command{
 	Long: `Usage: lucky metrics [OPTIONS]  (all metrics)
 			 lucky metrics [SUBCOMMAND] [OPTIONS]  (specific metrics)
 			 
-Metrics can either be output in plain text or JSON format by using
-the --format option. The default is plain text.`,
+Without a subcommand, prints the kernel and consensus metrics. They are
+output in plain text, or with --output json or yaml as one document:
+
+  kernel:     the kernel metrics, as output by lucky metrics kernel
+  consensus:  the consensus metrics, as output by lucky metrics consensus
+
+The help of each subcommand describes its document.`,
 	Run: func(cmd *cobra.Command, args []string) {
-		for _, c := range cmd.Commands() {
-			_, err := c.ExecuteC()
-			if err != nil {
-				fmt.Println(err)
-				return
-			}
+		kernel, err := fetchKernelMetrics(getMetricsFormat())
+		if err != nil {
+			failWithError(err)
+		}
+		consensus, err := fetchConsensusMetrics(getMetricsFormat())
+		if err != nil {
+			failWithError(err)
+		}
+
+		if !structuredOutput() {
+			fmt.Println(kernel)
+			fmt.Println(consensus)
+			return
 		}
+		doc := &metricsDocument{}
+		if doc.Kernel, err = metricsObject(kernel); err != nil {
+			failWithError(err)
+		}
+		if doc.Consensus, err = metricsObject(consensus); err != nil {
+			failWithError(err)
+		}
+		printResult(doc, nil)
 	},
 }
 
+// metricsDocument is the output of lucky metrics with --output json or
+// yaml.
+type metricsDocument struct {
+	Kernel    json.RawMessage `json:"kernel"`
+	Consensus json.RawMessage `json:"consensus"`
+}
+
 var metricsInJson bool
 
 func init() {
 	rootCmd.AddCommand(metricsCmd)
 
 	metricsCmd.PersistentFlags().BoolVarP(&metricsInJson, "json", "j", false, "output in json")
+	deprecateJSONFlag(metricsCmd.PersistentFlags())
 }
 
+// getMetricsFormat returns the format to request metrics from the node
+// in.
 func getMetricsFormat() string {
-	if metricsInJson {
+	if structuredOutput() {
 		return "json"
 	}
 	return "text"
@@ -17,8 +17,6 @@
 package cmd
 
 import (
-	"fmt"
-
 	rpcconsensus "github.com/blocktop/go-rpc-client/consensus"
 	"github.com/spf13/cobra"
 )
@@ -27,40 +25,31 @@ import (
 var metricsConsensusCmd = &cobra.Command{
 	Use:   "consensus",
 	Short: "Retrieves metrics from the consensus system of the lucky blockchain.",
-	Long:  `Usage: lucky metrics consensus [OPTIONS]`,
+	Long: `Usage: lucky metrics consensus [OPTIONS]
+
+With --output json or yaml, the document is the JSON object of the
+consensus metrics as reported by go-consensus.`,
 	Run: func(cmd *cobra.Command, args []string) {
-		// https://gist.github.com/rnix/fc03d74ec128cb6a3099
-		res, err := rpcconsensus.GetMetrics(getMetricsFormat())
+		metrics, err := fetchConsensusMetrics(getMetricsFormat())
 		if err != nil {
 			failWithError(err)
 		}
-		fmt.Println(res.Metrics)
-		/*
-			req := &consensus.GetMetricsRequest{}
-			reqb, err := json.Marshal(req.GetMetrics(consensus.GetMetricsArgs{metricsFormat}))
-			if err != nil {
-				failWithError(err)
-			}
-			url := fmt.Sprintf("http://localhost:%d/rpc", viper.GetInt("rpc.port"))
-			res, err := http.Post(url, "application/json", strings.NewReader(string(reqb)))
-			if err != nil {
-				failWithError(err)
-			}
-			resS, err := ioutil.ReadAll(res.Body)
-			res.Body.Close()
-			if err != nil {
-				failWithError(err)
-			}
-			var data consensus.GetMetricsResponse
-			err = json.Unmarshal(resS, &data)
-			if err != nil {
-				failWithError(err)
-			}
-			fmt.Println(data.Result.Metrics)
-		*/
+		printMetrics(metrics)
 	},
 }
 
+// fetchConsensusMetrics returns the consensus metrics of the running node
+// in format.
+func fetchConsensusMetrics(format string) (string, error) {
+	// https://gist.github.com/rnix/fc03d74ec128cb6a3099
+	req := &rpcconsensus.GetMetricsRequest{}
+	var res rpcconsensus.GetMetricsResponse
+	if err := postNodeRPC(rpcURL(), req.GetMetrics(rpcconsensus.GetMetricsArgs{Format: format}), &res); err != nil {
+		return "", err
+	}
+	return res.Result.Metrics, nil
+}
+
 func init() {
 	metricsCmd.AddCommand(metricsConsensusCmd)
 }
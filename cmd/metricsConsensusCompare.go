@@ -0,0 +1,236 @@
+// Copyright © 2018 J. Strobus White.
+// This file is part of the blocktop blockchain development kit.
+//
+// Blocktop is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// Blocktop is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with blocktop. If not, see <http://www.gnu.org/licenses/>.
+
+package cmd
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+)
+
+// metricsConsensusCompareCmd represents the compare command
+var metricsConsensusCompareCmd = &cobra.Command{
+	Use:   "compare",
+	Short: "Compares the consensus trees of several lucky nodes.",
+	Long: `Usage: lucky metrics consensus compare --rpc HOST:PORT --rpc HOST:PORT ...
+
+Fetches the consensus tree of every node, aligns the trees by block hash
+and reports the most recent common ancestor of all consensus heads, the
+branches the nodes are on and which nodes are behind.`,
+	Run: func(cmd *cobra.Command, args []string) {
+		if len(compareAddrs) < 2 {
+			failWithError(errors.New("at least two nodes are needed, use --rpc for each"))
+		}
+
+		nodes := make([]*comparedNode, len(compareAddrs))
+		for i, a := range compareAddrs {
+			if _, _, err := net.SplitHostPort(a); err != nil {
+				a = net.JoinHostPort(a, strconv.Itoa(viper.GetInt("rpc.port")))
+			}
+			tree, err := fetchConsensusTreeFrom(a)
+			if err != nil {
+				failWithError(fmt.Errorf("%s: %v", a, err))
+			}
+			nodes[i] = &comparedNode{Addr: a, tree: tree, Head: tree.head(), Blocks: len(tree.blocks)}
+		}
+
+		cmp := compareTrees(nodes)
+		printResult(cmp, func() { printTreeComparison(cmp) })
+	},
+}
+
+var compareAddrs []string
+
+func init() {
+	metricsConsensusCmd.AddCommand(metricsConsensusCompareCmd)
+
+	metricsConsensusCompareCmd.Flags().StringArrayVar(&compareAddrs, "rpc", []string{}, `RPC address (host:port) of a node to compare,
+specify once per node`)
+}
+
+type comparedNode struct {
+	Addr   string     `json:"addr"`
+	Head   *treeBlock `json:"head"`
+	Blocks int        `json:"blocks"`
+	Branch int        `json:"branch"`
+	Behind int        `json:"behind"`
+	Status string     `json:"status"`
+	tree   *consensusTree
+}
+
+// treeBranch is the chain of blocks from a consensus head down to the
+// common ancestor, shared by the nodes with that head.
+type treeBranch struct {
+	Head   *treeBlock `json:"head"`
+	Blocks []string   `json:"blocks"`
+	Nodes  []string   `json:"nodes"`
+}
+
+type treeComparison struct {
+	Nodes          []*comparedNode `json:"nodes"`
+	CommonAncestor *treeBlock      `json:"commonAncestor"`
+	Branches       []*treeBranch   `json:"branches"`
+	Unknown        int             `json:"unknown"`
+}
+
+// statusUnknown is the status of a node that reports no consensus head, so
+// that nothing is known about which branch it is on.
+const statusUnknown = "unknown"
+
+func compareTrees(nodes []*comparedNode) *treeComparison {
+	cmp := &treeComparison{Nodes: nodes, Branches: make([]*treeBranch, 0)}
+
+	// the common ancestor is the highest block on the chain of every head;
+	// nodes without a head cannot be placed and are left out
+	var first *comparedNode
+	chains := make([]map[string]bool, len(nodes))
+	for i, n := range nodes {
+		chains[i] = make(map[string]bool)
+		if n.Head == nil {
+			continue
+		}
+		if first == nil {
+			first = n
+		}
+		for _, b := range n.tree.ancestors(n.Head.Hash) {
+			chains[i][b.Hash] = true
+		}
+	}
+	if first != nil {
+		for _, b := range first.tree.ancestors(first.Head.Hash) {
+			common := true
+			for i, c := range chains {
+				common = common && (nodes[i].Head == nil || c[b.Hash])
+			}
+			if common {
+				cmp.CommonAncestor = b
+				break
+			}
+		}
+	}
+
+	top := uint64(0)
+	byHead := make(map[string]int)
+	for _, n := range nodes {
+		if n.Head == nil {
+			n.Branch = -1
+			n.Status = statusUnknown
+			cmp.Unknown++
+			continue
+		}
+		if n.Head.Number > top {
+			top = n.Head.Number
+		}
+
+		i, ok := byHead[n.Head.Hash]
+		if !ok {
+			br := &treeBranch{Head: n.Head, Blocks: make([]string, 0)}
+			for _, b := range n.tree.ancestors(n.Head.Hash) {
+				if cmp.CommonAncestor != nil && b.Hash == cmp.CommonAncestor.Hash {
+					break
+				}
+				br.Blocks = append(br.Blocks, b.Hash)
+			}
+			i = len(cmp.Branches)
+			byHead[n.Head.Hash] = i
+			cmp.Branches = append(cmp.Branches, br)
+		}
+		cmp.Branches[i].Nodes = append(cmp.Branches[i].Nodes, n.Addr)
+		n.Branch = i
+	}
+
+	for i, n := range nodes {
+		if n.Head == nil {
+			continue
+		}
+		n.Behind = int(top - n.Head.Number)
+		switch {
+		case len(cmp.Branches) == 1 && cmp.Unknown == 0:
+			n.Status = "in consensus"
+		case n.Behind == 0:
+			n.Status = "at top height"
+		default:
+			// behind but possibly on the same branch as a node further ahead
+			n.Status = "diverged"
+			for j, o := range nodes {
+				if j != i && o.Head != nil && o.Head.Number > n.Head.Number && chains[j][n.Head.Hash] {
+					n.Status = "behind on the branch of " + o.Addr
+					break
+				}
+			}
+		}
+	}
+
+	return cmp
+}
+
+func printTreeComparison(cmp *treeComparison) {
+	fmt.Println("Nodes:")
+	for _, n := range cmp.Nodes {
+		if n.Head == nil {
+			fmt.Printf("  %-22s %s, no consensus head\n", n.Addr, n.Status)
+			continue
+		}
+		behind := ""
+		if n.Behind > 0 {
+			behind = fmt.Sprintf(", %d behind", n.Behind)
+		}
+		fmt.Printf("  %-22s head %d %s (%d blocks in tree%s) %s\n",
+			n.Addr, n.Head.Number, shortHash(n.Head.Hash), n.Blocks, behind, n.Status)
+	}
+
+	fmt.Println()
+	if cmp.CommonAncestor == nil {
+		fmt.Println("Common ancestor: none within the consensus trees")
+	} else {
+		fmt.Printf("Common ancestor: %d %s\n", cmp.CommonAncestor.Number, cmp.CommonAncestor.Hash)
+	}
+
+	switch {
+	case len(cmp.Branches) == 0:
+		fmt.Println("No node reports a consensus head.")
+		return
+	case len(cmp.Branches) == 1 && cmp.Unknown == 0:
+		fmt.Println("All nodes agree on the consensus head.")
+		return
+	case len(cmp.Branches) == 1:
+		fmt.Printf("The nodes with a consensus head agree on it, %d unknown.\n", cmp.Unknown)
+		return
+	}
+	fmt.Println("\nBranches:")
+	for i, br := range cmp.Branches {
+		short := make([]string, len(br.Blocks))
+		for j, h := range br.Blocks {
+			short[j] = shortHash(h)
+		}
+		fmt.Printf("  %c: head %d, %d blocks above ancestor, nodes %s\n",
+			'A'+i, br.Head.Number, len(br.Blocks), strings.Join(br.Nodes, ", "))
+		fmt.Printf("     %s\n", strings.Join(short, " <- "))
+	}
+}
+
+func shortHash(hash string) string {
+	if len(hash) > 12 {
+		return hash[:12]
+	}
+	return hash
+}
@@ -0,0 +1,108 @@
+// Copyright © 2018 J. Strobus White.
+// This file is part of the blocktop blockchain development kit.
+//
+// Blocktop is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// Blocktop is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with blocktop. If not, see <http://www.gnu.org/licenses/>.
+
+package cmd
+
+import (
+	"reflect"
+	"testing"
+)
+
+// testTree builds a consensus tree of blocks given as hash, parent hash
+// and number, with the consensus head head.
+func testTree(head string, blocks ...treeBlock) *consensusTree {
+	t := &consensusTree{blocks: make(map[string]*treeBlock), children: make(map[string][]string), headHash: head}
+	for i := range blocks {
+		b := blocks[i]
+		b.Head = b.Hash == head
+		t.blocks[b.Hash] = &b
+	}
+	for _, b := range t.blocks {
+		if _, ok := t.blocks[b.ParentHash]; ok {
+			t.children[b.ParentHash] = append(t.children[b.ParentHash], b.Hash)
+		}
+	}
+	return t
+}
+
+func TestCompareTrees(t *testing.T) {
+	g := treeBlock{Hash: "g", Number: 0}
+	a1 := treeBlock{Hash: "a1", ParentHash: "g", Number: 1}
+	a2 := treeBlock{Hash: "a2", ParentHash: "a1", Number: 2}
+	a3 := treeBlock{Hash: "a3", ParentHash: "a2", Number: 3}
+	b2 := treeBlock{Hash: "b2", ParentHash: "a1", Number: 2}
+
+	tests := []struct {
+		name     string
+		trees    []*consensusTree
+		ancestor string
+		branches int
+		unknown  int
+		status   []string
+		behind   []int
+	}{
+		{"agree", []*consensusTree{testTree("a3", g, a1, a2, a3), testTree("a3", g, a1, a2, a3, b2)},
+			"a3", 1, 0, []string{"in consensus", "in consensus"}, []int{0, 0}},
+		{"behind", []*consensusTree{testTree("a3", g, a1, a2, a3), testTree("a2", g, a1, a2)},
+			"a2", 2, 0, []string{"at top height", "behind on the branch of n0"}, []int{0, 1}},
+		{"fork", []*consensusTree{testTree("a3", g, a1, a2, a3, b2), testTree("b2", g, a1, a2, b2)},
+			"a1", 2, 0, []string{"at top height", "diverged"}, []int{0, 1}},
+		{"unknown", []*consensusTree{testTree("a3", g, a1, a2, a3), testTree(""), testTree("a3", a2, a3)},
+			"a3", 1, 1, []string{"at top height", statusUnknown, "at top height"}, []int{0, 0, 0}},
+		{"first unknown", []*consensusTree{testTree("", g), testTree("a3", g, a1, a2, a3), testTree("a2", g, a1, a2)},
+			"a2", 2, 1, []string{statusUnknown, "at top height", "behind on the branch of n1"}, []int{0, 0, 1}},
+		{"no heads", []*consensusTree{testTree(""), testTree("", g)},
+			"", 0, 2, []string{statusUnknown, statusUnknown}, []int{0, 0}},
+		{"no common ancestor", []*consensusTree{testTree("a3", a2, a3), testTree("b2", a1, b2)},
+			"", 2, 0, []string{"at top height", "diverged"}, []int{0, 1}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			nodes := make([]*comparedNode, len(tt.trees))
+			for i, tree := range tt.trees {
+				nodes[i] = &comparedNode{Addr: "n" + string(rune('0'+i)), tree: tree, Head: tree.head(), Blocks: len(tree.blocks)}
+			}
+
+			cmp := compareTrees(nodes)
+			ancestor := ""
+			if cmp.CommonAncestor != nil {
+				ancestor = cmp.CommonAncestor.Hash
+			}
+			if ancestor != tt.ancestor {
+				t.Errorf("common ancestor = %q, want %q", ancestor, tt.ancestor)
+			}
+			if len(cmp.Branches) != tt.branches {
+				t.Errorf("%d branches, want %d", len(cmp.Branches), tt.branches)
+			}
+			if cmp.Unknown != tt.unknown {
+				t.Errorf("%d unknown, want %d", cmp.Unknown, tt.unknown)
+			}
+
+			status := make([]string, len(nodes))
+			behind := make([]int, len(nodes))
+			for i, n := range nodes {
+				status[i], behind[i] = n.Status, n.Behind
+			}
+			if !reflect.DeepEqual(status, tt.status) {
+				t.Errorf("status = %q, want %q", status, tt.status)
+			}
+			if !reflect.DeepEqual(behind, tt.behind) {
+				t.Errorf("behind = %v, want %v", behind, tt.behind)
+			}
+		})
+	}
+}
@@ -0,0 +1,175 @@
+// Copyright © 2018 J. Strobus White.
+// This file is part of the blocktop blockchain development kit.
+//
+// Blocktop is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// Blocktop is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with blocktop. If not, see <http://www.gnu.org/licenses/>.
+
+package cmd
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/spf13/cobra"
+)
+
+// metricsConsensusForksCmd represents the forks command
+var metricsConsensusForksCmd = &cobra.Command{
+	Use:   "forks",
+	Short: "Summarizes the fork history of the lucky blockchain.",
+	Long: `Usage: lucky metrics consensus forks [OPTIONS]
+
+Reports how often the consensus tree branched, how many branches were
+pruned and how deep the reorgs were when the consensus head moved to
+another branch, over the period given by --since. Rates are computed over
+the part of the period that the node observed, which is shorter if the
+node started or its history was trimmed within the period.`,
+	Run: func(cmd *cobra.Command, args []string) {
+		var history forkHistoryResult
+		err := callNodeRPC("consensus.history", &forkHistoryParams{Since: forksSince.String()}, &history)
+		if err != nil {
+			failWithError(err)
+		}
+
+		summary := summarizeForks(history.Events, forksSince, time.Since(history.Since))
+		res := &forkReport{Events: history.Events, Summary: summary}
+		printResult(res, func() { printForkSummary(summary) })
+	},
+}
+
+var forksSince time.Duration
+
+func init() {
+	metricsConsensusCmd.AddCommand(metricsConsensusForksCmd)
+
+	metricsConsensusForksCmd.Flags().DurationVar(&forksSince, "since", time.Hour, "period to report on")
+}
+
+// forkReport is the output of lucky metrics consensus forks.
+type forkReport struct {
+	Events  []forkEvent  `json:"events"`
+	Summary *forkSummary `json:"summary"`
+}
+
+type depthStats struct {
+	Count     int         `json:"count"`
+	Mean      float64     `json:"mean"`
+	P90       int         `json:"p90"`
+	Max       int         `json:"max"`
+	Histogram map[int]int `json:"histogram"`
+}
+
+type forkSummary struct {
+	Period          string     `json:"period"`
+	Observed        string     `json:"observed"`
+	BranchesCreated int        `json:"branchesCreated"`
+	BranchesPerHour float64    `json:"branchesPerHour"`
+	HeadChanges     int        `json:"headChanges"`
+	Reorgs          depthStats `json:"reorgs"`
+	PrunedBranches  depthStats `json:"prunedBranches"`
+}
+
+// summarizeForks summarizes the events of the requested period, of which
+// the node observed the last observed.
+func summarizeForks(events []forkEvent, period, observed time.Duration) *forkSummary {
+	if observed > period {
+		observed = period
+	}
+	observed = observed.Round(time.Second)
+	s := &forkSummary{Period: period.String(), Observed: observed.String()}
+	reorgs := make([]int, 0)
+	pruned := make([]int, 0)
+
+	for _, e := range events {
+		switch e.Type {
+		case forkBranchCreated:
+			s.BranchesCreated++
+		case forkBranchPruned:
+			pruned = append(pruned, e.Depth)
+		case forkHeadChanged:
+			s.HeadChanges++
+			if e.Depth > 0 {
+				reorgs = append(reorgs, e.Depth)
+			}
+		}
+	}
+	if observed > 0 {
+		s.BranchesPerHour = float64(s.BranchesCreated) / observed.Hours()
+	}
+	s.Reorgs = newDepthStats(reorgs)
+	s.PrunedBranches = newDepthStats(pruned)
+
+	return s
+}
+
+func newDepthStats(depths []int) depthStats {
+	s := depthStats{Count: len(depths), Histogram: make(map[int]int)}
+	if len(depths) == 0 {
+		return s
+	}
+
+	sort.Ints(depths)
+	sum := 0
+	for _, d := range depths {
+		sum += d
+		s.Histogram[d]++
+	}
+	s.Mean = float64(sum) / float64(len(depths))
+	s.P90 = depths[(len(depths)*9+9)/10-1]
+	s.Max = depths[len(depths)-1]
+
+	return s
+}
+
+func printForkSummary(s *forkSummary) {
+	if s.Observed != s.Period {
+		fmt.Printf("Fork history for the last %s, observed for %s:\n", s.Period, s.Observed)
+	} else {
+		fmt.Printf("Fork history for the last %s:\n", s.Period)
+	}
+	fmt.Printf("  branches created:  %d (%.1f/hour)\n", s.BranchesCreated, s.BranchesPerHour)
+	fmt.Printf("  branches pruned:   %d, length mean %.1f, p90 %d, max %d\n",
+		s.PrunedBranches.Count, s.PrunedBranches.Mean, s.PrunedBranches.P90, s.PrunedBranches.Max)
+	fmt.Printf("  head changes:      %d, reorgs %d, depth mean %.1f, p90 %d, max %d\n",
+		s.HeadChanges, s.Reorgs.Count, s.Reorgs.Mean, s.Reorgs.P90, s.Reorgs.Max)
+
+	printHistogram("Reorg depth", s.Reorgs.Histogram)
+	printHistogram("Pruned branch length", s.PrunedBranches.Histogram)
+}
+
+func printHistogram(title string, h map[int]int) {
+	if len(h) == 0 {
+		return
+	}
+
+	keys := make([]int, 0, len(h))
+	max := 0
+	for k, n := range h {
+		keys = append(keys, k)
+		if n > max {
+			max = n
+		}
+	}
+	sort.Ints(keys)
+
+	fmt.Printf("\n%s:\n", title)
+	for _, k := range keys {
+		bar := h[k] * 40 / max
+		if bar == 0 {
+			bar = 1
+		}
+		fmt.Printf("  %4d | %s %d\n", k, strings.Repeat("#", bar), h[k])
+	}
+}
@@ -17,47 +17,42 @@
 package cmd
 
 import (
+	"encoding/json"
 	"fmt"
 
-	"github.com/spf13/cobra"
+	consensus "github.com/blocktop/go-consensus"
 	rpcconsensus "github.com/blocktop/go-rpc-client/consensus"
-
+	"github.com/spf13/cobra"
 )
 
 // metricsConsensusTreeCmd represents the tree command
 var metricsConsensusTreeCmd = &cobra.Command{
 	Use:   "tree",
 	Short: "Retrieves the current consensus-finding tree from lucky blockchain.",
-	Long:  `Usage: lucky metrics consensus tree [OPTIONS]`,
+	Long: `Usage: lucky metrics consensus tree [OPTIONS]
+
+With --output json or yaml, the document is the tree of go-consensus:
+
+  head:    hash of the consensus head
+  blocks:  list of the blocks of the tree, each with hash, parentHash
+           and blockNumber`,
 	Run: func(cmd *cobra.Command, args []string) {
-		res, err := rpcconsensus.GetTree(getMetricsFormat())
+		req := &rpcconsensus.GetTreeRequest{}
+		var res rpcconsensus.GetTreeResponse
+		err := postNodeRPC(rpcURL(), req.GetTree(rpcconsensus.GetTreeArgs{Format: getMetricsFormat()}), &res)
 		if err != nil {
 			failWithError(err)
 		}
-		fmt.Println(res.Tree)
-		/*
-			req := &consensus.GetTreeRequest{}
-			reqb, err := json.Marshal(req.GetTree(consensus.GetTreeArgs{"text"}))
-			if err != nil {
-				failWithError(err)
-			}
-			url := fmt.Sprintf("http://localhost:%d/rpc", viper.GetInt("rpc.port"))
-			res, err := http.Post(url, "application/json", strings.NewReader(string(reqb)))
-			if err != nil {
-				failWithError(err)
-			}
-			resS, err := ioutil.ReadAll(res.Body)
-			res.Body.Close()
-			if err != nil {
-				failWithError(err)
-			}
-			var data consensus.GetTreeResponse
-			err = json.Unmarshal(resS, &data)
-			if err != nil {
-				failWithError(err)
-			}
-			fmt.Println(data.Result.Tree)
-		*/
+		if !structuredOutput() {
+			fmt.Println(res.Result.Tree)
+			return
+		}
+
+		var tree consensus.Tree
+		if err := json.Unmarshal([]byte(res.Result.Tree), &tree); err != nil {
+			failWithError(fmt.Errorf("invalid consensus tree: %v", err))
+		}
+		printResult(&tree, nil)
 	},
 }
 
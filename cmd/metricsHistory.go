@@ -0,0 +1,163 @@
+// Copyright © 2018 J. Strobus White.
+// This file is part of the blocktop blockchain development kit.
+//
+// Blocktop is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// Blocktop is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with blocktop. If not, see <http://www.gnu.org/licenses/>.
+
+package cmd
+
+import (
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"os"
+	"path"
+	"strconv"
+	"time"
+
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+)
+
+// metricsHistoryCmd represents the history command
+var metricsHistoryCmd = &cobra.Command{
+	Use:   "history",
+	Short: "Queries the metrics recorded by the lucky blockchain.",
+	Long: `Usage: lucky metrics history --metric NAME [OPTIONS]
+       lucky metrics history --list
+
+Reads the kernel and consensus metrics recorded in the data directory
+when diagnostics.history.enable is set. Metric names are the flattened
+JSON metric names prefixed with kernel. or consensus., and may use
+shell patterns such as 'consensus.*'. Array elements and entries keyed
+by block hashes or peer IDs are not recorded, and the recorded metrics
+can be narrowed with the patterns of diagnostics.history.metrics and
+capped with diagnostics.history.maxMetrics. The node does not have to be
+running. Output is plain text or CSV (--format), or JSON or YAML with
+--output.`,
+	Run: func(cmd *cobra.Command, args []string) {
+		dir := metricsHistoryDir()
+		names, err := listMetricsHistory(dir)
+		if err != nil {
+			if os.IsNotExist(err) {
+				err = errors.New("no metrics history in " + dir + ", is diagnostics.history.enable set?")
+			}
+			failWithError(err)
+		}
+
+		if historyList {
+			printResult(names, func() {
+				for _, name := range names {
+					fmt.Println(name)
+				}
+			})
+			return
+		}
+
+		if len(historyMetrics) == 0 {
+			failWithError(errors.New("at least one --metric is required, see --list"))
+		}
+		// --format json is the same as --output json
+		if historyFormat == outputJSON && !structuredOutput() {
+			outputFormat = outputJSON
+		}
+		format := historyFormat
+		if structuredOutput() {
+			format = outputFormat
+		}
+
+		series := make([]metricSeries, 0)
+		// ring files may hold older points if the node was not running
+		since := time.Now().Add(-historySince)
+		if oldest := time.Now().Add(-viper.GetDuration("diagnostics.history.retention")); since.Before(oldest) {
+			since = oldest
+		}
+		for _, name := range names {
+			if !matchesAny(historyMetrics, name) {
+				continue
+			}
+			points, err := readRingFile(metricFile(dir, name), since)
+			if err != nil {
+				failWithError(err)
+			}
+			series = append(series, metricSeries{name, points})
+		}
+		if len(series) == 0 {
+			failWithError(errors.New("no recorded metric matches --metric"))
+		}
+
+		switch format {
+		case "csv":
+			writeHistoryCSV(series)
+		case outputJSON, outputYAML:
+			printResult(series, nil)
+		case "text":
+			for _, s := range series {
+				fmt.Printf("%s:\n", s.Metric)
+				for _, p := range s.Points {
+					fmt.Printf("  %s  %g\n", p.Time.Format(time.RFC3339), p.Value)
+				}
+			}
+		default:
+			failWithError(errors.New("unknown format: " + format))
+		}
+	},
+}
+
+var (
+	historyMetrics []string
+	historySince   time.Duration
+	historyFormat  string
+	historyList    bool
+)
+
+func init() {
+	metricsCmd.AddCommand(metricsHistoryCmd)
+
+	flags := metricsHistoryCmd.Flags()
+	flags.StringArrayVarP(&historyMetrics, "metric", "m", nil, "metric name or pattern, may be repeated")
+	flags.DurationVar(&historySince, "since", time.Hour, "period to report on")
+	flags.StringVar(&historyFormat, "format", "text", "output format: text, csv, or json as for --output json")
+	flags.BoolVar(&historyList, "list", false, "list the recorded metrics")
+}
+
+type metricSeries struct {
+	Metric string        `json:"metric"`
+	Points []metricPoint `json:"points"`
+}
+
+func matchesAny(patterns []string, name string) bool {
+	for _, p := range patterns {
+		if ok, _ := path.Match(p, name); ok {
+			return true
+		}
+	}
+	return false
+}
+
+func writeHistoryCSV(series []metricSeries) {
+	w := csv.NewWriter(os.Stdout)
+	w.Write([]string{"time", "metric", "value"})
+	for _, s := range series {
+		for _, p := range s.Points {
+			w.Write([]string{
+				p.Time.Format(time.RFC3339Nano),
+				s.Metric,
+				strconv.FormatFloat(p.Value, 'g', -1, 64)})
+		}
+	}
+	w.Flush()
+	if err := w.Error(); err != nil {
+		failWithError(err)
+	}
+}
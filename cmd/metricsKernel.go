@@ -15,32 +15,45 @@
 package cmd
 
 import (
-	"fmt"
+	"encoding/json"
 
 	"github.com/spf13/cobra"
-	rpckernel "github.com/blocktop/go-rpc-client/kernel"
-
 )
 
 // metricsKernelCmd represents the kernel command
 var metricsKernelCmd = &cobra.Command{
 	Use:   "kernel",
-	Short: "A brief description of your command",
-	Long: `A longer description that spans multiple lines and likely contains examples
-and usage of using your command. For example:
+	Short: "Retrieves metrics from the kernel of the lucky blockchain.",
+	Long: `Usage: lucky metrics kernel [OPTIONS]
 
-Cobra is a CLI library for Go that empowers applications.
-This application is a tool to generate the needed files
-to quickly create a Cobra application.`,
+Prints the kernel metrics with the sections lucky adds, such as the
+network usage. With --output json or yaml, the document is the JSON
+object of the kernel metrics as reported by go-kernel, with a key for
+each added section, e.g. network.`,
 	Run: func(cmd *cobra.Command, args []string) {
-		res, err := rpckernel.GetMetrics(getMetricsFormat())
+		metrics, err := fetchKernelMetrics(getMetricsFormat())
 		if err != nil {
 			failWithError(err)
 		}
-		fmt.Println(res.Metrics)
+		printMetrics(metrics)
 	},
 }
 
+// fetchKernelMetrics returns the kernel metrics of the running node in
+// format. The control server reports them with the sections lucky adds.
+func fetchKernelMetrics(format string) (string, error) {
+	var res json.RawMessage
+	if err := callControl("kernel.metrics", &metricsParams{Format: format}, &res); err != nil {
+		return "", err
+	}
+
+	var text string
+	if json.Unmarshal(res, &text) == nil {
+		return text, nil
+	}
+	return string(res), nil
+}
+
 func init() {
 	metricsCmd.AddCommand(metricsKernelCmd)
 }
@@ -0,0 +1,369 @@
+// Copyright © 2018 J. Strobus White.
+// This file is part of the blocktop blockchain development kit.
+//
+// Blocktop is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// Blocktop is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with blocktop. If not, see <http://www.gnu.org/licenses/>.
+
+package cmd
+
+import (
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"os"
+	"path"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	rpcconsensus "github.com/blocktop/go-rpc-client/consensus"
+
+	"github.com/spf13/viper"
+)
+
+// Metric history is stored as one ring buffer file per metric in the
+// metrics directory below the data directory. A ring file starts with a
+// header, written when the file is created, followed by capacity records
+// of a unix nanosecond timestamp and a float64 value, all little endian:
+//
+//	magic    [4]byte  "LKYR"
+//	capacity uint32
+//	reserved [8]byte
+//	records  [capacity]struct{ time int64; value float64 }
+//
+// Records with time 0 have not been written. The next record to write is
+// the one after the newest.
+const (
+	ringMagic      = "LKYR"
+	ringHeaderSize = 16
+	ringRecordSize = 16
+)
+
+var metricFileChars = regexp.MustCompile(`[^A-Za-z0-9._-]`)
+
+func metricsHistoryDir() string {
+	return path.Join(dataDir(), "metrics")
+}
+
+func metricFile(dir, metric string) string {
+	return path.Join(dir, metricFileChars.ReplaceAllString(metric, "_")+".ring")
+}
+
+type metricPoint struct {
+	Time  time.Time `json:"time"`
+	Value float64   `json:"value"`
+}
+
+type ringFile struct {
+	f        *os.File
+	capacity uint32
+	next     uint32
+}
+
+// openRingFile opens the ring file at file, creating it with capacity
+// records if it does not exist. A file with a different capacity, because
+// the retention or interval changed, is started over.
+func openRingFile(file string, capacity uint32) (*ringFile, error) {
+	f, err := os.OpenFile(file, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, err
+	}
+	r := &ringFile{f: f, capacity: capacity}
+
+	data, err := ioutil.ReadAll(f)
+	if err == nil {
+		var records []ringRecord
+		if records, err = parseRingFile(data); err == nil && uint32(len(records)) == capacity {
+			r.next = nextRingRecord(records)
+			return r, nil
+		}
+	}
+
+	header := make([]byte, ringHeaderSize)
+	copy(header, ringMagic)
+	binary.LittleEndian.PutUint32(header[4:], capacity)
+	if err = f.Truncate(0); err == nil {
+		err = f.Truncate(ringHeaderSize + int64(capacity)*ringRecordSize)
+	}
+	if err == nil {
+		_, err = f.WriteAt(header, 0)
+	}
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	return r, nil
+}
+
+func (r *ringFile) append(p metricPoint) error {
+	rec := make([]byte, ringRecordSize)
+	binary.LittleEndian.PutUint64(rec, uint64(p.Time.UnixNano()))
+	binary.LittleEndian.PutUint64(rec[8:], math.Float64bits(p.Value))
+	if _, err := r.f.WriteAt(rec, ringHeaderSize+int64(r.next)*ringRecordSize); err != nil {
+		return err
+	}
+	r.next = (r.next + 1) % r.capacity
+	return nil
+}
+
+// ringRecord is a record of a ring file, with time 0 if it has not been
+// written.
+type ringRecord struct {
+	time  int64
+	value float64
+}
+
+// parseRingFile returns the records of the ring file data.
+func parseRingFile(data []byte) ([]ringRecord, error) {
+	if len(data) < ringHeaderSize || string(data[:4]) != ringMagic {
+		return nil, errors.New("not a metrics history file")
+	}
+	capacity := binary.LittleEndian.Uint32(data[4:])
+	if len(data) < ringHeaderSize+int(capacity)*ringRecordSize {
+		return nil, errors.New("truncated metrics history file")
+	}
+
+	records := make([]ringRecord, capacity)
+	for i := range records {
+		rec := data[ringHeaderSize+i*ringRecordSize:]
+		records[i] = ringRecord{
+			time:  int64(binary.LittleEndian.Uint64(rec)),
+			value: math.Float64frombits(binary.LittleEndian.Uint64(rec[8:]))}
+	}
+	return records, nil
+}
+
+// nextRingRecord returns the index of the record after the newest one.
+func nextRingRecord(records []ringRecord) uint32 {
+	newest := -1
+	for i, rec := range records {
+		if rec.time != 0 && (newest < 0 || rec.time > records[newest].time) {
+			newest = i
+		}
+	}
+	return uint32(newest+1) % uint32(len(records))
+}
+
+// readRingFile returns the points in file recorded at or after since,
+// oldest first.
+func readRingFile(file string, since time.Time) ([]metricPoint, error) {
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	records, err := parseRingFile(data)
+	if err != nil {
+		return nil, fmt.Errorf("%v: %s", err, file)
+	}
+
+	points := make([]metricPoint, 0, len(records))
+	for _, rec := range records {
+		p := metricPoint{Time: time.Unix(0, rec.time), Value: rec.value}
+		if rec.time != 0 && !p.Time.Before(since) {
+			points = append(points, p)
+		}
+	}
+	sort.Slice(points, func(i, j int) bool { return points[i].Time.Before(points[j].Time) })
+	return points, nil
+}
+
+// listMetricsHistory returns the names of the recorded metrics in dir.
+func listMetricsHistory(dir string) ([]string, error) {
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	names := make([]string, 0, len(files))
+	for _, f := range files {
+		if strings.HasSuffix(f.Name(), ".ring") {
+			names = append(names, strings.TrimSuffix(f.Name(), ".ring"))
+		}
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+// unboundedMetricKey matches keys of metrics maps that name a block,
+// peer or other item of an unbounded set, such as hashes and peer IDs.
+var unboundedMetricKey = regexp.MustCompile(`^(0x)?[0-9a-fA-F]{16,}$|^(Qm|12D3Koo)[1-9A-HJ-NP-Za-km-z]{20,}$`)
+
+// metricsRecorder samples the kernel and consensus metrics of the node
+// into ring files. Only metrics matching one of patterns are recorded, at
+// most maxMetrics of them. Files of metrics that were not in the last
+// idleSamples samples are closed.
+type metricsRecorder struct {
+	dir        string
+	interval   time.Duration
+	capacity   uint32
+	patterns   []string
+	maxMetrics int
+	files      map[string]*ringFile
+	lastSeen   map[string]time.Time
+	warned     bool
+}
+
+// idleSamples is the number of samples a metric may be missing before its
+// ring file is closed.
+const idleSamples = 3
+
+func init() {
+	viper.SetDefault("diagnostics.history.enable", false)
+	viper.SetDefault("diagnostics.history.interval", 10*time.Second)
+	viper.SetDefault("diagnostics.history.retention", 24*time.Hour)
+	viper.SetDefault("diagnostics.history.metrics", []string{"*"}) // shell patterns of metric names
+	viper.SetDefault("diagnostics.history.maxMetrics", 500)
+}
+
+func buildMetricsRecorder() (*metricsRecorder, error) {
+	if !viper.GetBool("diagnostics.history.enable") {
+		return nil, nil
+	}
+
+	interval := viper.GetDuration("diagnostics.history.interval")
+	retention := viper.GetDuration("diagnostics.history.retention")
+	if interval <= 0 || retention < interval {
+		return nil, errors.New("metrics history needs a positive interval no longer than the retention")
+	}
+
+	patterns := viper.GetStringSlice("diagnostics.history.metrics")
+	for _, p := range patterns {
+		if _, err := path.Match(p, ""); err != nil {
+			return nil, errors.New("invalid metrics history pattern " + p + ": " + err.Error())
+		}
+	}
+
+	return &metricsRecorder{
+		dir:        metricsHistoryDir(),
+		interval:   interval,
+		capacity:   uint32(retention / interval),
+		patterns:   patterns,
+		maxMetrics: viper.GetInt("diagnostics.history.maxMetrics"),
+		files:      make(map[string]*ringFile),
+		lastSeen:   make(map[string]time.Time)}, nil
+}
+
+// start records samples until ctx is done.
+func (m *metricsRecorder) start(ctx context.Context) {
+	if m == nil {
+		return
+	}
+	makeDirAll(m.dir)
+
+	go func() {
+		ticker := time.NewTicker(m.interval)
+		defer ticker.Stop()
+		defer func() {
+			for _, r := range m.files {
+				r.f.Close()
+			}
+		}()
+
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case now := <-ticker.C:
+				m.record(now)
+			}
+		}
+	}()
+}
+
+func (m *metricsRecorder) record(now time.Time) {
+	metrics := make(map[string]float64)
+
+	if res, err := nodeKernelMetrics("json"); err == nil {
+		var v interface{}
+		if json.Unmarshal([]byte(res), &v) == nil {
+			flattenRecordedMetrics("kernel", v, metrics)
+		}
+	}
+	if res, err := rpcconsensus.GetMetrics("json"); err == nil {
+		var v interface{}
+		if json.Unmarshal([]byte(res.Metrics), &v) == nil {
+			flattenRecordedMetrics("consensus", v, metrics)
+		}
+	}
+
+	names := make([]string, 0, len(metrics))
+	for name := range metrics {
+		if m.wanted(name) {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		r, ok := m.files[name]
+		if !ok {
+			if len(m.files) >= m.maxMetrics {
+				if !m.warned {
+					diagLog.WithField("max", m.maxMetrics).Warn("Too many metrics to record, raise diagnostics.history.maxMetrics or narrow diagnostics.history.metrics")
+					m.warned = true
+				}
+				continue
+			}
+			var err error
+			r, err = openRingFile(metricFile(m.dir, name), m.capacity)
+			if err != nil {
+				diagLog.WithField("metric", name).WithError(err).Error("Failed to open metrics history")
+				continue
+			}
+			m.files[name] = r
+		}
+		m.lastSeen[name] = now
+		if err := r.append(metricPoint{now, metrics[name]}); err != nil {
+			diagLog.WithField("metric", name).WithError(err).Error("Failed to record metrics history")
+		}
+	}
+
+	for name, r := range m.files {
+		if now.Sub(m.lastSeen[name]) > idleSamples*m.interval {
+			r.f.Close()
+			delete(m.files, name)
+			delete(m.lastSeen, name)
+		}
+	}
+}
+
+func (m *metricsRecorder) wanted(name string) bool {
+	for _, p := range m.patterns {
+		if ok, _ := path.Match(p, name); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// flattenRecordedMetrics is like flattenMetrics but skips arrays and the
+// entries of maps keyed by hashes or peer IDs, which would add a ring file
+// for every block or peer ever seen.
+func flattenRecordedMetrics(prefix string, v interface{}, out map[string]float64) {
+	switch v := v.(type) {
+	case map[string]interface{}:
+		for k, e := range v {
+			if unboundedMetricKey.MatchString(k) {
+				continue
+			}
+			flattenRecordedMetrics(prefix+"."+k, e, out)
+		}
+	case []interface{}:
+	default:
+		flattenMetrics(prefix, v, out)
+	}
+}
@@ -0,0 +1,106 @@
+// Copyright © 2018 J. Strobus White.
+// This file is part of the blocktop blockchain development kit.
+//
+// Blocktop is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// Blocktop is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with blocktop. If not, see <http://www.gnu.org/licenses/>.
+
+package cmd
+
+import (
+	"fmt"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestRingFile(t *testing.T) {
+	base := time.Unix(1500000000, 0)
+	at := func(i int) time.Time { return base.Add(time.Duration(i) * time.Second) }
+	points := func(from, to int) []metricPoint {
+		res := make([]metricPoint, 0)
+		for i := from; i <= to; i++ {
+			res = append(res, metricPoint{Time: at(i), Value: float64(i)})
+		}
+		return res
+	}
+
+	tests := []struct {
+		name     string
+		capacity uint32
+		appends  int
+		// reopen is the capacity the file is opened with after the first
+		// half of the appends, 0 to keep it open
+		reopen uint32
+		since  int
+		want   []metricPoint
+	}{
+		{"empty", 4, 0, 0, 0, points(1, 0)},
+		{"partly filled", 4, 3, 0, 0, points(1, 3)},
+		{"full", 4, 4, 0, 0, points(1, 4)},
+		{"wrapped", 4, 10, 0, 0, points(7, 10)},
+		{"since", 4, 10, 0, 9, points(9, 10)},
+		{"reopened", 4, 6, 4, 0, points(3, 6)},
+		{"reopened after wrapping", 3, 10, 3, 0, points(8, 10)},
+		{"capacity changed", 4, 6, 2, 0, points(5, 6)},
+	}
+
+	dir := t.TempDir()
+	for i, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			file := filepath.Join(dir, fmt.Sprintf("%d.ring", i))
+			r, err := openRingFile(file, tt.capacity)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for n := 1; n <= tt.appends; n++ {
+				if tt.reopen > 0 && n == tt.appends/2+1 {
+					r.f.Close()
+					if r, err = openRingFile(file, tt.reopen); err != nil {
+						t.Fatal(err)
+					}
+				}
+				if err = r.append(metricPoint{Time: at(n), Value: float64(n)}); err != nil {
+					t.Fatal(err)
+				}
+			}
+			r.f.Close()
+
+			got, err := readRingFile(file, at(tt.since))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("points = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestReadRingFileInvalid(t *testing.T) {
+	dir := t.TempDir()
+	file := filepath.Join(dir, "bad.ring")
+	r, err := openRingFile(file, 4)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.f.Truncate(ringHeaderSize + ringRecordSize)
+	r.f.Close()
+
+	if _, err = readRingFile(file, time.Time{}); err == nil {
+		t.Error("no error for a truncated file")
+	}
+	if _, err = readRingFile(filepath.Join(dir, "missing.ring"), time.Time{}); err == nil {
+		t.Error("no error for a missing file")
+	}
+}
@@ -0,0 +1,212 @@
+// Copyright © 2018 J. Strobus White.
+// This file is part of the blocktop blockchain development kit.
+//
+// Blocktop is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// Blocktop is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with blocktop. If not, see <http://www.gnu.org/licenses/>.
+
+package cmd
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/http"
+	"time"
+
+	p2p "github.com/blocktop/go-network-libp2p"
+	rpcconsensus "github.com/blocktop/go-rpc-client/consensus"
+	rpckernel "github.com/blocktop/go-rpc-client/kernel"
+
+	"github.com/spf13/viper"
+)
+
+const (
+	healthOK   = "ok"
+	healthFail = "fail"
+)
+
+type healthCheck struct {
+	Name   string `json:"name"`
+	OK     bool   `json:"ok"`
+	Detail string `json:"detail"`
+}
+
+type healthReport struct {
+	Status string         `json:"status"`
+	Checks []*healthCheck `json:"checks"`
+}
+
+// nodeHealth answers the /healthz and /readyz endpoints of the control
+// server and of the probe listener at health.addr. A node is healthy while
+// its kernel is producing or receiving blocks, and ready once it is also
+// connected to enough peers, following a recent consensus head and serving
+// RPC.
+type nodeHealth struct {
+	node    *p2p.NetworkNode
+	tracker *blockTracker
+	history *forkHistory
+}
+
+func init() {
+	viper.SetDefault("health.maxStall", 0)   // 0 for 10 block intervals, at least 30s
+	viper.SetDefault("health.maxHeadAge", 0) // 0 for 10 block intervals, at least 30s
+	viper.SetDefault("health.addr", "")      // e.g. :28183, empty for no probe listener
+	viper.SetDefault("health.rpcTimeout", 2*time.Second)
+}
+
+func buildNodeHealth(node *p2p.NetworkNode, tracker *blockTracker, history *forkHistory) *nodeHealth {
+	h := &nodeHealth{node: node, tracker: tracker, history: history}
+
+	registerControlPath("/healthz", h.handler(h.live))
+	registerControlPath("/readyz", h.handler(h.ready))
+
+	return h
+}
+
+// start serves /healthz and /readyz on health.addr, if set, until ctx is
+// done. Unlike the control server, which only listens on localhost, it is
+// meant to be reachable by liveness and readiness probes and serves
+// nothing else.
+func (h *nodeHealth) start(ctx context.Context) {
+	addr := viper.GetString("health.addr")
+	if addr == "" {
+		return
+	}
+
+	mux := http.NewServeMux()
+	mux.Handle("/healthz", h.handler(h.live))
+	mux.Handle("/readyz", h.handler(h.ready))
+
+	srv := &http.Server{Addr: addr, Handler: mux}
+
+	go func() {
+		kernelLog.WithField("addr", addr).Info("Serving health probes")
+		err := srv.ListenAndServe()
+		if err != nil && err != http.ErrServerClosed {
+			kernelLog.WithError(err).Error("Health probe server failed")
+		}
+	}()
+
+	go func() {
+		<-ctx.Done()
+		sctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		srv.Shutdown(sctx)
+	}()
+}
+
+func (h *nodeHealth) handler(check func() *healthReport) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		report := check()
+		w.Header().Set("Content-Type", "application/json")
+		if report.Status != healthOK {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+		json.NewEncoder(w).Encode(report)
+	})
+}
+
+func (h *nodeHealth) live() *healthReport {
+	return newHealthReport(h.kernelCheck())
+}
+
+func (h *nodeHealth) ready() *healthReport {
+	return newHealthReport(h.kernelCheck(), h.peersCheck(), h.headCheck(), h.rpcCheck())
+}
+
+func newHealthReport(checks ...*healthCheck) *healthReport {
+	r := &healthReport{Status: healthOK, Checks: checks}
+	for _, c := range checks {
+		if !c.OK {
+			r.Status = healthFail
+		}
+	}
+	return r
+}
+
+// kernelCheck passes if a block was broadcast or received recently. The
+// kernel produces a block every block interval, so a long silence means
+// its loop has stalled.
+func (h *nodeHealth) kernelCheck() *healthCheck {
+	last := h.tracker.lastActivity()
+	if last.IsZero() {
+		last = processStart
+	}
+	age := time.Since(last)
+	max := healthTolerance("health.maxStall")
+
+	return &healthCheck{
+		Name:   "kernel",
+		OK:     age <= max,
+		Detail: fmt.Sprintf("last block activity %v ago, max %v", age.Round(time.Millisecond), max)}
+}
+
+func (h *nodeHealth) peersCheck() *healthCheck {
+	n := len(h.node.Host.Network().Peers())
+	min := viper.GetInt("node.bootstrapper.minPeers")
+
+	return &healthCheck{
+		Name:   "peers",
+		OK:     n >= min,
+		Detail: fmt.Sprintf("%d peers, min %d", n, min)}
+}
+
+func (h *nodeHealth) headCheck() *healthCheck {
+	last := h.history.lastHeadChange()
+	if last.IsZero() {
+		return &healthCheck{Name: "head", Detail: "no consensus head yet"}
+	}
+	age := time.Since(last)
+	max := healthTolerance("health.maxHeadAge")
+
+	return &healthCheck{
+		Name:   "head",
+		OK:     age <= max,
+		Detail: fmt.Sprintf("head changed %v ago, max %v", age.Round(time.Millisecond), max)}
+}
+
+// rpcCheck passes if the RPC server answers a metrics request of each
+// module within health.rpcTimeout. It probes the gateway at rpc.port, the
+// address clients of the node use.
+func (h *nodeHealth) rpcCheck() *healthCheck {
+	client := &http.Client{Timeout: viper.GetDuration("health.rpcTimeout")}
+
+	kreq := &rpckernel.GetMetricsRequest{}
+	kreqb, _ := json.Marshal(kreq.GetMetrics(rpckernel.GetMetricsArgs{Format: "text"}))
+	var kres rpckernel.GetMetricsResponse
+	if err := postNodeRPCOnce(client, rpcURL(), kreqb, &kres); err != nil {
+		return &healthCheck{Name: "rpc", Detail: err.Error()}
+	}
+
+	creq := &rpcconsensus.GetMetricsRequest{}
+	creqb, _ := json.Marshal(creq.GetMetrics(rpcconsensus.GetMetricsArgs{Format: "text"}))
+	var cres rpcconsensus.GetMetricsResponse
+	if err := postNodeRPCOnce(client, rpcURL(), creqb, &cres); err != nil {
+		return &healthCheck{Name: "rpc", Detail: err.Error()}
+	}
+	return &healthCheck{Name: "rpc", OK: true, Detail: "serving"}
+}
+
+// healthTolerance returns the duration configured at key, or 10 block
+// intervals but at least 30s if it is not set.
+func healthTolerance(key string) time.Duration {
+	if d := viper.GetDuration(key); d > 0 {
+		return d
+	}
+	d := 30 * time.Second
+	if f := viper.GetFloat64("blockchain.blockFrequency"); f > 0 {
+		d = time.Duration(math.Max(float64(d), float64(10*time.Second)/f))
+	}
+	return d
+}
@@ -0,0 +1,186 @@
+// Copyright © 2018 J. Strobus White.
+// This file is part of the blocktop blockchain development kit.
+//
+// Blocktop is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// Blocktop is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with blocktop. If not, see <http://www.gnu.org/licenses/>.
+
+package cmd
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/blocktop/go-kernel"
+	rpcconsensus "github.com/blocktop/go-rpc-client/consensus"
+)
+
+type metricsParams struct {
+	Format string `json:"format"`
+}
+
+// registerMetricsControlMethods makes the kernel and consensus metrics of
+// the node available on the control server, so that tools driving several
+// nodes only need to know their control addresses.
+func registerMetricsControlMethods() {
+	registerControlMethod("kernel.metrics", controlMethodDoc{
+		summary: "The kernel metrics, as text or with format json as JSON.",
+		params:  &metricsParams{}},
+		func(params json.RawMessage) (interface{}, error) {
+			var p metricsParams
+			if err := decodeControlParams(params, &p); err != nil {
+				return nil, err
+			}
+			res, err := nodeKernelMetrics(metricsFormat(p.Format))
+			if err != nil {
+				return nil, err
+			}
+			return metricsResult(p.Format, res), nil
+		})
+
+	registerControlMethod("consensus.metrics", controlMethodDoc{
+		summary: "The consensus metrics, as text or with format json as JSON.",
+		params:  &metricsParams{}},
+		func(params json.RawMessage) (interface{}, error) {
+			var p metricsParams
+			if err := decodeControlParams(params, &p); err != nil {
+				return nil, err
+			}
+			res, err := rpcconsensus.GetMetrics(metricsFormat(p.Format))
+			if err != nil {
+				return nil, err
+			}
+			return metricsResult(p.Format, res.Metrics), nil
+		})
+
+	registerControlMethod("consensus.tree", controlMethodDoc{
+		summary: "The consensus tree, as text or with format json as JSON.",
+		params:  &metricsParams{}},
+		func(params json.RawMessage) (interface{}, error) {
+			var p metricsParams
+			if err := decodeControlParams(params, &p); err != nil {
+				return nil, err
+			}
+			res, err := rpcconsensus.GetTree(metricsFormat(p.Format))
+			if err != nil {
+				return nil, err
+			}
+			return metricsResult(p.Format, res.Tree), nil
+		})
+}
+
+var (
+	kernelMetricsMutex    sync.Mutex
+	kernelMetricsSections = make(map[string]func() interface{})
+)
+
+// registerKernelMetrics adds a section name to the kernel metrics of the
+// node, whose content is returned by report. The content is a key of the
+// JSON metrics, and is formatted with its String method in text metrics.
+func registerKernelMetrics(name string, report func() interface{}) {
+	kernelMetricsMutex.Lock()
+	defer kernelMetricsMutex.Unlock()
+	kernelMetricsSections[name] = report
+}
+
+// nodeKernelMetrics returns the metrics of the kernel of this node with
+// the sections registered by lucky, in format json or text.
+func nodeKernelMetrics(format string) (string, error) {
+	metrics, err := kernel.GetMetrics(format)
+	if err != nil {
+		return "", err
+	}
+
+	kernelMetricsMutex.Lock()
+	names := make([]string, 0, len(kernelMetricsSections))
+	for name := range kernelMetricsSections {
+		names = append(names, name)
+	}
+	sections := make(map[string]interface{}, len(names))
+	for _, name := range names {
+		sections[name] = kernelMetricsSections[name]()
+	}
+	kernelMetricsMutex.Unlock()
+	if len(sections) == 0 {
+		return metrics, nil
+	}
+
+	if format != "json" {
+		sort.Strings(names)
+		var b strings.Builder
+		b.WriteString(strings.TrimRight(metrics, "\n"))
+		b.WriteString("\n")
+		for _, name := range names {
+			fmt.Fprint(&b, sections[name])
+		}
+		return b.String(), nil
+	}
+
+	doc := make(map[string]interface{})
+	if err := json.Unmarshal([]byte(metrics), &doc); err != nil {
+		return "", fmt.Errorf("invalid kernel metrics: %v", err)
+	}
+	for name, v := range sections {
+		doc[name] = v
+	}
+	b, err := json.Marshal(doc)
+	return string(b), err
+}
+
+func metricsFormat(format string) string {
+	if format == "json" {
+		return "json"
+	}
+	return "text"
+}
+
+// metricsResult embeds JSON metrics as JSON rather than as a string.
+func metricsResult(format string, metrics string) interface{} {
+	if format == "json" && json.Valid([]byte(metrics)) {
+		return json.RawMessage(metrics)
+	}
+	return metrics
+}
+
+// flattenMetrics collects the numeric and boolean leaves of decoded JSON
+// metrics into out, keyed by their dotted path below prefix.
+func flattenMetrics(prefix string, v interface{}, out map[string]float64) {
+	join := func(key string) string {
+		if prefix == "" {
+			return key
+		}
+		return prefix + "." + key
+	}
+
+	switch v := v.(type) {
+	case map[string]interface{}:
+		for k, e := range v {
+			flattenMetrics(join(k), e, out)
+		}
+	case []interface{}:
+		for i, e := range v {
+			flattenMetrics(join(strconv.Itoa(i)), e, out)
+		}
+	case float64:
+		out[prefix] = v
+	case bool:
+		if v {
+			out[prefix] = 1
+		} else {
+			out[prefix] = 0
+		}
+	}
+}
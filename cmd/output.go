@@ -0,0 +1,168 @@
+// Copyright © 2018 J. Strobus White.
+// This file is part of the blocktop blockchain development kit.
+//
+// Blocktop is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// Blocktop is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with blocktop. If not, see <http://www.gnu.org/licenses/>.
+
+package cmd
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/spf13/cobra"
+	"github.com/spf13/pflag"
+	yaml "gopkg.in/yaml.v2"
+)
+
+// Every command prints its result for humans, or with --output json or
+// --output yaml as a document for scripts. The documents are the JSON
+// encodings of the types the commands print, such as initResult,
+// nodeInfo, runtimeStats or peerStatus, and YAML documents have the same
+// field names. Fields are only ever added to them. Errors are printed as
+// an outputError document.
+
+const (
+	outputText = "text"
+	outputJSON = "json"
+	outputYAML = "yaml"
+)
+
+var outputFormat string
+
+// outputError is the document printed when a command fails. Code is the
+// exit status.
+type outputError struct {
+	Error  string      `json:"error"`
+	Code   int         `json:"code"`
+	Detail string      `json:"detail,omitempty"`
+	Hint   string      `json:"hint,omitempty"`
+	Data   interface{} `json:"data,omitempty"`
+}
+
+func init() {
+	cobra.OnInitialize(initOutput)
+
+	// no shorthand, -o is the output file of diag profile and diag bundle
+	rootCmd.PersistentFlags().StringVar(&outputFormat, "output", outputText, "output format: text, json or yaml")
+}
+
+// initOutput checks --output and applies the --json flags that preceded
+// it.
+func initOutput() {
+	switch outputFormat {
+	case outputText, outputJSON, outputYAML:
+	default:
+		bad := outputFormat
+		outputFormat = outputText
+		failWithError(fmt.Errorf("invalid output format: %s, must be text, json or yaml", bad))
+	}
+
+	if metricsInJson || diagInJson || healthInJson || benchJSON {
+		if !rootCmd.PersistentFlags().Changed("output") {
+			outputFormat = outputJSON
+		}
+	}
+}
+
+// deprecateJSONFlag marks the --json flag of a command as replaced by
+// --output json.
+func deprecateJSONFlag(flags *pflag.FlagSet) {
+	flags.MarkDeprecated("json", "use --output json")
+}
+
+// structuredOutput reports whether the output is a document rather than
+// text.
+func structuredOutput() bool {
+	return outputFormat != outputText
+}
+
+// printResult prints v as a document if --output asks for one, and
+// otherwise calls text to print it for humans.
+func printResult(v interface{}, text func()) {
+	if !structuredOutput() {
+		text()
+		return
+	}
+	if err := writeDocument(os.Stdout, v); err != nil {
+		outputFormat = outputText
+		failWithError(err)
+	}
+}
+
+// writeDocument writes v as a JSON or YAML document. YAML is converted
+// from JSON so that both use the field names of the JSON encoding.
+func writeDocument(w *os.File, v interface{}) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	if outputFormat == outputJSON {
+		_, err = fmt.Fprintln(w, string(data))
+		return err
+	}
+
+	var doc yaml.MapSlice
+	if err = yaml.Unmarshal(data, &doc); err != nil {
+		// not an object
+		var any interface{}
+		if err = yaml.Unmarshal(data, &any); err != nil {
+			return err
+		}
+		data, err = yaml.Marshal(any)
+	} else {
+		data, err = yaml.Marshal(doc)
+	}
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(data)
+	return err
+}
+
+// progressOutput returns where to print progress messages, which go to
+// stderr if stdout is for a document.
+func progressOutput() io.Writer {
+	if structuredOutput() {
+		return os.Stderr
+	}
+	return os.Stdout
+}
+
+// printMetrics prints metrics that a node returned in the format of
+// getMetricsFormat: as is if text, and as a document in the output format
+// otherwise. It fails if the node did not return a JSON object.
+func printMetrics(raw string) {
+	if !structuredOutput() {
+		fmt.Println(raw)
+		return
+	}
+	doc, err := metricsObject(raw)
+	if err != nil {
+		failWithError(err)
+	}
+	printResult(doc, nil)
+}
+
+// metricsObject checks that raw, metrics a node returned in JSON format,
+// is a JSON object.
+func metricsObject(raw string) (json.RawMessage, error) {
+	var obj map[string]json.RawMessage
+	if err := json.Unmarshal([]byte(raw), &obj); err != nil {
+		return nil, errors.New("the node did not return metrics as a JSON object: " + err.Error())
+	}
+	return json.RawMessage(raw), nil
+}
@@ -0,0 +1,43 @@
+// Copyright © 2018 J. Strobus White.
+// This file is part of the blocktop blockchain development kit.
+//
+// Blocktop is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// Blocktop is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with blocktop. If not, see <http://www.gnu.org/licenses/>.
+
+package cmd
+
+import "sync"
+
+// peerOrigins records where the node learned about a peer, e.g. a
+// bootstrap source, a static peer or mDNS. The first origin recorded for
+// a peer wins.
+var peerOrigins = struct {
+	sync.RWMutex
+	m map[string]string
+}{m: make(map[string]string)}
+
+func setPeerOrigin(peerID, origin string) {
+	peerOrigins.Lock()
+	defer peerOrigins.Unlock()
+
+	if _, ok := peerOrigins.m[peerID]; !ok {
+		peerOrigins.m[peerID] = origin
+	}
+}
+
+func peerOrigin(peerID string) string {
+	peerOrigins.RLock()
+	defer peerOrigins.RUnlock()
+
+	return peerOrigins.m[peerID]
+}
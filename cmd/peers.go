@@ -0,0 +1,90 @@
+// Copyright © 2018 J. Strobus White.
+// This file is part of the blocktop blockchain development kit.
+//
+// Blocktop is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// Blocktop is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with blocktop. If not, see <http://www.gnu.org/licenses/>.
+
+package cmd
+
+import (
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/spf13/cobra"
+)
+
+// peersCmd represents the peers command
+var peersCmd = &cobra.Command{
+	Use:   "peers",
+	Short: "Lists the peers of a running lucky blockchain.",
+	Long: `Usage: lucky peers [OPTIONS]
+       lucky peers [SUBCOMMAND] [OPTIONS]
+
+Lists connected peers along with their reputation score and the offenses
+counted against them. Use --banned to list banned peers instead.`,
+	Run: func(cmd *cobra.Command, args []string) {
+		w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+		defer w.Flush()
+
+		if peersBanned {
+			var bans []banEntry
+			if err := callControl("peers.bans", nil, &bans); err != nil {
+				failWithError(err)
+			}
+			printResult(bans, func() {
+				fmt.Fprintln(w, "PEER\tUNTIL\tBANS\tREASON")
+				for _, e := range bans {
+					until := e.Until.Format(time.RFC3339)
+					if e.Permanent {
+						until = "permanent"
+					}
+					fmt.Fprintf(w, "%s\t%s\t%d\t%s\n", e.PeerID, until, e.Bans, e.Reason)
+				}
+			})
+			return
+		}
+
+		var peers []peerStatus
+		if err := callControl("peers.list", nil, &peers); err != nil {
+			failWithError(err)
+		}
+		printResult(peers, func() {
+			fmt.Fprintln(w, "PEER\tORIGIN\tSCORE\tOFFENSES\tADDRESSES")
+			for _, p := range peers {
+				offenses := make([]string, 0, len(p.Offenses))
+				for o, n := range p.Offenses {
+					offenses = append(offenses, fmt.Sprintf("%s=%d", o, n))
+				}
+				sort.Strings(offenses)
+				origin := p.Origin
+				if origin == "" {
+					origin = "-"
+				}
+				fmt.Fprintf(w, "%s\t%s\t%.1f\t%s\t%s\n", p.PeerID, origin, p.Score,
+					strings.Join(offenses, ","), strings.Join(p.Addrs, ","))
+			}
+		})
+	},
+}
+
+var peersBanned bool
+
+func init() {
+	rootCmd.AddCommand(peersCmd)
+
+	peersCmd.Flags().BoolVar(&peersBanned, "banned", false, "list banned peers")
+}
@@ -0,0 +1,94 @@
+// Copyright © 2018 J. Strobus White.
+// This file is part of the blocktop blockchain development kit.
+//
+// Blocktop is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// Blocktop is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with blocktop. If not, see <http://www.gnu.org/licenses/>.
+
+package cmd
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/spf13/cobra"
+)
+
+// peersBanCmd represents the ban command
+var peersBanCmd = &cobra.Command{
+	Use:   "ban <peerID>",
+	Short: "Bans a peer from connecting to the lucky blockchain.",
+	Long: `Usage: lucky peers ban <peerID> [OPTIONS]
+
+Bans the peer permanently unless --duration is given. If no node is
+running the ban is written to the ban list in the data directory and
+takes effect when the node starts.`,
+	Args: cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		p := &peerBanParams{PeerID: args[0], Reason: peersBanReason}
+		if peersBanDuration > 0 {
+			p.Duration = peersBanDuration.String()
+		}
+
+		var e banEntry
+		err := callControl("peers.ban", p, &e)
+		if controlUnreachable(err) {
+			d, err := parseBanParams(p)
+			if err != nil {
+				failWithError(err)
+			}
+			updateBanListOffline(func(b *banList) bool {
+				e = b.ban(p.PeerID, d, p.Reason, time.Now())
+				return true
+			})
+		} else if err != nil {
+			failWithError(err)
+		}
+
+		printResult(&e, func() {
+			if e.Permanent {
+				fmt.Printf("Banned peer %s permanently\n", e.PeerID)
+			} else {
+				fmt.Printf("Banned peer %s until %s\n", e.PeerID, e.Until.Format(time.RFC3339))
+			}
+		})
+	},
+}
+
+var peersBanDuration time.Duration
+var peersBanReason string
+
+func init() {
+	peersCmd.AddCommand(peersBanCmd)
+
+	flags := peersBanCmd.Flags()
+	flags.DurationVarP(&peersBanDuration, "duration", "d", 0, "how long to ban the peer, 0 bans permanently")
+	flags.StringVar(&peersBanReason, "reason", "", "reason recorded with the ban")
+}
+
+// updateBanListOffline applies update to the ban list on disk, for use when
+// no node is running to take the request. update returns whether it changed
+// the list.
+func updateBanListOffline(update func(b *banList) bool) {
+	file := banListFile()
+	b, err := loadBanList(file)
+	if err != nil {
+		failWithError(err)
+	}
+	if !update(b) {
+		return
+	}
+	if err = b.save(); err != nil {
+		failWithError(err)
+	}
+	fmt.Println("No running node found, updated ban list:", file)
+}
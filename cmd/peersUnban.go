@@ -0,0 +1,63 @@
+// Copyright © 2018 J. Strobus White.
+// This file is part of the blocktop blockchain development kit.
+//
+// Blocktop is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// Blocktop is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with blocktop. If not, see <http://www.gnu.org/licenses/>.
+
+package cmd
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/spf13/cobra"
+)
+
+// peersUnbanCmd represents the unban command
+var peersUnbanCmd = &cobra.Command{
+	Use:   "unban <peerID>",
+	Short: "Lifts the ban on a peer.",
+	Long: `Usage: lucky peers unban <peerID>
+
+Lifts the ban and clears the peer's ban history, so that a later automatic
+ban starts again at the shortest ban time.`,
+	Args: cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		peerID := args[0]
+
+		err := callControl("peers.unban", &peerBanParams{PeerID: peerID}, nil)
+		if controlUnreachable(err) {
+			found := false
+			updateBanListOffline(func(b *banList) bool {
+				found = b.unban(peerID)
+				return found
+			})
+			if !found {
+				err = errors.New("peer is not banned: " + peerID)
+			} else {
+				err = nil
+			}
+		}
+		if err != nil {
+			failWithError(err)
+		}
+
+		printResult(&peerBanParams{PeerID: peerID}, func() {
+			fmt.Println("Unbanned peer", peerID)
+		})
+	},
+}
+
+func init() {
+	peersCmd.AddCommand(peersUnbanCmd)
+}
@@ -0,0 +1,278 @@
+// Copyright © 2018 J. Strobus White.
+// This file is part of the blocktop blockchain development kit.
+//
+// Blocktop is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// Blocktop is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with blocktop. If not, see <http://www.gnu.org/licenses/>.
+
+package cmd
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	httppprof "net/http/pprof"
+	"path"
+	"runtime"
+	"runtime/pprof"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/spf13/viper"
+)
+
+const (
+	profileCPU       = "cpu"
+	profileHeap      = "heap"
+	profileGoroutine = "goroutine"
+	profileMutex     = "mutex"
+	profileBlock     = "block"
+)
+
+type profileParams struct {
+	Type     string `json:"type"`
+	Duration string `json:"duration,omitempty"` // for cpu, mutex and block profiles
+}
+
+type profileResult struct {
+	Type string `json:"type"`
+	Data []byte `json:"data"` // pprof protobuf, base64 encoded in JSON
+}
+
+// profileLock allows one timed profile capture at a time.
+var profileLock sync.Mutex
+
+func init() {
+	viper.SetDefault("diagnostics.pprofAddr", "")
+	viper.SetDefault("diagnostics.dumps.threshold", 0) // megabytes of heap, 0 to disable
+	viper.SetDefault("diagnostics.dumps.checkInterval", 10*time.Second)
+	viper.SetDefault("diagnostics.dumps.cooldown", 10*time.Minute)
+	viper.SetDefault("diagnostics.dumps.dir", "")
+}
+
+// startPprofServer serves net/http/pprof on diagnostics.pprofAddr, if set,
+// until ctx is done.
+func startPprofServer(ctx context.Context) {
+	addr := viper.GetString("diagnostics.pprofAddr")
+	if addr == "" {
+		return
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/debug/pprof/", httppprof.Index)
+	mux.HandleFunc("/debug/pprof/cmdline", httppprof.Cmdline)
+	mux.HandleFunc("/debug/pprof/profile", httppprof.Profile)
+	mux.HandleFunc("/debug/pprof/symbol", httppprof.Symbol)
+	mux.HandleFunc("/debug/pprof/trace", httppprof.Trace)
+
+	srv := &http.Server{Addr: addr, Handler: mux}
+
+	go func() {
+		diagLog.WithField("addr", addr).Info("Serving pprof")
+		err := srv.ListenAndServe()
+		if err != nil && err != http.ErrServerClosed {
+			diagLog.WithError(err).Error("pprof server failed")
+		}
+	}()
+
+	go func() {
+		<-ctx.Done()
+		srv.Close()
+	}()
+}
+
+// profileMaxDuration caps the duration of cpu, mutex and block profiles.
+const profileMaxDuration = 5 * time.Minute
+
+// checkProfileParams returns an error if kind is not a profile type or d
+// is not a valid duration for it.
+func checkProfileParams(kind string, d time.Duration) error {
+	switch kind {
+	case profileHeap, profileGoroutine:
+		return nil
+	case profileCPU, profileMutex, profileBlock:
+	default:
+		return errors.New("unknown profile type: " + kind)
+	}
+
+	if d <= 0 {
+		return errors.New("a positive duration is required for a " + kind + " profile")
+	}
+	if d > profileMaxDuration {
+		return fmt.Errorf("a %s profile can last at most %v", kind, profileMaxDuration)
+	}
+	return nil
+}
+
+// captureProfile returns a profile of type kind in pprof format. The cpu,
+// mutex and block profiles are sampled for d and hold only what happened
+// in that time; the mutex and block profiles are enabled just for that
+// time unless already enabled.
+func captureProfile(kind string, d time.Duration) ([]byte, error) {
+	if err := checkProfileParams(kind, d); err != nil {
+		return nil, err
+	}
+
+	var buf bytes.Buffer
+	switch kind {
+	case profileHeap, profileGoroutine:
+		if err := pprof.Lookup(kind).WriteTo(&buf, 0); err != nil {
+			return nil, err
+		}
+		return buf.Bytes(), nil
+	}
+
+	profileLock.Lock()
+	defer profileLock.Unlock()
+
+	switch kind {
+	case profileCPU:
+		if err := pprof.StartCPUProfile(&buf); err != nil {
+			return nil, err
+		}
+		time.Sleep(d)
+		pprof.StopCPUProfile()
+		return buf.Bytes(), nil
+	case profileMutex:
+		if runtime.SetMutexProfileFraction(-1) == 0 {
+			runtime.SetMutexProfileFraction(5)
+			defer runtime.SetMutexProfileFraction(0)
+		}
+	case profileBlock:
+		// the block profile rate cannot be read back, so it is only
+		// ever enabled here
+		runtime.SetBlockProfileRate(int(time.Millisecond))
+		defer runtime.SetBlockProfileRate(0)
+	}
+
+	return deltaProfile(kind, d)
+}
+
+// deltaProfile returns what the cumulative profile kind recorded during d,
+// rounded up to whole seconds. net/http/pprof computes it from the
+// profiles taken before and after.
+func deltaProfile(kind string, d time.Duration) ([]byte, error) {
+	secs := (d + time.Second - 1) / time.Second
+	r, err := http.NewRequest(http.MethodGet, fmt.Sprintf("/debug/pprof/%s?seconds=%d", kind, secs), nil)
+	if err != nil {
+		return nil, err
+	}
+
+	w := &profileWriter{header: make(http.Header), status: http.StatusOK}
+	httppprof.Handler(kind).ServeHTTP(w, r)
+	if w.status != http.StatusOK {
+		return nil, fmt.Errorf("%s profile failed: %s", kind, strings.TrimSpace(w.String()))
+	}
+	return w.Bytes(), nil
+}
+
+// profileWriter collects the response of a net/http/pprof handler.
+type profileWriter struct {
+	bytes.Buffer
+	header http.Header
+	status int
+}
+
+func (w *profileWriter) Header() http.Header {
+	return w.header
+}
+
+func (w *profileWriter) WriteHeader(status int) {
+	w.status = status
+}
+
+func registerProfileControlMethod() {
+	registerControlMethod("diag.profile", controlMethodDoc{
+		summary: "A pprof profile of the node, gzipped and base64 encoded.",
+		params:  &profileParams{},
+		result:  &profileResult{}},
+		func(params json.RawMessage) (interface{}, error) {
+			var p profileParams
+			if err := decodeControlParams(params, &p); err != nil {
+				return nil, err
+			}
+			var d time.Duration
+			if p.Duration != "" {
+				var err error
+				if d, err = time.ParseDuration(p.Duration); err != nil {
+					return nil, newControlError(controlErrInvalidParams, err.Error())
+				}
+			}
+
+			if err := checkProfileParams(p.Type, d); err != nil {
+				return nil, newControlError(controlErrInvalidParams, err.Error())
+			}
+
+			data, err := captureProfile(p.Type, d)
+			if err != nil {
+				return nil, err
+			}
+			return &profileResult{Type: p.Type, Data: data}, nil
+		})
+}
+
+// watchMemory writes heap and goroutine profiles when the heap grows
+// beyond diagnostics.dumps.threshold megabytes, at most once per
+// cooldown period.
+func watchMemory(ctx context.Context) {
+	threshold := uint64(viper.GetInt64("diagnostics.dumps.threshold")) << 20
+	if threshold == 0 {
+		return
+	}
+	dir := viper.GetString("diagnostics.dumps.dir")
+	if dir == "" {
+		dir = path.Join(dataDir(), "profiles")
+	}
+	cooldown := viper.GetDuration("diagnostics.dumps.cooldown")
+
+	go func() {
+		ticker := time.NewTicker(viper.GetDuration("diagnostics.dumps.checkInterval"))
+		defer ticker.Stop()
+		var last time.Time
+
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case now := <-ticker.C:
+				var ms runtime.MemStats
+				runtime.ReadMemStats(&ms)
+				if ms.HeapAlloc < threshold || now.Sub(last) < cooldown {
+					continue
+				}
+				last = now
+
+				diagLog.WithField("heapAlloc", ms.HeapAlloc).Warn("Memory threshold exceeded, writing profiles")
+				makeDirAll(dir)
+				for _, kind := range []string{profileHeap, profileGoroutine} {
+					file := path.Join(dir, fmt.Sprintf("%s-%s.pb.gz", kind, now.Format("20060102T150405")))
+					if err := writeProfile(kind, file); err != nil {
+						diagLog.WithField("file", file).WithError(err).Error("Failed to write profile")
+					}
+				}
+			}
+		}
+	}()
+}
+
+func writeProfile(kind string, file string) error {
+	data, err := captureProfile(kind, 0)
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(file, data, 0644)
+}
@@ -0,0 +1,404 @@
+// Copyright © 2018 J. Strobus White.
+// This file is part of the blocktop blockchain development kit.
+//
+// Blocktop is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// Blocktop is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with blocktop. If not, see <http://www.gnu.org/licenses/>.
+
+package cmd
+
+import (
+	"encoding/json"
+	"errors"
+	"math"
+	"sort"
+	"sync"
+	"time"
+
+	p2p "github.com/blocktop/go-network-libp2p"
+	spec "github.com/blocktop/go-spec"
+
+	inet "github.com/libp2p/go-libp2p-net"
+	peer "github.com/libp2p/go-libp2p-peer"
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+)
+
+type peerOffense int
+
+const (
+	offenseInvalidBlock peerOffense = iota
+	offenseMalformedMessage
+	offenseExcessiveRate
+	numOffenses
+)
+
+var offenseNames = [numOffenses]string{"invalidBlock", "malformedMessage", "excessiveRate"}
+
+func (o peerOffense) String() string {
+	return offenseNames[o]
+}
+
+// maxTrackedSenders bounds the number of received block hashes remembered
+// for attributing invalid blocks to the peers that sent them.
+const maxTrackedSenders = 4096
+
+type peerScore struct {
+	score       float64
+	updated     time.Time
+	windowStart time.Time
+	windowCount int
+	offenses    [numOffenses]int
+}
+
+type blockSender struct {
+	peerID   string
+	received time.Time
+}
+
+// peerReputation scores peers for misbehavior and bans those whose score
+// crosses the ban threshold. Scores decay linearly over time so that only
+// sustained misbehavior leads to a ban.
+type peerReputation struct {
+	sync.Mutex
+	node       *p2p.NetworkNode
+	bans       *banList
+	peers      map[string]*peerScore
+	senders    map[string]blockSender
+	penalties  [numOffenses]float64
+	threshold  float64
+	decay      float64
+	maxRate    int
+	banTime    time.Duration
+	maxBanTime time.Duration
+}
+
+func init() {
+	viper.SetDefault("node.reputation.threshold", 100)
+	viper.SetDefault("node.reputation.decay", 0) // points/second, 0 derives it from blockFrequency
+	viper.SetDefault("node.reputation.penalty.invalidBlock", 1)
+	viper.SetDefault("node.reputation.penalty.malformedMessage", 20)
+	viper.SetDefault("node.reputation.penalty.excessiveRate", 10)
+	viper.SetDefault("node.reputation.maxMessageRate", 50) // messages/second
+	viper.SetDefault("node.reputation.banTime", 10*time.Minute)
+	viper.SetDefault("node.reputation.maxBanTime", 24*time.Hour)
+}
+
+func buildReputation(node *p2p.NetworkNode) (*peerReputation, error) {
+	bans, err := loadBanList(banListFile())
+	if err != nil {
+		return nil, err
+	}
+
+	r := &peerReputation{
+		node:       node,
+		bans:       bans,
+		peers:      make(map[string]*peerScore),
+		senders:    make(map[string]blockSender),
+		threshold:  viper.GetFloat64("node.reputation.threshold"),
+		decay:      viper.GetFloat64("node.reputation.decay"),
+		maxRate:    viper.GetInt("node.reputation.maxMessageRate"),
+		banTime:    viper.GetDuration("node.reputation.banTime"),
+		maxBanTime: viper.GetDuration("node.reputation.maxBanTime")}
+	for o := peerOffense(0); o < numOffenses; o++ {
+		r.penalties[o] = viper.GetFloat64("node.reputation.penalty." + o.String())
+	}
+
+	// By default a peer may send twice as many invalid blocks per second
+	// as the network produces before its score starts to grow.
+	if r.decay <= 0 {
+		r.decay = 2 * viper.GetFloat64("blockchain.blockFrequency") * r.penalties[offenseInvalidBlock]
+	}
+
+	node.Host.Network().Notify(&inet.NotifyBundle{
+		ConnectedF: func(n inet.Network, c inet.Conn) {
+			if r.bans.isBanned(c.RemotePeer().Pretty(), time.Now()) {
+				p2pLog.WithField(logFieldPeer, c.RemotePeer().Pretty()).Debug("Rejecting connection from banned peer")
+				go n.ClosePeer(c.RemotePeer())
+			}
+		}})
+
+	r.registerControlMethods()
+
+	return r, nil
+}
+
+// blockValidator is implemented by blocks that can check themselves.
+type blockValidator interface {
+	Validate() error
+}
+
+// comparator wraps the consensus block comparator so that peers are
+// penalized for the invalid blocks they send. Each compared block is
+// validated once, the first time it is compared after being received;
+// losing a comparison to a competing block is no offense.
+func (r *peerReputation) comparator(compare spec.BlockComparator) spec.BlockComparator {
+	return func(blocks []spec.Block) spec.Block {
+		for _, b := range blocks {
+			r.Lock()
+			sender, ok := r.senders[b.Hash()]
+			delete(r.senders, b.Hash())
+			r.Unlock()
+			if !ok {
+				continue
+			}
+
+			v, ok := b.(blockValidator)
+			if !ok {
+				continue
+			}
+			if err := v.Validate(); err != nil {
+				p2pLog.WithFields(logrus.Fields{logFieldPeer: sender.peerID, logFieldBlock: b.Hash()}).WithError(err).Debug("Received an invalid block")
+				r.penalize(sender.peerID, offenseInvalidBlock)
+			}
+		}
+		return compare(blocks)
+	}
+}
+
+func (r *peerReputation) inbound(msg *spec.NetworkMessage, next gossipHandler) {
+	now := time.Now()
+	if r.bans.isBanned(msg.From, now) {
+		return
+	}
+	if len(msg.Data) == 0 || msg.Hash == "" {
+		r.penalize(msg.From, offenseMalformedMessage)
+		return
+	}
+
+	r.Lock()
+	s := r.score(msg.From, now)
+	if now.Sub(s.windowStart) >= time.Second {
+		s.windowStart = now
+		s.windowCount = 0
+	}
+	s.windowCount++
+	exceeded := r.maxRate > 0 && s.windowCount > r.maxRate
+	if !exceeded {
+		r.trackSender(msg.Hash, msg.From, now)
+	}
+	r.Unlock()
+
+	if exceeded {
+		r.penalize(msg.From, offenseExcessiveRate)
+		return
+	}
+
+	next(msg)
+}
+
+func (r *peerReputation) outbound(msg *spec.NetworkMessage, next gossipHandler) {
+	next(msg)
+}
+
+// score returns the decayed score record of peerID. The caller must hold
+// the lock.
+func (r *peerReputation) score(peerID string, now time.Time) *peerScore {
+	s, ok := r.peers[peerID]
+	if !ok {
+		s = &peerScore{updated: now}
+		r.peers[peerID] = s
+	}
+	elapsed := now.Sub(s.updated).Seconds()
+	s.score = math.Max(0, s.score-r.decay*elapsed)
+	s.updated = now
+
+	return s
+}
+
+func (r *peerReputation) trackSender(hash, peerID string, now time.Time) {
+	if len(r.senders) >= maxTrackedSenders {
+		horizon := now.Add(-viper.GetDuration("blockchain.consensus.time"))
+		for h, s := range r.senders {
+			if s.received.Before(horizon) {
+				delete(r.senders, h)
+			}
+		}
+	}
+	if len(r.senders) < maxTrackedSenders {
+		r.senders[hash] = blockSender{peerID, now}
+	}
+}
+
+func (r *peerReputation) penalize(peerID string, offense peerOffense) {
+	if peerID == "" {
+		return
+	}
+	now := time.Now()
+
+	r.Lock()
+	s := r.score(peerID, now)
+	s.score += r.penalties[offense]
+	s.offenses[offense]++
+	banned := s.score >= r.threshold
+	if banned {
+		delete(r.peers, peerID)
+	}
+	r.Unlock()
+
+	p2pLog.WithFields(logrus.Fields{logFieldPeer: peerID, "offense": offense}).Trace("Peer penalized")
+
+	if banned {
+		r.autoBan(peerID, offense, now)
+	}
+}
+
+// autoBan bans peerID with exponential backoff: every earlier ban doubles
+// the ban time, up to maxBanTime.
+func (r *peerReputation) autoBan(peerID string, offense peerOffense, now time.Time) {
+	d := r.banTime
+	for i := r.bans.bans(peerID); i > 0 && d < r.maxBanTime; i-- {
+		d *= 2
+	}
+	if d > r.maxBanTime {
+		d = r.maxBanTime
+	}
+
+	e := r.bans.ban(peerID, d, offense.String(), now)
+	p2pLog.WithFields(logrus.Fields{logFieldPeer: peerID, "duration": d, "offense": offense, "bans": e.Bans}).Warn("Banned peer")
+	r.disconnect(peerID)
+	if err := r.bans.save(); err != nil {
+		storeLog.WithError(err).Error("Failed to save ban list")
+	}
+}
+
+func (r *peerReputation) disconnect(peerID string) {
+	id, err := peer.IDB58Decode(peerID)
+	if err != nil {
+		return
+	}
+	go r.node.Host.Network().ClosePeer(id)
+}
+
+type peerStatus struct {
+	PeerID   string         `json:"peerID"`
+	Addrs    []string       `json:"addrs"`
+	Origin   string         `json:"origin,omitempty"`
+	Score    float64        `json:"score"`
+	Offenses map[string]int `json:"offenses"`
+}
+
+type peerBanParams struct {
+	PeerID   string `json:"peerID"`
+	Duration string `json:"duration,omitempty"`
+	Reason   string `json:"reason,omitempty"`
+}
+
+func (r *peerReputation) status() []peerStatus {
+	now := time.Now()
+	network := r.node.Host.Network()
+
+	res := make([]peerStatus, 0)
+	for _, id := range network.Peers() {
+		ps := peerStatus{
+			PeerID:   id.Pretty(),
+			Addrs:    make([]string, 0),
+			Origin:   peerOrigin(id.Pretty()),
+			Offenses: make(map[string]int)}
+		for _, c := range network.ConnsToPeer(id) {
+			ps.Addrs = append(ps.Addrs, c.RemoteMultiaddr().String())
+		}
+
+		r.Lock()
+		if s, ok := r.peers[ps.PeerID]; ok {
+			ps.Score = r.score(ps.PeerID, now).score
+			for o, n := range s.offenses {
+				if n > 0 {
+					ps.Offenses[peerOffense(o).String()] = n
+				}
+			}
+		}
+		r.Unlock()
+
+		res = append(res, ps)
+	}
+	sort.Slice(res, func(i, j int) bool { return res[i].PeerID < res[j].PeerID })
+
+	return res
+}
+
+func (r *peerReputation) registerControlMethods() {
+	registerControlMethod("peers.list", controlMethodDoc{
+		summary: "The connected peers with their reputation.",
+		result:  []peerStatus{}},
+		func(json.RawMessage) (interface{}, error) {
+			return r.status(), nil
+		})
+
+	registerControlMethod("peers.bans", controlMethodDoc{
+		summary: "The active peer bans.",
+		result:  []banEntry{}},
+		func(json.RawMessage) (interface{}, error) {
+			return r.bans.active(time.Now()), nil
+		})
+
+	registerControlMethod("peers.ban", controlMethodDoc{
+		summary: "Bans a peer, permanently unless a duration is given.",
+		params:  &peerBanParams{},
+		result:  &banEntry{}},
+		func(params json.RawMessage) (interface{}, error) {
+			var p peerBanParams
+			if err := decodeControlParams(params, &p); err != nil {
+				return nil, err
+			}
+			d, err := parseBanParams(&p)
+			if err != nil {
+				return nil, newControlError(controlErrInvalidParams, err.Error())
+			}
+
+			e := r.bans.ban(p.PeerID, d, p.Reason, time.Now())
+			r.Lock()
+			delete(r.peers, p.PeerID)
+			r.Unlock()
+			r.disconnect(p.PeerID)
+
+			return e, r.bans.save()
+		})
+
+	registerControlMethod("peers.unban", controlMethodDoc{
+		summary: "Lifts the ban of a peer.",
+		params:  &peerBanParams{}},
+		func(params json.RawMessage) (interface{}, error) {
+			var p peerBanParams
+			if err := decodeControlParams(params, &p); err != nil {
+				return nil, err
+			}
+			if !r.bans.unban(p.PeerID) {
+				return nil, newControlError(controlErrInvalidParams, "peer is not banned: "+p.PeerID)
+			}
+
+			return true, r.bans.save()
+		})
+}
+
+// parseBanParams validates the peer ID and returns the ban duration, zero
+// meaning permanent.
+func parseBanParams(p *peerBanParams) (time.Duration, error) {
+	if _, err := peer.IDB58Decode(p.PeerID); err != nil || p.PeerID == "" {
+		return 0, errors.New("invalid peer ID: " + p.PeerID)
+	}
+	if p.Reason == "" {
+		p.Reason = "manual"
+	}
+	if p.Duration == "" {
+		return 0, nil
+	}
+	d, err := time.ParseDuration(p.Duration)
+	if err != nil {
+		return 0, err
+	}
+	if d < 0 {
+		return 0, errors.New("ban duration must not be negative")
+	}
+
+	return d, nil
+}
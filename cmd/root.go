@@ -37,7 +37,24 @@ var rootCmd = &cobra.Command{
 	Use:     "lucky",
 	Short:   "The 'Lucky' example blockchain application",
 	Long: `Lucky is an example blockchain application that showcases the blocktop
-	blockchain development kit.`,
+	blockchain development kit.
+
+Every command prints its result as text, or with --output json or
+--output yaml as a document with a stable schema for scripts: lucky init
+prints the config file, peer ID, public key and addresses it created,
+lucky blockchain the P2P addresses it listens on, and the other commands
+the data they show. Failures are printed as a document with the error,
+exit code and a hint. Fields are only ever added to the documents.
+
+Commands that call a running node wait --timeout for an answer and repeat
+the call --retries times if the node cannot be reached or does not answer.
+They exit with status 3 if the node cannot be reached, 4 if it does not
+answer in time, 5 if it refuses the request and 6 if it fails to handle it.
+
+The RPC server of a node at --rpcport and its control server at
+--controlport speak JSON-RPC 2.0 at /rpc. Both accept batches, report
+errors with standard codes and data naming the method, and list their
+methods as an OpenRPC document with rpc.discover.`,
 	// Uncomment the following line if your bare application
 	// has an action associated with it:
 	//	Run: func(cmd *cobra.Command, args []string) { },
@@ -82,19 +99,24 @@ func initConfig() {
 
 	// If a config file is found, read it in.
 	if err := viper.ReadInConfig(); err == nil {
-		fmt.Println("Using config file:", viper.ConfigFileUsed())
+		fmt.Fprintln(progressOutput(), "Using config file:", viper.ConfigFileUsed())
 	}
 
 	viper.SetEnvPrefix("LUCKY_")
 
-	// make sure we are logging something to stderr
+	// make sure we are logging something to stderr, unless it is reserved
+	// for structured logs or logs go to a file. Then the blocktop libraries
+	// log to glog files instead.
 	flags := rootCmd.PersistentFlags()
-	if b, _ := flags.GetBool(glogcobra.LogToStdErr); !b {
+	if viper.GetString("log.format") == "json" || viper.GetString("log.file") != "" {
+		redirectGlog(flags)
+	} else if b, _ := flags.GetBool(glogcobra.LogToStdErr); !b {
 		if b, _ = flags.GetBool(glogcobra.AlsoLogToStdErr); !b {
 			flags.Set(glogcobra.AlsoLogToStdErr, "true")
 		}
 	}
 	glogcobra.Parse(rootCmd)
+	configureLogging()
 }
 
 func getHomeDir() string {
@@ -0,0 +1,266 @@
+// Copyright © 2018 J. Strobus White.
+// This file is part of the blocktop blockchain development kit.
+//
+// Blocktop is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// Blocktop is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with blocktop. If not, see <http://www.gnu.org/licenses/>.
+
+package cmd
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/spf13/viper"
+)
+
+// Exit codes of commands that fail calling the node. Other failures exit
+// with 1.
+const (
+	exitUnreachable = 3
+	exitTimeout     = 4
+	exitAuth        = 5
+	exitServerError = 6
+)
+
+const (
+	rpcErrUnreachable = iota + 1
+	rpcErrTimeout
+	rpcErrAuth
+	rpcErrServer
+)
+
+// rpcError is a failed call from the CLI to the RPC or control server of
+// a node at addr.
+type rpcError struct {
+	kind    int
+	server  string // "RPC" or "control"
+	addr    string
+	err     error
+	timeout time.Duration // if not the configured timeout
+}
+
+func (e *rpcError) Error() string {
+	switch e.kind {
+	case rpcErrUnreachable:
+		return fmt.Sprintf("cannot reach the %s server at %s: %v", e.server, e.addr, e.err)
+	case rpcErrTimeout:
+		timeout := e.timeout
+		if timeout == 0 {
+			timeout = rpcTimeout()
+		}
+		return fmt.Sprintf("the %s server at %s did not answer within %s", e.server, e.addr, timeout)
+	case rpcErrAuth:
+		return fmt.Sprintf("the %s server at %s refused the request: %v", e.server, e.addr, e.err)
+	}
+	return fmt.Sprintf("the %s server at %s failed: %v", e.server, e.addr, e.err)
+}
+
+// hint returns advice for the user on how to resolve e.
+func (e *rpcError) hint() string {
+	switch e.kind {
+	case rpcErrUnreachable:
+		flag := "--controlport"
+		if e.server == "RPC" {
+			flag = "--rpcport"
+		}
+		return "Is the node running? Start it with lucky blockchain. If it is running, check\n" +
+			"that " + flag + " matches the port it was started with."
+	case rpcErrTimeout:
+		return "The node may be busy or hung. Try again with a longer --timeout or with\n" +
+			"--retries, and check its log."
+	case rpcErrAuth:
+		return "Check the credentials for the node, or the proxy in front of it."
+	}
+	if cerr, ok := e.err.(*controlError); ok {
+		return cerr.hint()
+	}
+	return "The node may have logged details of the failure."
+}
+
+func (e *rpcError) exitCode() int {
+	switch e.kind {
+	case rpcErrUnreachable:
+		return exitUnreachable
+	case rpcErrTimeout:
+		return exitTimeout
+	case rpcErrAuth:
+		return exitAuth
+	}
+	return exitServerError
+}
+
+// retryable reports whether the call may succeed if it is repeated.
+func (e *rpcError) retryable() bool {
+	return e.kind == rpcErrUnreachable || e.kind == rpcErrTimeout
+}
+
+func init() {
+	rootCmd.PersistentFlags().Duration("timeout", 10*time.Second, "time to wait for the node to answer a call, 0 to wait forever")
+	rootCmd.PersistentFlags().Int("retries", 0, "times to repeat a call the node cannot be reached for or does not answer")
+	viper.BindPFlag("rpc.timeout", rootCmd.PersistentFlags().Lookup("timeout"))
+	viper.BindPFlag("rpc.retries", rootCmd.PersistentFlags().Lookup("retries"))
+
+	viper.SetDefault("rpc.timeout", 10*time.Second)
+	viper.SetDefault("rpc.retries", 0)
+}
+
+func rpcTimeout() time.Duration {
+	return viper.GetDuration("rpc.timeout")
+}
+
+func rpcAddr() string {
+	return fmt.Sprintf("%s:%d", viper.GetString("rpc.host"), viper.GetInt("rpc.port"))
+}
+
+// rpcURL returns the endpoint of the RPC server of the node.
+func rpcURL() string {
+	return "http://" + rpcAddr() + "/rpc"
+}
+
+// rpcHTTPClient returns a client for calls to the node that gives up after
+// the configured timeout.
+func rpcHTTPClient() *http.Client {
+	return &http.Client{Timeout: rpcTimeout()}
+}
+
+// postNodeRPC posts req, a request built with go-rpc-client, to the
+// blocktop RPC server at endpoint, e.g. http://localhost:28180/rpc, and
+// decodes the response into res. Unlike the functions of go-rpc-client
+// it can call any node, not only the one at --rpcport, and it returns the
+// errors of the RPC gateway with their code and data.
+func postNodeRPC(endpoint string, req interface{}, res interface{}) error {
+	reqb, err := json.Marshal(req)
+	if err != nil {
+		return err
+	}
+	addr := endpoint
+	if u, err := url.Parse(endpoint); err == nil && u.Host != "" {
+		addr = u.Host
+	}
+
+	return retryRPC("RPC", addr, func() error {
+		return postNodeRPCOnce(rpcHTTPClient(), endpoint, reqb, res)
+	})
+}
+
+// callNodeRPC calls method of lucky on the RPC server of the node, which
+// the gateway serves like the control server serves its methods.
+func callNodeRPC(method string, params interface{}, result interface{}) error {
+	var res controlResult
+	if err := postNodeRPC(rpcURL(), newControlCall(method, params), &res); err != nil {
+		return err
+	}
+	if err := res.decode(result); err != nil {
+		return classifyRPCError("RPC", rpcAddr(), err)
+	}
+	return nil
+}
+
+// postNodeRPCOnce is postNodeRPC without retries, using client.
+func postNodeRPCOnce(client *http.Client, endpoint string, reqb []byte, res interface{}) error {
+	httpRes, err := client.Post(endpoint, "application/json", bytes.NewReader(reqb))
+	if err != nil {
+		return err
+	}
+	defer httpRes.Body.Close()
+
+	body, err := ioutil.ReadAll(httpRes.Body)
+	if err != nil {
+		return err
+	}
+	if httpRes.StatusCode != http.StatusOK {
+		return &httpStatusError{code: httpRes.StatusCode, status: httpRes.Status}
+	}
+
+	var envelope struct {
+		Error json.RawMessage `json:"error"`
+	}
+	if err := json.Unmarshal(body, &envelope); err != nil {
+		return fmt.Errorf("invalid response: %v", err)
+	}
+	if len(envelope.Error) > 0 && string(envelope.Error) != "null" {
+		return rpcServerError(envelope.Error)
+	}
+	return json.Unmarshal(body, res)
+}
+
+// retryRPC runs call until it succeeds, fails with an error that is not
+// retryable or the configured retries are used up, waiting a little
+// longer before each retry. Errors are returned as rpcError.
+func retryRPC(server string, addr string, call func() error) error {
+	retries := viper.GetInt("rpc.retries")
+	for attempt := 0; ; attempt++ {
+		err := classifyRPCError(server, addr, call())
+		rerr, ok := err.(*rpcError)
+		if err == nil || !ok || !rerr.retryable() || attempt >= retries {
+			return err
+		}
+		rpcLog.WithError(err).Debugf("Retrying call to the %s server", server)
+		time.Sleep(time.Duration(attempt+1) * 500 * time.Millisecond)
+	}
+}
+
+// classifyRPCError wraps err in an rpcError describing the failure of a
+// call to the server at addr.
+func classifyRPCError(server string, addr string, err error) error {
+	switch e := err.(type) {
+	case nil:
+		return nil
+	case *rpcError:
+		return e
+	case *controlError:
+		return &rpcError{kind: rpcErrServer, server: server, addr: addr, err: e}
+	case *httpStatusError:
+		switch {
+		case e.code == http.StatusUnauthorized || e.code == http.StatusForbidden:
+			return &rpcError{kind: rpcErrAuth, server: server, addr: addr, err: e}
+		case e.code >= 500:
+			return &rpcError{kind: rpcErrServer, server: server, addr: addr, err: e}
+		}
+		return e
+	}
+
+	if err == context.DeadlineExceeded {
+		return &rpcError{kind: rpcErrTimeout, server: server, addr: addr, err: err}
+	}
+	if uerr, ok := err.(*url.Error); ok {
+		if uerr.Timeout() {
+			return &rpcError{kind: rpcErrTimeout, server: server, addr: addr, err: err}
+		}
+		err = uerr.Err
+	}
+	if oerr, ok := err.(*net.OpError); ok && oerr.Op == "dial" {
+		return &rpcError{kind: rpcErrUnreachable, server: server, addr: addr, err: oerr.Err}
+	}
+	if nerr, ok := err.(net.Error); ok && nerr.Timeout() {
+		return &rpcError{kind: rpcErrTimeout, server: server, addr: addr, err: err}
+	}
+	return &rpcError{kind: rpcErrServer, server: server, addr: addr, err: err}
+}
+
+// httpStatusError is an unexpected HTTP status from a server.
+type httpStatusError struct {
+	code   int
+	status string
+}
+
+func (e *httpStatusError) Error() string {
+	return "server replied " + e.status
+}
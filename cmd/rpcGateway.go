@@ -0,0 +1,243 @@
+// Copyright © 2018 J. Strobus White.
+// This file is part of the blocktop blockchain development kit.
+//
+// Blocktop is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// Blocktop is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with blocktop. If not, see <http://www.gnu.org/licenses/>.
+
+package cmd
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"time"
+
+	rpcconsensus "github.com/blocktop/go-rpc-client/consensus"
+	rpckernel "github.com/blocktop/go-rpc-client/kernel"
+	rpc "github.com/blocktop/go-rpc-server"
+	"github.com/spf13/viper"
+)
+
+// The RPC gateway serves the blocktop RPC server at /rpc on rpc.host and
+// rpc.port as JSON-RPC 2.0. It accepts batches and notifications, answers
+// rpc.discover, and reports errors with standard codes and structured
+// data, passing single requests on to go-rpc-server, which listens on
+// rpc.internalPort behind it. Methods of lucky itself that belong with
+// those of the blocktop RPC server, such as consensus.history, are served
+// by the gateway.
+
+// rpcGatewayTimeout is how long the gateway waits for go-rpc-server.
+const rpcGatewayTimeout = 30 * time.Second
+
+type rpcGateway struct {
+	backend string
+	client  *http.Client
+	docs    map[string]controlMethodDoc
+	methods map[string]*controlMethod
+}
+
+// rpcMethods are the methods of lucky served by the gateway. They must be
+// registered before the RPC server starts.
+var rpcMethods = make(map[string]*controlMethod)
+
+// registerRPCMethod registers the handler h of method name on the RPC
+// server, which rpc.discover describes with doc.
+func registerRPCMethod(name string, doc controlMethodDoc, h controlHandler) {
+	rpcMethods[name] = &controlMethod{doc: doc, handler: h}
+}
+
+func init() {
+	viper.SetDefault("rpc.host", "localhost")
+	viper.SetDefault("rpc.internalPort", 28182)
+}
+
+// startRPCServer starts go-rpc-server and the gateway in front of it,
+// which serves until ctx is done.
+func startRPCServer(ctx context.Context) {
+	public := viper.GetInt("rpc.port")
+	internal := viper.GetInt("rpc.internalPort")
+
+	// go-rpc-server reads the port it listens on from rpc.port when it
+	// starts. The public port is put back right away so that rpcAddr
+	// keeps pointing at the gateway.
+	viper.Set("rpc.port", internal)
+	rpc.Start()
+	viper.Set("rpc.port", public)
+
+	g := &rpcGateway{
+		backend: fmt.Sprintf("http://localhost:%d/rpc", internal),
+		client:  &http.Client{Timeout: rpcGatewayTimeout},
+		docs:    rpcServerMethodDocs(),
+		methods: rpcMethods}
+	for name, m := range g.methods {
+		g.docs[name] = m.doc
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/rpc", func(w http.ResponseWriter, r *http.Request) {
+		serveJSONRPC(w, r, g.handle)
+	})
+	srv := &http.Server{Addr: rpcAddr(), Handler: mux}
+
+	go func() {
+		err := srv.ListenAndServe()
+		if err != nil && err != http.ErrServerClosed {
+			rpcLog.WithError(err).Error("RPC gateway failed")
+		}
+	}()
+
+	go func() {
+		<-ctx.Done()
+		sctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		srv.Shutdown(sctx)
+	}()
+}
+
+// rpcServerMethodDocs describes the methods of go-rpc-server, whose names
+// are taken from the requests go-rpc-client builds.
+func rpcServerMethodDocs() map[string]controlMethodDoc {
+	kernelMetrics := (&rpckernel.GetMetricsRequest{}).GetMetrics(rpckernel.GetMetricsArgs{})
+	consensusMetrics := (&rpcconsensus.GetMetricsRequest{}).GetMetrics(rpcconsensus.GetMetricsArgs{})
+	consensusTree := (&rpcconsensus.GetTreeRequest{}).GetTree(rpcconsensus.GetTreeArgs{})
+
+	return map[string]controlMethodDoc{
+		kernelMetrics.Method: {
+			summary:    "The kernel metrics, as text or with format json as JSON.",
+			params:     &rpckernel.GetMetricsArgs{},
+			result:     &rpckernel.GetMetricsResult{},
+			positional: true},
+		consensusMetrics.Method: {
+			summary:    "The consensus metrics, as text or with format json as JSON.",
+			params:     &rpcconsensus.GetMetricsArgs{},
+			result:     &rpcconsensus.GetMetricsResult{},
+			positional: true},
+		consensusTree.Method: {
+			summary:    "The consensus tree, as text or with format json as JSON.",
+			params:     &rpcconsensus.GetTreeArgs{},
+			result:     &rpcconsensus.GetTreeResult{},
+			positional: true},
+		"rpc.discover": {
+			summary: "This OpenRPC document."}}
+}
+
+func (g *rpcGateway) handle(req *controlRequest) *controlResponse {
+	res := &controlResponse{JSONRPC: "2.0", ID: req.ID}
+	if req.Method == "rpc.discover" {
+		res.Result = openRPCDocument("blocktop RPC", g.docs)
+		return res
+	}
+	if m, ok := g.methods[req.Method]; ok {
+		return callControlMethod(m, req)
+	}
+
+	result, err := g.forward(req)
+	if err != nil {
+		if err.Data == nil {
+			err.Data = &controlErrorData{}
+		}
+		err.Data.Method = req.Method
+		if _, known := g.docs[req.Method]; !known {
+			names := make([]string, 0, len(g.docs))
+			for name := range g.docs {
+				names = append(names, name)
+			}
+			err.Code = controlErrMethodNotFound
+			err.Data.Suggestions = similarMethods(req.Method, names)
+		}
+		res.Error = err
+		return res
+	}
+	res.Result = result
+	return res
+}
+
+// forward passes req on to go-rpc-server. Notifications are sent with an
+// ID since go-rpc-server answers every request.
+func (g *rpcGateway) forward(req *controlRequest) (json.RawMessage, *controlError) {
+	fwd := *req
+	if len(fwd.ID) == 0 {
+		fwd.ID = json.RawMessage("0")
+	}
+	reqb, err := json.Marshal(&fwd)
+	if err != nil {
+		return nil, newControlError(controlErrInternal, err.Error())
+	}
+
+	httpRes, err := g.client.Post(g.backend, "application/json", bytes.NewReader(reqb))
+	if err != nil {
+		cerr := newControlError(controlErrInternal, "RPC server unavailable")
+		cerr.Data = &controlErrorData{Detail: err.Error()}
+		return nil, cerr
+	}
+	defer httpRes.Body.Close()
+
+	body, err := ioutil.ReadAll(httpRes.Body)
+	var res struct {
+		Result json.RawMessage `json:"result"`
+		Error  json.RawMessage `json:"error"`
+	}
+	if err == nil {
+		err = json.Unmarshal(body, &res)
+	}
+	if err != nil {
+		cerr := newControlError(controlErrInternal, "invalid response from the RPC server")
+		cerr.Data = &controlErrorData{Detail: fmt.Sprintf("%s: %s", httpRes.Status, strings.TrimSpace(string(body)))}
+		return nil, cerr
+	}
+
+	if len(res.Error) > 0 && string(res.Error) != "null" {
+		return nil, rpcServerError(res.Error)
+	}
+	if len(res.Result) == 0 {
+		res.Result = json.RawMessage("null")
+	}
+	return res.Result, nil
+}
+
+// rpcServerError turns an error of go-rpc-server, which is either a
+// message or a JSON-RPC error object, into a JSON-RPC 2.0 error.
+func rpcServerError(raw json.RawMessage) *controlError {
+	var obj struct {
+		Code    int             `json:"code"`
+		Message string          `json:"message"`
+		Data    json.RawMessage `json:"data"`
+	}
+	if json.Unmarshal(raw, &obj) == nil && obj.Message != "" {
+		code := obj.Code
+		if code == 0 {
+			code = controlErrInternal
+		}
+		cerr := newControlError(code, obj.Message)
+		if len(obj.Data) > 0 && string(obj.Data) != "null" {
+			cerr.Data = &controlErrorData{Detail: string(obj.Data)}
+		}
+		return cerr
+	}
+
+	var msg string
+	if json.Unmarshal(raw, &msg) != nil {
+		msg = string(raw)
+	}
+	code := controlErrInternal
+	if strings.Contains(msg, "can't find") {
+		code = controlErrMethodNotFound
+	}
+	cerr := newControlError(code, msg)
+	cerr.Data = &controlErrorData{Detail: msg}
+	return cerr
+}
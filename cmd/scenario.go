@@ -0,0 +1,209 @@
+// Copyright © 2018 J. Strobus White.
+// This file is part of the blocktop blockchain development kit.
+//
+// Blocktop is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// Blocktop is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with blocktop. If not, see <http://www.gnu.org/licenses/>.
+
+package cmd
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"time"
+
+	"github.com/spf13/cobra"
+	yaml "gopkg.in/yaml.v2"
+)
+
+// scenarioCmd represents the scenario command
+var scenarioCmd = &cobra.Command{
+	Use:   "scenario",
+	Short: "Runs scripted experiments against a local lucky network.",
+	Long: `Usage: lucky scenario [SUBCOMMAND] [OPTIONS]
+
+A scenario file describes a network of nodes, the faults to inject into it
+over time and the assertions the network must satisfy, for example:
+
+	name: partition-heal
+	nodes: 5
+	blockFrequency: 2
+	consensusTime: 30s
+	steps:
+	  - at: 30s
+	    partition: [[1, 2], [3, 4, 5]]
+	  - at: 90s
+	    heal: true
+	asserts:
+	  - by: 150s
+	    singleHead: true
+
+Steps can partition and heal the network, set faults on some or all nodes
+(faults: {nodes: [3], drop: 20, latency: 100ms, jitter: 50ms, duplicate: 5,
+reorder: 10}) and stop or start nodes (stop: [4], start: [4]). Nodes are
+numbered from 1.
+
+An assertion holds if its condition is met at any sample between from and
+by. From defaults to the time of the last step at or before by. Conditions
+are singleHead (all running nodes agree on the consensus head), minPeers
+and minHeight (of the consensus head on every running node).
+
+Nodes run as child processes. With inProcess: true, node 1 runs inside
+the lucky scenario process instead, for debugging or profiling it along
+with the scenario; it logs to the output of the command and cannot be
+stopped or started by steps.`,
+}
+
+func init() {
+	rootCmd.AddCommand(scenarioCmd)
+}
+
+type scenario struct {
+	Name           string                 `yaml:"name"`
+	Nodes          int                    `yaml:"nodes"`
+	BasePort       int                    `yaml:"basePort"`
+	BlockFrequency float64                `yaml:"blockFrequency"`
+	ConsensusTime  time.Duration          `yaml:"consensusTime"`
+	Duration       time.Duration          `yaml:"duration"`
+	SampleInterval time.Duration          `yaml:"sampleInterval"`
+	InProcess      bool                   `yaml:"inProcess"`
+	Config         map[string]interface{} `yaml:"config"`
+	Steps          []scenarioStep         `yaml:"steps"`
+	Asserts        []scenarioAssert       `yaml:"asserts"`
+}
+
+type scenarioStep struct {
+	At        time.Duration   `yaml:"at"`
+	Partition [][]int         `yaml:"partition"`
+	For       time.Duration   `yaml:"for"`
+	Heal      bool            `yaml:"heal"`
+	Faults    *scenarioFaults `yaml:"faults"`
+	Stop      []int           `yaml:"stop"`
+	Start     []int           `yaml:"start"`
+}
+
+type scenarioFaults struct {
+	Nodes     []int         `yaml:"nodes"`
+	Drop      float64       `yaml:"drop"`
+	Duplicate float64       `yaml:"duplicate"`
+	Reorder   float64       `yaml:"reorder"`
+	Latency   time.Duration `yaml:"latency"`
+	Jitter    time.Duration `yaml:"jitter"`
+}
+
+type scenarioAssert struct {
+	Name       string         `yaml:"name"`
+	From       *time.Duration `yaml:"from"`
+	By         time.Duration  `yaml:"by"`
+	SingleHead bool           `yaml:"singleHead"`
+	MinPeers   int            `yaml:"minPeers"`
+	MinHeight  uint64         `yaml:"minHeight"`
+}
+
+func (a *scenarioAssert) String() string {
+	if a.Name != "" {
+		return a.Name
+	}
+	s := ""
+	if a.SingleHead {
+		s += "single consensus head, "
+	}
+	if a.MinPeers > 0 {
+		s += fmt.Sprintf("at least %d peers, ", a.MinPeers)
+	}
+	if a.MinHeight > 0 {
+		s += fmt.Sprintf("head at height %d or above, ", a.MinHeight)
+	}
+	return fmt.Sprintf("%sby %v", s, a.By)
+}
+
+func loadScenario(file string) (*scenario, error) {
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+
+	s := &scenario{
+		Nodes:          3,
+		BasePort:       30000,
+		SampleInterval: time.Second}
+	if err = yaml.UnmarshalStrict(data, s); err != nil {
+		return nil, err
+	}
+	if s.Name == "" {
+		s.Name = "scenario"
+	}
+
+	checkNodes := func(nodes []int) error {
+		for _, i := range nodes {
+			if i < 1 || i > s.Nodes {
+				return fmt.Errorf("no node %d in a scenario of %d nodes", i, s.Nodes)
+			}
+		}
+		return nil
+	}
+
+	end := time.Duration(0)
+	for i := range s.Steps {
+		st := &s.Steps[i]
+		for _, g := range st.Partition {
+			if err = checkNodes(g); err != nil {
+				return nil, err
+			}
+		}
+		if st.Faults != nil {
+			if err = checkNodes(st.Faults.Nodes); err != nil {
+				return nil, err
+			}
+		}
+		if err = checkNodes(append(st.Stop, st.Start...)); err != nil {
+			return nil, err
+		}
+		if s.InProcess {
+			for _, i := range append(st.Stop, st.Start...) {
+				if i == 1 {
+					return nil, errors.New("node 1 runs in process with inProcess and cannot be stopped or started")
+				}
+			}
+		}
+		if st.At > end {
+			end = st.At
+		}
+	}
+	for i := range s.Asserts {
+		a := &s.Asserts[i]
+		if a.By <= 0 {
+			return nil, errors.New("assertion needs a positive by time: " + a.String())
+		}
+		if !a.SingleHead && a.MinPeers == 0 && a.MinHeight == 0 {
+			return nil, errors.New("assertion has no condition: " + a.String())
+		}
+		if a.From == nil {
+			from := time.Duration(0)
+			for _, st := range s.Steps {
+				if st.At <= a.By && st.At > from {
+					from = st.At
+				}
+			}
+			a.From = &from
+		}
+		if a.By > end {
+			end = a.By
+		}
+	}
+	if s.Duration == 0 {
+		s.Duration = end + s.SampleInterval
+	}
+
+	return s, nil
+}
@@ -0,0 +1,404 @@
+// Copyright © 2018 J. Strobus White.
+// This file is part of the blocktop blockchain development kit.
+//
+// Blocktop is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// Blocktop is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with blocktop. If not, see <http://www.gnu.org/licenses/>.
+
+package cmd
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"os/signal"
+	"path"
+	"sort"
+	"strconv"
+	"syscall"
+	"time"
+
+	"github.com/spf13/cobra"
+)
+
+// scenarioRunCmd represents the scenario run command
+var scenarioRunCmd = &cobra.Command{
+	Use:   "run <file>",
+	Short: "Runs a scenario file and reports whether its assertions hold.",
+	Long: `Usage: lucky scenario run <file> [OPTIONS]
+
+Starts the scenario's nodes on the loopback interface, as child processes
+except for node 1 with inProcess, executes its steps and samples the
+kernel and consensus metrics of every node. The output directory receives
+the node configs and logs, the samples in timeseries.csv and the
+pass/fail report in report.txt. The command exits non-zero if an
+assertion fails.`,
+	Args: cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		s, err := loadScenario(args[0])
+		if err != nil {
+			failWithError(err)
+		}
+
+		out := scenarioOut
+		if out == "" {
+			out = fmt.Sprintf("scenario-%s-%s", s.Name, time.Now().Format("20060102-150405"))
+		}
+		makeDirAll(out)
+
+		r, err := newScenarioRun(s, out)
+		if err != nil {
+			failWithError(err)
+		}
+		passed, err := r.run()
+		if err != nil {
+			failWithError(err)
+		}
+		if !passed {
+			exit(1)
+		}
+	},
+}
+
+var scenarioOut string
+
+func init() {
+	scenarioCmd.AddCommand(scenarioRunCmd)
+
+	scenarioRunCmd.Flags().StringVarP(&scenarioOut, "out", "o", "", `output directory (default is
+scenario-<name>-<time> in the current directory)`)
+}
+
+// nodeSample is what a sample records of one node.
+type nodeSample struct {
+	head    *treeBlock
+	peers   int
+	metrics map[string]float64
+}
+
+type assertResult struct {
+	assert *scenarioAssert
+	passed bool
+	at     time.Duration
+}
+
+type scenarioRun struct {
+	s       *scenario
+	out     string
+	net     *devnet
+	faults  map[int]*faultConfig
+	csv     *csv.Writer
+	csvFile *os.File
+	results []*assertResult
+}
+
+func newScenarioRun(s *scenario, out string) (*scenarioRun, error) {
+	net, err := newDevnet(path.Join(out, "nodes"), &devnetConfig{
+		Nodes:          s.Nodes,
+		BasePort:       s.BasePort,
+		BlockFrequency: s.BlockFrequency,
+		ConsensusTime:  s.ConsensusTime,
+		Settings:       s.Config,
+		InProcess:      s.InProcess})
+	if err != nil {
+		return nil, err
+	}
+
+	r := &scenarioRun{s: s, out: out, net: net, faults: make(map[int]*faultConfig)}
+	for _, n := range net.nodes {
+		r.faults[n.index] = &faultConfig{}
+	}
+	for i := range s.Asserts {
+		r.results = append(r.results, &assertResult{assert: &s.Asserts[i]})
+	}
+
+	return r, nil
+}
+
+// run executes the scenario and writes the report. It returns whether all
+// assertions passed. The nodes are stopped before it returns.
+func (r *scenarioRun) run() (bool, error) {
+	f, err := os.Create(path.Join(r.out, "timeseries.csv"))
+	if err != nil {
+		return false, err
+	}
+	r.csvFile = f
+	r.csv = csv.NewWriter(f)
+	r.csv.Write([]string{"time", "node", "metric", "value"})
+
+	fmt.Fprintf(progressOutput(), "Starting %d nodes in %s\n", len(r.net.nodes), r.out)
+	if err = r.net.start(); err != nil {
+		f.Close()
+		return false, err
+	}
+	defer r.net.stop()
+
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, syscall.SIGINT, syscall.SIGTERM)
+	defer signal.Stop(sig)
+
+	steps := make([]scenarioStep, len(r.s.Steps))
+	copy(steps, r.s.Steps)
+	sort.SliceStable(steps, func(i, j int) bool { return steps[i].At < steps[j].At })
+
+	ticker := time.NewTicker(r.s.SampleInterval)
+	defer ticker.Stop()
+
+	start := time.Now()
+	interrupted := false
+	for elapsed := time.Duration(0); elapsed <= r.s.Duration && !interrupted; elapsed = time.Since(start) {
+		for len(steps) > 0 && steps[0].At <= elapsed {
+			r.step(&steps[0], elapsed)
+			steps = steps[1:]
+		}
+		r.check(elapsed, r.sample(elapsed))
+
+		select {
+		case <-ticker.C:
+		case <-sig:
+			interrupted = true
+		}
+	}
+
+	r.csv.Flush()
+	f.Close()
+
+	return r.report(interrupted)
+}
+
+func (r *scenarioRun) step(st *scenarioStep, elapsed time.Duration) {
+	logf := func(format string, args ...interface{}) {
+		fmt.Fprintf(progressOutput(), "[%6.1fs] %s\n", elapsed.Seconds(), fmt.Sprintf(format, args...))
+	}
+	touched := make(map[int]bool)
+
+	for _, i := range st.Stop {
+		n, _ := r.net.node(i)
+		logf("stopping node %d", i)
+		n.stop()
+	}
+	for _, i := range st.Start {
+		n, _ := r.net.node(i)
+		logf("starting node %d", i)
+		if err := n.start(); err != nil {
+			logf("%v", err)
+		}
+		touched[i] = true
+	}
+
+	if st.Heal {
+		logf("healing partition")
+		for i, fc := range r.faults {
+			fc.Partition = nil
+			fc.PartitionFor = 0
+			touched[i] = true
+		}
+	}
+	if len(st.Partition) > 0 {
+		groups := make([][]string, len(st.Partition))
+		for g, members := range st.Partition {
+			for _, i := range members {
+				n, _ := r.net.node(i)
+				groups[g] = append(groups[g], n.peerID)
+			}
+		}
+		logf("partitioning nodes %v", st.Partition)
+		for i, fc := range r.faults {
+			fc.Partition = groups
+			fc.PartitionFor = faultDuration(st.For)
+			touched[i] = true
+		}
+	}
+	if sf := st.Faults; sf != nil {
+		nodes := sf.Nodes
+		if len(nodes) == 0 {
+			for i := range r.faults {
+				nodes = append(nodes, i)
+			}
+		}
+		logf("setting faults on nodes %v", nodes)
+		for _, i := range nodes {
+			fc := r.faults[i]
+			fc.Drop, fc.Duplicate, fc.Reorder = sf.Drop, sf.Duplicate, sf.Reorder
+			fc.Latency, fc.Jitter = faultDuration(sf.Latency), faultDuration(sf.Jitter)
+			touched[i] = true
+		}
+	}
+
+	for i := range touched {
+		n, _ := r.net.node(i)
+		if !n.running() {
+			continue
+		}
+		if err := callControlAt(n.controlAddr(), "faults.set", r.faults[i], nil); err != nil {
+			logf("failed to set faults on node %d: %v", i, err)
+		}
+	}
+}
+
+// sample records the metrics of every running node.
+func (r *scenarioRun) sample(elapsed time.Duration) map[int]*nodeSample {
+	samples := make(map[int]*nodeSample)
+	t := strconv.FormatFloat(elapsed.Seconds(), 'f', 3, 64)
+
+	for _, n := range r.net.nodes {
+		if !n.running() {
+			continue
+		}
+		addr := n.controlAddr()
+		ns := &nodeSample{metrics: make(map[string]float64)}
+
+		for _, m := range []string{"kernel.metrics", "consensus.metrics"} {
+			var raw json.RawMessage
+			if callControlAt(addr, m, &metricsParams{Format: "json"}, &raw) != nil {
+				continue
+			}
+			var v interface{}
+			if json.Unmarshal(raw, &v) == nil {
+				flattenMetrics(m[:len(m)-len(".metrics")], v, ns.metrics)
+			}
+		}
+		var peers []peerStatus
+		if callControlAt(addr, "peers.list", nil, &peers) == nil {
+			ns.peers = len(peers)
+			ns.metrics["peers"] = float64(ns.peers)
+		}
+		if tree, err := fetchConsensusTree(addr); err == nil {
+			ns.head = tree.head()
+			if ns.head != nil {
+				ns.metrics["head.number"] = float64(ns.head.Number)
+			}
+		}
+
+		keys := make([]string, 0, len(ns.metrics))
+		for k := range ns.metrics {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		for _, k := range keys {
+			r.csv.Write([]string{t, strconv.Itoa(n.index), k, strconv.FormatFloat(ns.metrics[k], 'g', -1, 64)})
+		}
+		samples[n.index] = ns
+	}
+	r.csv.Flush()
+
+	return samples
+}
+
+func (r *scenarioRun) check(elapsed time.Duration, samples map[int]*nodeSample) {
+	for _, res := range r.results {
+		a := res.assert
+		if res.passed || elapsed < *a.From || elapsed > a.By {
+			continue
+		}
+		if len(samples) > 0 && assertHolds(a, samples) {
+			res.passed = true
+			res.at = elapsed
+			fmt.Fprintf(progressOutput(), "[%6.1fs] assertion met: %s\n", elapsed.Seconds(), a)
+		}
+	}
+}
+
+func assertHolds(a *scenarioAssert, samples map[int]*nodeSample) bool {
+	head := ""
+	for _, ns := range samples {
+		if a.MinPeers > 0 && ns.peers < a.MinPeers {
+			return false
+		}
+		if a.MinHeight > 0 && (ns.head == nil || ns.head.Number < a.MinHeight) {
+			return false
+		}
+		if a.SingleHead {
+			if ns.head == nil || (head != "" && ns.head.Hash != head) {
+				return false
+			}
+			head = ns.head.Hash
+		}
+	}
+	return true
+}
+
+func (r *scenarioRun) report(interrupted bool) (bool, error) {
+	f, err := os.Create(path.Join(r.out, "report.txt"))
+	if err != nil {
+		return false, err
+	}
+	defer f.Close()
+	w := io.Writer(f)
+	if !structuredOutput() {
+		w = io.MultiWriter(os.Stdout, f)
+	}
+
+	fmt.Fprintf(w, "\nScenario %s: %d nodes, %v\n", r.s.Name, r.s.Nodes, r.s.Duration)
+	passed := !interrupted
+	for _, res := range r.results {
+		if res.passed {
+			fmt.Fprintf(w, "PASS  %s (met at %.1fs)\n", res.assert, res.at.Seconds())
+		} else {
+			fmt.Fprintf(w, "FAIL  %s\n", res.assert)
+			passed = false
+		}
+	}
+	if interrupted {
+		fmt.Fprintln(w, "Scenario interrupted")
+	}
+	if passed {
+		fmt.Fprintln(w, "Result: PASS")
+	} else {
+		fmt.Fprintln(w, "Result: FAIL")
+	}
+
+	if structuredOutput() {
+		printResult(r.newReport(interrupted, passed), nil)
+	}
+	return passed, nil
+}
+
+// scenarioReport is the output of lucky scenario run. MetAt is when an
+// assertion was met, in seconds since the start.
+type scenarioReport struct {
+	Scenario    string              `json:"scenario"`
+	Nodes       int                 `json:"nodes"`
+	Duration    string              `json:"duration"`
+	Dir         string              `json:"dir"`
+	Interrupted bool                `json:"interrupted"`
+	Passed      bool                `json:"passed"`
+	Asserts     []scenarioAssertion `json:"asserts"`
+}
+
+type scenarioAssertion struct {
+	Assert string   `json:"assert"`
+	Passed bool     `json:"passed"`
+	MetAt  *float64 `json:"metAt,omitempty"`
+}
+
+func (r *scenarioRun) newReport(interrupted bool, passed bool) *scenarioReport {
+	rep := &scenarioReport{
+		Scenario:    r.s.Name,
+		Nodes:       r.s.Nodes,
+		Duration:    r.s.Duration.String(),
+		Dir:         r.out,
+		Interrupted: interrupted,
+		Passed:      passed,
+		Asserts:     make([]scenarioAssertion, 0, len(r.results))}
+	for _, res := range r.results {
+		a := scenarioAssertion{Assert: fmt.Sprint(res.assert), Passed: res.passed}
+		if res.passed {
+			at := res.at.Seconds()
+			a.MetAt = &at
+		}
+		rep.Asserts = append(rep.Asserts, a)
+	}
+	return rep
+}
@@ -0,0 +1,111 @@
+// Copyright © 2018 J. Strobus White.
+// This file is part of the blocktop blockchain development kit.
+//
+// Blocktop is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// Blocktop is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with blocktop. If not, see <http://www.gnu.org/licenses/>.
+
+package cmd
+
+import (
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestLoadScenario(t *testing.T) {
+	tests := []struct {
+		name  string
+		yaml  string
+		err   string
+		check func(t *testing.T, s *scenario)
+	}{
+		{name: "defaults",
+			yaml: "asserts:\n- by: 30s\n  singleHead: true\n",
+			check: func(t *testing.T, s *scenario) {
+				if s.Name != "scenario" || s.Nodes != 3 || s.BasePort != 30000 || s.SampleInterval != time.Second {
+					t.Errorf("defaults not applied: %+v", s)
+				}
+				if s.Duration != 31*time.Second {
+					t.Errorf("duration = %v, want 31s", s.Duration)
+				}
+			}},
+		{name: "assertion from last step",
+			yaml: `nodes: 4
+steps:
+- at: 10s
+  partition: [[1, 2], [3, 4]]
+- at: 40s
+  heal: true
+- at: 90s
+  stop: [2]
+asserts:
+- by: 60s
+  singleHead: true
+- by: 5s
+  minPeers: 1
+- from: 0s
+  by: 120s
+  minHeight: 3
+`,
+			check: func(t *testing.T, s *scenario) {
+				want := []time.Duration{40 * time.Second, 0, 0}
+				for i, a := range s.Asserts {
+					if *a.From != want[i] {
+						t.Errorf("assertion %d from = %v, want %v", i, *a.From, want[i])
+					}
+				}
+				if s.Duration != 121*time.Second {
+					t.Errorf("duration = %v, want 121s", s.Duration)
+				}
+			}},
+		{name: "duration given",
+			yaml: "duration: 5m\nsteps:\n- at: 10s\n  stop: [3]\n",
+			check: func(t *testing.T, s *scenario) {
+				if s.Duration != 5*time.Minute {
+					t.Errorf("duration = %v, want 5m", s.Duration)
+				}
+			}},
+		{name: "unknown field", yaml: "nodez: 3\n", err: "nodez"},
+		{name: "partition of unknown node", yaml: "steps:\n- at: 1s\n  partition: [[1], [4]]\n", err: "no node 4"},
+		{name: "faults of node 0", yaml: "steps:\n- at: 1s\n  faults:\n    nodes: [0]\n", err: "no node 0"},
+		{name: "start unknown node", yaml: "nodes: 2\nsteps:\n- at: 1s\n  start: [3]\n", err: "no node 3"},
+		{name: "stop node 1 in process", yaml: "inProcess: true\nsteps:\n- at: 1s\n  stop: [1]\n", err: "in process"},
+		{name: "assertion without by", yaml: "asserts:\n- singleHead: true\n", err: "positive by"},
+		{name: "assertion without condition", yaml: "asserts:\n- by: 10s\n", err: "no condition"},
+	}
+
+	dir := t.TempDir()
+	for i, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			file := filepath.Join(dir, fmt.Sprintf("%d.yaml", i))
+			if err := ioutil.WriteFile(file, []byte(tt.yaml), 0644); err != nil {
+				t.Fatal(err)
+			}
+
+			s, err := loadScenario(file)
+			if tt.err != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.err) {
+					t.Fatalf("error = %v, want one containing %q", err, tt.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			tt.check(t, s)
+		})
+	}
+}
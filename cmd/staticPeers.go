@@ -0,0 +1,129 @@
+// Copyright © 2018 J. Strobus White.
+// This file is part of the blocktop blockchain development kit.
+//
+// Blocktop is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// Blocktop is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with blocktop. If not, see <http://www.gnu.org/licenses/>.
+
+package cmd
+
+import (
+	"context"
+	"time"
+
+	p2p "github.com/blocktop/go-network-libp2p"
+
+	inet "github.com/libp2p/go-libp2p-net"
+	peer "github.com/libp2p/go-libp2p-peer"
+	pstore "github.com/libp2p/go-libp2p-peerstore"
+	ma "github.com/multiformats/go-multiaddr"
+	"github.com/spf13/viper"
+)
+
+// staticPeers keeps the node connected to the peers listed in
+// node.staticPeers. It works independently of the bootstrapper: static
+// peers are redialed whenever they drop, no matter how many other peers
+// the node has.
+type staticPeers struct {
+	node     *p2p.NetworkNode
+	peers    map[peer.ID]pstore.PeerInfo
+	dropped  chan peer.ID
+	interval time.Duration
+}
+
+func buildStaticPeers(node *p2p.NetworkNode) (*staticPeers, error) {
+	s := &staticPeers{
+		node:     node,
+		peers:    make(map[peer.ID]pstore.PeerInfo),
+		dropped:  make(chan peer.ID, 16),
+		interval: time.Duration(viper.GetInt("node.redialInterval")) * time.Second}
+
+	for _, a := range viper.GetStringSlice("node.staticPeers") {
+		addr, err := ma.NewMultiaddr(a)
+		if err != nil {
+			return nil, err
+		}
+		pi, err := pstore.InfoFromP2pAddr(addr)
+		if err != nil {
+			return nil, err
+		}
+		node.Host.Peerstore().AddAddrs(pi.ID, pi.Addrs, pstore.PermanentAddrTTL)
+		s.peers[pi.ID] = *pi
+		setPeerOrigin(pi.ID.Pretty(), "static")
+	}
+
+	return s, nil
+}
+
+// ids returns the peer IDs of the static peers.
+func (s *staticPeers) ids() []string {
+	ids := make([]string, 0, len(s.peers))
+	for id := range s.peers {
+		ids = append(ids, id.Pretty())
+	}
+	return ids
+}
+
+// start connects to all static peers and keeps redialing them until ctx
+// is done.
+func (s *staticPeers) start(ctx context.Context) {
+	if len(s.peers) == 0 {
+		return
+	}
+
+	s.node.Host.Network().Notify(&inet.NotifyBundle{
+		DisconnectedF: func(n inet.Network, c inet.Conn) {
+			id := c.RemotePeer()
+			if _, ok := s.peers[id]; !ok || n.Connectedness(id) == inet.Connected {
+				return
+			}
+			select {
+			case s.dropped <- id:
+			default:
+			}
+		}})
+
+	go func() {
+		ticker := time.NewTicker(s.interval)
+		defer ticker.Stop()
+
+		s.dialAll(ctx)
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case id := <-s.dropped:
+				p2pLog.WithField(logFieldPeer, id.Pretty()).Info("Static peer disconnected, redialing")
+				s.dial(ctx, s.peers[id])
+			case <-ticker.C:
+				s.dialAll(ctx)
+			}
+		}
+	}()
+}
+
+func (s *staticPeers) dialAll(ctx context.Context) {
+	for id, pi := range s.peers {
+		if s.node.Host.Network().Connectedness(id) != inet.Connected {
+			s.dial(ctx, pi)
+		}
+	}
+}
+
+func (s *staticPeers) dial(ctx context.Context, pi pstore.PeerInfo) {
+	dctx, cancel := context.WithTimeout(ctx, s.interval)
+	defer cancel()
+
+	if err := s.node.Host.Connect(dctx, pi); err != nil {
+		p2pLog.WithField(logFieldPeer, pi.ID.Pretty()).WithError(err).Debug("Failed to connect to static peer")
+	}
+}
@@ -0,0 +1,410 @@
+// Copyright © 2018 J. Strobus White.
+// This file is part of the blocktop blockchain development kit.
+//
+// Blocktop is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// Blocktop is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with blocktop. If not, see <http://www.gnu.org/licenses/>.
+
+package cmd
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"os"
+	"path"
+	"sync"
+	"time"
+
+	spec "github.com/blocktop/go-spec"
+
+	"github.com/spf13/viper"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/exporters/stdout/stdouttrace"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/trace"
+	"go.opentelemetry.io/otel/trace/noop"
+)
+
+const (
+	tracingNone = "none"
+	tracingOTLP = "otlp"
+	tracingFile = "file"
+)
+
+// traceEnvelopeMagic starts block gossip data that carries trace context.
+// The envelope is the magic, a big endian uint16 header length, the W3C
+// trace context headers as a JSON object and the original data.
+var traceEnvelopeMagic = []byte("LKT1")
+
+// lifecycleTracer follows each block through generation, broadcast,
+// receipt, consensus evaluation and confirmation with OpenTelemetry spans. Every block gets a
+// "block" span, keyed by block hash, that ends when the block is confirmed
+// or pruned from the consensus tree. A block received from a peer that
+// propagates trace context continues the trace of the peer's broadcast.
+//
+// The tracer always strips trace envelopes from received messages, so
+// nodes that do not trace can still talk to nodes that propagate.
+type lifecycleTracer struct {
+	sync.Mutex
+	enabled    bool
+	propagate  bool
+	tracer     trace.Tracer
+	provider   *sdktrace.TracerProvider
+	propagator propagation.TextMapPropagator
+	blocks     map[string]*tracedBlock
+	maxAge     time.Duration
+}
+
+type tracedBlock struct {
+	ctx     context.Context
+	span    trace.Span
+	started time.Time
+}
+
+// blockGenerating is implemented by block generators that generate blocks
+// on top of a branch of the consensus tree.
+type blockGenerating interface {
+	GenerateBlock(branch []spec.Block, rootID int) spec.Block
+}
+
+// tracedGenerator wraps the block generator with a block.generate span.
+type tracedGenerator struct {
+	spec.BlockGenerator
+	tracer *lifecycleTracer
+}
+
+func init() {
+	viper.SetDefault("diagnostics.tracing.exporter", tracingNone)
+	viper.SetDefault("diagnostics.tracing.endpoint", "localhost:4318")
+	viper.SetDefault("diagnostics.tracing.insecure", true)
+	viper.SetDefault("diagnostics.tracing.file", "")
+	viper.SetDefault("diagnostics.tracing.sampleRatio", 1.0)
+	viper.SetDefault("diagnostics.tracing.propagate", false)
+}
+
+func buildLifecycleTracer(peerID string) (*lifecycleTracer, error) {
+	t := &lifecycleTracer{
+		tracer:     noop.NewTracerProvider().Tracer("lucky"),
+		propagator: propagation.TraceContext{},
+		blocks:     make(map[string]*tracedBlock),
+		maxAge:     2*viper.GetDuration("blockchain.consensus.time") + time.Minute}
+
+	exporter, err := newSpanExporter(viper.GetString("diagnostics.tracing.exporter"))
+	if err != nil {
+		return nil, err
+	}
+	if exporter == nil {
+		return t, nil
+	}
+
+	res := resource.NewSchemaless(
+		attribute.String("service.name", "lucky"),
+		attribute.String("service.instance.id", peerID),
+		attribute.String("blockchain.name", viper.GetString("blockchain.name")))
+	sampler := sdktrace.ParentBased(sdktrace.TraceIDRatioBased(viper.GetFloat64("diagnostics.tracing.sampleRatio")))
+
+	t.provider = sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithResource(res),
+		sdktrace.WithSampler(sampler))
+	t.tracer = t.provider.Tracer("lucky")
+	t.enabled = true
+	t.propagate = viper.GetBool("diagnostics.tracing.propagate")
+
+	return t, nil
+}
+
+func newSpanExporter(kind string) (sdktrace.SpanExporter, error) {
+	switch kind {
+	case "", tracingNone:
+		return nil, nil
+	case tracingOTLP:
+		opts := []otlptracehttp.Option{otlptracehttp.WithEndpoint(viper.GetString("diagnostics.tracing.endpoint"))}
+		if viper.GetBool("diagnostics.tracing.insecure") {
+			opts = append(opts, otlptracehttp.WithInsecure())
+		}
+		return otlptracehttp.New(context.Background(), opts...)
+	case tracingFile:
+		file := viper.GetString("diagnostics.tracing.file")
+		if file == "" {
+			file = path.Join(dataDir(), "traces.json")
+		}
+		f, err := os.OpenFile(file, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+		if err != nil {
+			return nil, err
+		}
+		return stdouttrace.New(stdouttrace.WithWriter(f))
+	}
+	return nil, errors.New("unknown tracing exporter: " + kind)
+}
+
+// observe ends block spans as the fork history sees blocks confirmed or
+// pruned, and ends spans of blocks that were never seen to leave the
+// consensus tree once they are older than maxAge.
+func (t *lifecycleTracer) observe(ctx context.Context, history *forkHistory) {
+	if !t.enabled {
+		return
+	}
+	history.subscribe(t.forkEvent)
+
+	go func() {
+		ticker := time.NewTicker(time.Minute)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case now := <-ticker.C:
+				t.Lock()
+				for hash, b := range t.blocks {
+					if now.Sub(b.started) > t.maxAge {
+						t.end(hash, "untracked")
+					}
+				}
+				t.Unlock()
+			}
+		}
+	}()
+}
+
+// shutdown ends all open block spans and flushes the exporter.
+func (t *lifecycleTracer) shutdown(ctx context.Context) {
+	if !t.enabled {
+		return
+	}
+
+	t.Lock()
+	for hash := range t.blocks {
+		t.end(hash, "shutdown")
+	}
+	t.Unlock()
+
+	if err := t.provider.Shutdown(ctx); err != nil {
+		diagLog.WithError(err).Error("Failed to flush traces")
+	}
+}
+
+func (t *lifecycleTracer) forkEvent(e forkEvent) {
+	t.Lock()
+	defer t.Unlock()
+
+	b, ok := t.blocks[e.Hash]
+	if !ok {
+		return
+	}
+	b.span.SetAttributes(attribute.Int64("block.number", int64(e.Number)))
+
+	switch e.Type {
+	case forkBlockConfirmed:
+		t.end(e.Hash, "confirmed")
+	case forkBranchPruned:
+		t.end(e.Hash, "pruned")
+	case forkHeadChanged:
+		b.span.AddEvent("consensus.head", trace.WithAttributes(attribute.Int("reorg.depth", e.Depth)))
+	}
+}
+
+// block returns the span of the block with hash, starting it at start as a
+// child of parent if the block is new. The caller must hold the lock.
+func (t *lifecycleTracer) block(hash string, parent context.Context, origin string, start time.Time) *tracedBlock {
+	if b, ok := t.blocks[hash]; ok {
+		return b
+	}
+
+	ctx, span := t.tracer.Start(parent, "block", trace.WithTimestamp(start), trace.WithAttributes(
+		attribute.String("block.hash", hash),
+		attribute.String("block.origin", origin)))
+	b := &tracedBlock{ctx: ctx, span: span, started: start}
+	t.blocks[hash] = b
+	return b
+}
+
+// end ends the span of the block with hash. The caller must hold the lock.
+func (t *lifecycleTracer) end(hash string, outcome string) {
+	b, ok := t.blocks[hash]
+	if !ok {
+		return
+	}
+	b.span.SetAttributes(attribute.String("block.outcome", outcome))
+	b.span.End()
+	delete(t.blocks, hash)
+}
+
+func (t *lifecycleTracer) inbound(msg *spec.NetworkMessage, next gossipHandler) {
+	if data, carrier, ok := openTraceEnvelope(msg.Data); ok {
+		m := *msg
+		m.Data = data
+		msg = &m
+
+		if !t.enabled {
+			next(msg)
+			return
+		}
+		t.receive(msg, t.propagator.Extract(context.Background(), propagation.MapCarrier(carrier)), next)
+		return
+	}
+
+	if !t.enabled {
+		next(msg)
+		return
+	}
+	t.receive(msg, context.Background(), next)
+}
+
+func (t *lifecycleTracer) receive(msg *spec.NetworkMessage, parent context.Context, next gossipHandler) {
+	t.Lock()
+	b := t.block(msg.Hash, parent, "received", time.Now())
+	t.Unlock()
+
+	_, span := t.tracer.Start(b.ctx, "block.receive", trace.WithSpanKind(trace.SpanKindConsumer),
+		trace.WithAttributes(
+			attribute.String("peer.id", msg.From),
+			attribute.String("net.protocol", protocolName(msg))))
+	next(msg)
+	span.End()
+}
+
+func (t *lifecycleTracer) outbound(msg *spec.NetworkMessage, next gossipHandler) {
+	if !t.enabled {
+		next(msg)
+		return
+	}
+
+	t.Lock()
+	b := t.block(msg.Hash, context.Background(), "local", time.Now())
+	t.Unlock()
+
+	ctx, span := t.tracer.Start(b.ctx, "block.broadcast", trace.WithSpanKind(trace.SpanKindProducer),
+		trace.WithAttributes(attribute.String("net.protocol", protocolName(msg))))
+	if t.propagate {
+		carrier := propagation.MapCarrier{}
+		t.propagator.Inject(ctx, carrier)
+		m := *msg
+		m.Data = sealTraceEnvelope(carrier, msg.Data)
+		msg = &m
+	}
+	next(msg)
+	span.End()
+}
+
+// generator wraps the block generator so that locally generated blocks
+// start their block span with a block.generate span.
+func (t *lifecycleTracer) generator(bg spec.BlockGenerator) spec.BlockGenerator {
+	if !t.enabled {
+		return bg
+	}
+	if _, ok := bg.(blockGenerating); !ok {
+		return bg
+	}
+	return &tracedGenerator{BlockGenerator: bg, tracer: t}
+}
+
+// GenerateBlock generates a block and records how long it took. The block
+// hash is only known afterwards, so the spans are started back in time.
+func (g *tracedGenerator) GenerateBlock(branch []spec.Block, rootID int) spec.Block {
+	start := time.Now()
+	block := g.BlockGenerator.(blockGenerating).GenerateBlock(branch, rootID)
+	if block == nil {
+		return nil
+	}
+
+	t := g.tracer
+	t.Lock()
+	b := t.block(block.Hash(), context.Background(), "local", start)
+	t.Unlock()
+
+	_, span := t.tracer.Start(b.ctx, "block.generate", trace.WithTimestamp(start), trace.WithAttributes(
+		attribute.Int64("block.number", int64(block.BlockNumber())),
+		attribute.Int("branch.length", len(branch))))
+	span.End()
+	return block
+}
+
+// comparator wraps the consensus block comparator with a
+// consensus.evaluate span linked to the spans of the compared blocks.
+func (t *lifecycleTracer) comparator(compare spec.BlockComparator) spec.BlockComparator {
+	if !t.enabled {
+		return compare
+	}
+
+	return func(blocks []spec.Block) spec.Block {
+		t.Lock()
+		links := make([]trace.Link, 0, len(blocks))
+		for _, b := range blocks {
+			if tb, ok := t.blocks[b.Hash()]; ok {
+				links = append(links, trace.Link{SpanContext: tb.span.SpanContext()})
+			}
+		}
+		t.Unlock()
+
+		_, span := t.tracer.Start(context.Background(), "consensus.evaluate",
+			trace.WithLinks(links...),
+			trace.WithAttributes(attribute.Int("consensus.candidates", len(blocks))))
+		winner := compare(blocks)
+		if winner == nil {
+			span.SetStatus(codes.Error, "no block selected")
+		} else {
+			span.SetAttributes(attribute.String("consensus.winner", winner.Hash()))
+		}
+		span.End()
+
+		t.Lock()
+		for _, b := range blocks {
+			tb, ok := t.blocks[b.Hash()]
+			if !ok {
+				continue
+			}
+			tb.span.SetAttributes(attribute.Int64("block.number", int64(b.BlockNumber())))
+			if winner != nil && b.Hash() == winner.Hash() {
+				tb.span.AddEvent("consensus.selected")
+			} else {
+				tb.span.AddEvent("consensus.disqualified")
+			}
+		}
+		t.Unlock()
+
+		return winner
+	}
+}
+
+func sealTraceEnvelope(carrier map[string]string, data []byte) []byte {
+	header, _ := json.Marshal(carrier)
+	buf := make([]byte, 0, len(traceEnvelopeMagic)+2+len(header)+len(data))
+	buf = append(buf, traceEnvelopeMagic...)
+	buf = append(buf, byte(len(header)>>8), byte(len(header)))
+	buf = append(buf, header...)
+	return append(buf, data...)
+}
+
+func openTraceEnvelope(data []byte) ([]byte, map[string]string, bool) {
+	n := len(traceEnvelopeMagic)
+	if len(data) < n+2 || !bytes.Equal(data[:n], traceEnvelopeMagic) {
+		return data, nil, false
+	}
+	size := int(binary.BigEndian.Uint16(data[n:]))
+	if len(data) < n+2+size {
+		return data, nil, false
+	}
+	var carrier map[string]string
+	if err := json.Unmarshal(data[n+2:n+2+size], &carrier); err != nil {
+		return data, nil, false
+	}
+	return data[n+2+size:], carrier, true
+}
@@ -0,0 +1,60 @@
+// Copyright © 2018 J. Strobus White.
+// This file is part of the blocktop blockchain development kit.
+//
+// Blocktop is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// Blocktop is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with blocktop. If not, see <http://www.gnu.org/licenses/>.
+
+package cmd
+
+import (
+	"bytes"
+	"reflect"
+	"testing"
+)
+
+func TestTraceEnvelope(t *testing.T) {
+	carrier := map[string]string{"traceparent": "00-0af7651916cd43dd8448eb211c80319c-b7ad6b7169203331-01"}
+	sealed := sealTraceEnvelope(carrier, []byte("block"))
+
+	tests := []struct {
+		name    string
+		in      []byte
+		data    []byte
+		carrier map[string]string
+		ok      bool
+	}{
+		{"sealed", sealed, []byte("block"), carrier, true},
+		{"empty carrier", sealTraceEnvelope(map[string]string{}, []byte("block")), []byte("block"), map[string]string{}, true},
+		{"empty data", sealTraceEnvelope(carrier, nil), []byte{}, carrier, true},
+		{"plain", []byte("block"), []byte("block"), nil, false},
+		{"empty", nil, nil, nil, false},
+		{"magic only", traceEnvelopeMagic, traceEnvelopeMagic, nil, false},
+		{"truncated header", sealed[:len(traceEnvelopeMagic)+4], sealed[:len(traceEnvelopeMagic)+4], nil, false},
+		{"bad header", append(append([]byte{}, traceEnvelopeMagic...), 0, 2, '{', 'x'), append(append([]byte{}, traceEnvelopeMagic...), 0, 2, '{', 'x'), nil, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			data, carrier, ok := openTraceEnvelope(tt.in)
+			if ok != tt.ok {
+				t.Fatalf("ok = %v, want %v", ok, tt.ok)
+			}
+			if !bytes.Equal(data, tt.data) {
+				t.Errorf("data = %q, want %q", data, tt.data)
+			}
+			if !reflect.DeepEqual(carrier, tt.carrier) {
+				t.Errorf("carrier = %v, want %v", carrier, tt.carrier)
+			}
+		})
+	}
+}
@@ -0,0 +1,47 @@
+// Copyright © 2018 J. Strobus White.
+// This file is part of the blocktop blockchain development kit.
+//
+// Blocktop is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// Blocktop is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with blocktop. If not, see <http://www.gnu.org/licenses/>.
+
+package cmd
+
+import (
+	"embed"
+	"io/fs"
+	"net/http"
+
+	"github.com/spf13/viper"
+)
+
+// The web UI is a static block explorer built on the REST API and the
+// event stream. Its assets are embedded so that it works without network
+// access beyond the API.
+//
+//go:embed webui
+var webUIFiles embed.FS
+
+// routeWebUI serves the web UI at the root path.
+func (s *apiServer) routeWebUI() {
+	if !viper.GetBool("api.ui") {
+		return
+	}
+	files, _ := fs.Sub(webUIFiles, "webui")
+	fileServer := http.FileServer(http.FS(files))
+
+	s.mux.HandleFunc("/", apiGet(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Security-Policy", "default-src 'self'")
+		w.Header().Set("X-Content-Type-Options", "nosniff")
+		fileServer.ServeHTTP(w, r)
+	}))
+}
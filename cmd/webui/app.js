@@ -0,0 +1,399 @@
+// The lucky explorer. It reads the node through the REST API under
+// /api/v1 and refreshes when the event stream reports a change.
+(function () {
+	"use strict";
+
+	var api = "/api/v1";
+	var svgNS = "http://www.w3.org/2000/svg";
+	var maxEvents = 200;
+
+	var state = {
+		blocks: {},
+		selected: null,
+		view: null
+	};
+
+	function $(id) {
+		return document.getElementById(id);
+	}
+
+	function get(path) {
+		return fetch(api + path, {headers: {Accept: "application/json"}}).then(function (res) {
+			return res.json().then(function (body) {
+				if (!res.ok) {
+					throw new Error(body.error || res.statusText);
+				}
+				return body;
+			});
+		});
+	}
+
+	function el(tag, text, cls) {
+		var e = document.createElement(tag);
+		if (text !== undefined) {
+			e.textContent = text;
+		}
+		if (cls) {
+			e.className = cls;
+		}
+		return e;
+	}
+
+	function svg(tag, attrs) {
+		var e = document.createElementNS(svgNS, tag);
+		Object.keys(attrs).forEach(function (k) {
+			e.setAttribute(k, attrs[k]);
+		});
+		return e;
+	}
+
+	function short(hash) {
+		return hash && hash.length > 12 ? hash.slice(0, 6) + "…" + hash.slice(-4) : hash || "";
+	}
+
+	function row(cells) {
+		var tr = el("tr");
+		cells.forEach(function (c) {
+			tr.appendChild(c);
+		});
+		return tr;
+	}
+
+	function fill(tbody, rows, empty) {
+		tbody.textContent = "";
+		if (rows.length === 0) {
+			var td = el("td", empty, "muted");
+			td.colSpan = 4;
+			tbody.appendChild(row([td]));
+		}
+		rows.forEach(function (r) {
+			tbody.appendChild(r);
+		});
+	}
+
+	// Blocks and the consensus tree
+
+	function loadBlocks() {
+		return get("/blocks?limit=500").then(function (page) {
+			var blocks = {};
+			page.items.forEach(function (b) {
+				blocks[b.hash] = b;
+			});
+			state.blocks = blocks;
+			renderHead(page.items);
+			renderBlocks(page.items.slice(0, 20));
+			renderTree();
+		}).catch(function (err) {
+			fill($("blocks"), [], "unavailable: " + err.message);
+		});
+	}
+
+	function renderHead(blocks) {
+		var head = blocks.filter(function (b) {
+			return b.head;
+		})[0];
+		$("head").textContent = head ? "head #" + head.blockNumber + " " + short(head.hash) : "no head yet";
+	}
+
+	function renderBlocks(blocks) {
+		fill($("blocks"), blocks.map(function (b) {
+			var tag = el("td");
+			if (b.head) {
+				tag.appendChild(el("span", "head", "tag"));
+			} else if (b.siblings.length > 0) {
+				tag.appendChild(el("span", b.onHeadChain ? "fork, kept" : "fork", "muted"));
+			}
+			var tr = row([el("td", b.blockNumber, "num"), el("td", short(b.hash), "hash"),
+				el("td", short(b.parentHash), "hash"), tag]);
+			tr.title = b.hash;
+			tr.style.cursor = "pointer";
+			tr.onclick = function () {
+				select(b.hash);
+			};
+			return tr;
+		}), "no blocks yet");
+	}
+
+	// layout places the blocks in columns by number and in lanes by branch:
+	// the chain of the consensus head takes the first lane and every other
+	// branch the next free lane below it.
+	function layout(blocks) {
+		var children = {};
+		var roots = [];
+		Object.keys(blocks).forEach(function (h) {
+			var b = blocks[h];
+			if (blocks[b.parentHash]) {
+				(children[b.parentHash] = children[b.parentHash] || []).push(b);
+			} else {
+				roots.push(b);
+			}
+		});
+
+		function order(list) {
+			return list.sort(function (a, b) {
+				return (b.onHeadChain - a.onHeadChain) || (a.hash < b.hash ? -1 : 1);
+			});
+		}
+
+		var pos = {};
+		var lanes = 0;
+		var min = Infinity;
+		Object.keys(blocks).forEach(function (h) {
+			min = Math.min(min, blocks[h].blockNumber);
+		});
+
+		function place(b, lane) {
+			pos[b.hash] = {x: (b.blockNumber - min) * 70 + 40, y: lane * 44 + 30};
+			order(children[b.hash] || []).forEach(function (c, i) {
+				place(c, i === 0 ? lane : lanes++);
+			});
+		}
+		order(roots).forEach(function (r) {
+			place(r, lanes++);
+		});
+		return {pos: pos, lanes: lanes};
+	}
+
+	function renderTree() {
+		var tree = $("tree");
+		tree.textContent = "";
+		var blocks = state.blocks;
+		var l = layout(blocks);
+
+		var width = 80;
+		Object.keys(l.pos).forEach(function (h) {
+			width = Math.max(width, l.pos[h].x + 40);
+		});
+		if (!state.view) {
+			var box = tree.getBoundingClientRect();
+			state.view = {x: Math.max(0, width - box.width), y: 0, w: box.width || 800, h: box.height || 320};
+		}
+		setView();
+
+		var edges = svg("g", {});
+		var nodes = svg("g", {});
+		tree.appendChild(edges);
+		tree.appendChild(nodes);
+
+		Object.keys(blocks).forEach(function (h) {
+			var b = blocks[h];
+			var p = l.pos[h];
+			var pp = l.pos[b.parentHash];
+			if (pp) {
+				edges.appendChild(svg("line", {x1: pp.x, y1: pp.y, x2: p.x, y2: p.y,
+					"class": b.onHeadChain ? "chain" : ""}));
+			}
+
+			var cls = [];
+			if (b.onHeadChain) {
+				cls.push("chain");
+			}
+			if (b.head) {
+				cls.push("head");
+			}
+			if (h === state.selected) {
+				cls.push("selected");
+			}
+			var c = svg("circle", {cx: p.x, cy: p.y, r: 9, "class": cls.join(" ")});
+			var title = svg("title", {});
+			title.textContent = "#" + b.blockNumber + " " + b.hash;
+			c.appendChild(title);
+			c.addEventListener("click", function (e) {
+				e.stopPropagation();
+				select(h);
+			});
+			nodes.appendChild(c);
+
+			var label = svg("text", {x: p.x, y: p.y + 22, "text-anchor": "middle"});
+			label.textContent = b.blockNumber;
+			nodes.appendChild(label);
+		});
+	}
+
+	function setView() {
+		var v = state.view;
+		$("tree").setAttribute("viewBox", [v.x, v.y, v.w, v.h].join(" "));
+	}
+
+	function select(hash) {
+		state.selected = hash;
+		renderTree();
+
+		var detail = $("block-detail");
+		detail.hidden = false;
+		detail.textContent = "";
+		get("/blocks/" + encodeURIComponent(hash)).then(function (b) {
+			var dl = el("table");
+			[["Hash", b.hash], ["Number", b.blockNumber], ["Parent", b.parentHash],
+				["Head", b.head ? "yes" : "no"], ["On head chain", b.onHeadChain ? "yes" : "no"],
+				["Children", b.children.join(", ") || "none"], ["Siblings", b.siblings.join(", ") || "none"]
+			].forEach(function (f) {
+				dl.appendChild(row([el("th", f[0]), el("td", f[1], "hash")]));
+			});
+			detail.appendChild(dl);
+		}).catch(function (err) {
+			detail.textContent = "Block " + hash + ": " + err.message;
+		});
+	}
+
+	function enablePanZoom() {
+		var tree = $("tree");
+		var drag = null;
+
+		tree.addEventListener("mousedown", function (e) {
+			drag = {x: e.clientX, y: e.clientY, vx: state.view.x, vy: state.view.y};
+			tree.classList.add("dragging");
+		});
+		window.addEventListener("mousemove", function (e) {
+			if (!drag) {
+				return;
+			}
+			var scale = state.view.w / tree.getBoundingClientRect().width;
+			state.view.x = drag.vx - (e.clientX - drag.x) * scale;
+			state.view.y = drag.vy - (e.clientY - drag.y) * scale;
+			setView();
+		});
+		window.addEventListener("mouseup", function () {
+			drag = null;
+			tree.classList.remove("dragging");
+		});
+		tree.addEventListener("wheel", function (e) {
+			e.preventDefault();
+			var box = tree.getBoundingClientRect();
+			var v = state.view;
+			var f = e.deltaY > 0 ? 1.15 : 1 / 1.15;
+			var px = v.x + (e.clientX - box.left) / box.width * v.w;
+			var py = v.y + (e.clientY - box.top) / box.height * v.h;
+			v.w *= f;
+			v.h *= f;
+			v.x = px - (px - v.x) * f;
+			v.y = py - (py - v.y) * f;
+			setView();
+		}, {passive: false});
+	}
+
+	// Peers and metrics
+
+	function loadPeers() {
+		return get("/peers?limit=500").then(function (page) {
+			$("peer-count").textContent = "(" + page.total + ")";
+			fill($("peers"), page.items.map(function (p) {
+				var offenses = Object.keys(p.offenses || {}).map(function (k) {
+					return k + " ×" + p.offenses[k];
+				}).join(", ");
+				var id = el("td", short(p.peerID), "hash");
+				id.title = p.peerID + "\n" + (p.addrs || []).join("\n");
+				return row([id, el("td", p.score.toFixed(1), "num"), el("td", offenses)]);
+			}), "no peers connected");
+		}).catch(function (err) {
+			fill($("peers"), [], "unavailable: " + err.message);
+		});
+	}
+
+	function flatten(prefix, v, out) {
+		if (v !== null && typeof v === "object") {
+			Object.keys(v).forEach(function (k) {
+				flatten(prefix ? prefix + "." + k : k, v[k], out);
+			});
+		} else {
+			out.push([prefix, v]);
+		}
+		return out;
+	}
+
+	function loadMetrics() {
+		return get("/kernel/metrics").then(function (m) {
+			if (typeof m === "string") {
+				try {
+					m = JSON.parse(m);
+				} catch (e) {
+					m = {metrics: m};
+				}
+			}
+			fill($("metrics"), flatten("", m, []).map(function (f) {
+				return row([el("th", f[0]), el("td", f[1], typeof f[1] === "number" ? "num" : "")]);
+			}), "no metrics");
+		}).catch(function (err) {
+			fill($("metrics"), [], "unavailable: " + err.message);
+		});
+	}
+
+	// Events
+
+	var pending = {};
+	var timer = null;
+
+	// refresh reloads the given parts once events have settled.
+	function refresh(parts) {
+		parts.forEach(function (p) {
+			pending[p] = true;
+		});
+		if (timer) {
+			return;
+		}
+		timer = setTimeout(function () {
+			var p = pending;
+			pending = {};
+			timer = null;
+			if (p.blocks) {
+				loadBlocks();
+			}
+			if (p.peers) {
+				loadPeers();
+			}
+		}, 500);
+	}
+
+	function logEvent(e) {
+		var list = $("events");
+		var data = e.data || {};
+		var subject = data.hash ? short(data.hash) : short(data.peer);
+		var li = el("li");
+		li.appendChild(el("span", new Date(e.time).toLocaleTimeString() + " ", "muted"));
+		li.appendChild(el("span", e.type + " "));
+		li.appendChild(el("span", subject, "hash"));
+		list.insertBefore(li, list.firstChild);
+		while (list.childNodes.length > maxEvents) {
+			list.removeChild(list.lastChild);
+		}
+	}
+
+	function connectEvents() {
+		var status = $("status");
+		var source = new EventSource(api + "/events");
+
+		source.onopen = function () {
+			status.textContent = "live";
+			status.className = "status live";
+		};
+		source.onerror = function () {
+			status.textContent = "reconnecting";
+			status.className = "status down";
+		};
+		source.onmessage = function (m) {
+			handleEvent(JSON.parse(m.data));
+		};
+		["blockProduced", "blockReceived", "peerConnected", "peerDisconnected",
+			"branchCreated", "branchPruned", "headChanged", "blockConfirmed"].forEach(function (t) {
+			source.addEventListener(t, function (m) {
+				handleEvent(JSON.parse(m.data));
+			});
+		});
+	}
+
+	function handleEvent(e) {
+		logEvent(e);
+		if (e.type.indexOf("peer") === 0) {
+			refresh(["peers"]);
+		} else {
+			refresh(["blocks"]);
+		}
+	}
+
+	enablePanZoom();
+	loadBlocks();
+	loadPeers();
+	loadMetrics();
+	connectEvents();
+	setInterval(loadMetrics, 10000);
+})();